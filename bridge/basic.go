@@ -23,6 +23,15 @@ func newBasicBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, dial
 		log.Error(`dialer not found`, `dialer`, opts.Dialer.Tag)
 		return
 	}
+	limits := network.NewLimits(log, &opts.Dialer)
+	via, e := dialer.Via(log, dialers, opts.Via)
+	if e != nil {
+		return
+	}
+	limits.Mirror, e = dialer.NewMirror(log, dialers, &opts.Dialer)
+	if e != nil {
+		return
+	}
 	var (
 		network = `tcp`
 		addr    = u.Host
@@ -50,25 +59,37 @@ func newBasicBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, dial
 	}
 	var cfg *tls.Config
 	if secure {
-		cfg = &tls.Config{
-			ServerName:         u.Hostname(),
-			InsecureSkipVerify: opts.AllowInsecure,
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
 		}
 	}
+	encrypted := u.Scheme == dialer.BasicPsk
+	if encrypted && opts.PSK == `` {
+		e = dialer.ErrPskEmpty
+		log.Error(`new dialer fail`, `error`, e)
+		return
+	}
 	tag := opts.Tag
 	if tag == `` {
 		if secure {
 			tag = `basic ` + network + `+tls://` + addr
+		} else if encrypted {
+			tag = `basic ` + network + `+psk://` + addr
 		} else {
 			tag = `basic ` + network + `://` + addr
 		}
 	}
 	log = log.With(`bridge`, tag, `dialer`, opts.Dialer.Tag)
-	rawDialer, e := nk.Dialer(network, addr, cfg)
+	rawDialer, e := dialer.RawDialer(nk, via, network, addr, cfg)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
 	}
+	if encrypted {
+		rawDialer = dialer.PSKDialer(rawDialer, opts.PSK)
+	}
 
 	var closeDuration time.Duration
 	if opts.Dialer.Close == `` {
@@ -96,9 +117,9 @@ func newBasicBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, dial
 		}),
 		reverse.WithListenerSynAck(true),
 	)
-	bridge = newBridge(log, l, rawDialer,
+	bridge = newBridge(nk, log, l, rawDialer,
 		pool,
-		found, closeDuration,
+		found, closeDuration, limits,
 		tag, network, addr, opts.URL,
 	)
 	return
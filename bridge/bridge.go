@@ -11,6 +11,7 @@ import (
 
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/internal/network"
 	"github.com/powerpuffpenguin/streamf/pool"
 	"github.com/powerpuffpenguin/vnet/reverse"
@@ -30,7 +31,11 @@ func New(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[str
 	}
 	switch u.Scheme {
 	case dialer.Socks:
-		b, e = newSocksBridge(log, pool, dialers, opts, u)
+		b, e = newSocksBridge(nk, log, pool, dialers, opts, u)
+	case dialer.HttpConnect:
+		b, e = newHttpConnectBridge(nk, log, pool, dialers, opts, u, false)
+	case dialer.HttpsConnect:
+		b, e = newHttpConnectBridge(nk, log, pool, dialers, opts, u, true)
 	case dialer.Http:
 		b, e = newHttpBridge(nk, log, pool, dialers, opts, u, false)
 	case dialer.HttpTls:
@@ -43,6 +48,8 @@ func New(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[str
 		b, e = newBasicBridge(nk, log, pool, dialers, opts, u, false)
 	case dialer.BasicTls:
 		b, e = newBasicBridge(nk, log, pool, dialers, opts, u, true)
+	case dialer.BasicPsk:
+		b, e = newBasicBridge(nk, log, pool, dialers, opts, u, false)
 	default:
 		e = errors.New(`url scheme not supported: ` + opts.URL)
 		log.Error(`url scheme not supported`, `url`, opts.URL)
@@ -53,6 +60,7 @@ func New(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[str
 type bridge struct {
 	tag, network, addr, url string
 
+	nk       *network.Network
 	done     chan struct{}
 	closed   uint32
 	log      *slog.Logger
@@ -62,14 +70,16 @@ type bridge struct {
 	pool          *pool.Pool
 	dialer        dialer.Dialer
 	closeDuration time.Duration
+	limits        network.Limits
 }
 
-func newBridge(log *slog.Logger, l *reverse.Listener, closer io.Closer,
+func newBridge(nk *network.Network, log *slog.Logger, l *reverse.Listener, closer io.Closer,
 	pool *pool.Pool,
-	dialer dialer.Dialer, closeDuration time.Duration,
+	dialer dialer.Dialer, closeDuration time.Duration, limits network.Limits,
 	tag, network, addr, url string,
 ) *bridge {
 	return &bridge{
+		nk:       nk,
 		done:     make(chan struct{}),
 		log:      log,
 		listener: l,
@@ -78,6 +88,7 @@ func newBridge(log *slog.Logger, l *reverse.Listener, closer io.Closer,
 		pool:          pool,
 		dialer:        dialer,
 		closeDuration: closeDuration,
+		limits:        limits,
 
 		tag:     tag,
 		network: network,
@@ -132,6 +143,7 @@ func (b *bridge) Serve() (e error) {
 			time.Sleep(tempDelay)
 			continue
 		}
+		metrics.Accepted.With(b.tag).Inc()
 		go b.serve(rw)
 	}
 }
@@ -151,7 +163,12 @@ func (b *bridge) serve(rw io.ReadWriteCloser) {
 		`secure`, addr.Secure,
 		`url`, addr.URL,
 	)
-	network.Bridging(rw, dst.ReadWriteCloser, b.pool, b.closeDuration)
+	b.nk.Bridging(network.Metadata{
+		Listener: b.tag,
+		Client:   b.addr,
+		Dialer:   addr.Dialer,
+		Remote:   addr.Addr,
+	}, rw, dst.ReadWriteCloser, b.pool, b.closeDuration, b.limits)
 }
 
 type emptyAddress struct {
@@ -28,6 +28,15 @@ func newHttpBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, diale
 		log.Error(`dialer not found`, `dialer`, opts.Dialer.Tag)
 		return
 	}
+	limits := network.NewLimits(log, &opts.Dialer)
+	via, e := dialer.Via(log, dialers, opts.Via)
+	if e != nil {
+		return
+	}
+	limits.Mirror, e = dialer.NewMirror(log, dialers, &opts.Dialer)
+	if e != nil {
+		return
+	}
 	method := strings.ToUpper(opts.Method)
 	switch method {
 	case ``:
@@ -53,11 +62,12 @@ func newHttpBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, diale
 	}
 	var cfg *tls.Config
 	if secure {
-		cfg = &tls.Config{
-			NextProtos:         []string{`h2`},
-			ServerName:         u.Hostname(),
-			InsecureSkipVerify: opts.AllowInsecure,
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
 		}
+		cfg.NextProtos = []string{`h2`}
 	}
 	tag := opts.Tag
 	if tag == `` {
@@ -68,7 +78,7 @@ func newHttpBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, diale
 		}
 	}
 	log = log.With(`bridge`, tag, `dialer`, opts.Dialer.Tag)
-	rawDialer, e := nk.Dialer(network, addr, cfg)
+	rawDialer, e := dialer.RawDialer(nk, via, network, addr, cfg)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
@@ -148,9 +158,9 @@ func newHttpBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, diale
 		}),
 		reverse.WithListenerSynAck(true),
 	)
-	bridge = newBridge(log, l, rawDialer,
+	bridge = newBridge(nk, log, l, rawDialer,
 		pool,
-		found, closeDuration,
+		found, closeDuration, limits,
 		tag, network, addr, opts.URL,
 	)
 	return
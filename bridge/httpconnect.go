@@ -0,0 +1,127 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/httpmux"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/pool"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func newHttpConnectBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[string]dialer.Dialer, opts *config.Bridge, u *url.URL, secure bool) (bridge *bridge, e error) {
+	found, ok := dialers[opts.Dialer.Tag]
+	if !ok {
+		e = errors.New(`dialer not found: ` + opts.Dialer.Tag)
+		log.Error(`dialer not found`, `dialer`, opts.Dialer.Tag)
+		return
+	}
+	limits := network.NewLimits(log, &opts.Dialer)
+	via, e := dialer.Via(log, dialers, opts.Via)
+	if e != nil {
+		return
+	}
+	limits.Mirror, e = dialer.NewMirror(log, dialers, &opts.Dialer)
+	if e != nil {
+		return
+	}
+	var (
+		network = `tcp`
+		addr    = u.Host
+		query   url.Values
+	)
+	if opts.Network != `` {
+		network = opts.Network
+	} else {
+		query = u.Query()
+		s := query.Get(`network`)
+		if s != `` {
+			network = s
+		}
+	}
+	if opts.Addr != `` {
+		addr = opts.Addr
+	} else {
+		if query == nil {
+			query = u.Query()
+		}
+		s := query.Get(`addr`)
+		if s != `` {
+			addr = s
+		}
+	}
+	var cfg *tls.Config
+	if secure {
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
+		}
+	}
+	tag := opts.Tag
+	if tag == `` {
+		if secure {
+			tag = `httpconnect ` + network + `+tls://` + addr
+		} else {
+			tag = `httpconnect ` + network + `://` + addr
+		}
+	}
+	log = log.With(`bridge`, tag, `dialer`, opts.Dialer.Tag)
+	rawDialer, e := dialer.RawDialer(nk, via, network, addr, cfg)
+	if e != nil {
+		log.Error(`new dialer fail`, `error`, e)
+		return
+	}
+	header := make(http.Header, 1)
+	if opts.HttpConnect.User != `` || opts.HttpConnect.Password != `` {
+		header.Set(`Proxy-Authorization`, httpmux.ProxyAuthorization(opts.HttpConnect.User, opts.HttpConnect.Password))
+	}
+	connect := opts.HttpConnect.Connect
+
+	var closeDuration time.Duration
+	if opts.Dialer.Close == `` {
+		closeDuration = time.Second
+	} else {
+		var err error
+		closeDuration, err = time.ParseDuration(opts.Dialer.Close)
+		if err != nil {
+			closeDuration = time.Second
+			log.Warn(`parse duration fail, used default close duration.`,
+				`error`, err,
+				`close`, opts.Dialer.Close,
+				`default`, closeDuration,
+			)
+		}
+	}
+	log.Info(`new httpconnect bridge`,
+		`network`, network,
+		`addr`, addr,
+		`url`, opts.URL,
+		`connect`, connect,
+	)
+	l := reverse.Listen(emptyAddress{},
+		reverse.WithListenerDialContext(func(ctx context.Context, network, address string) (c net.Conn, e error) {
+			c, e = rawDialer.DialContext(ctx)
+			if e != nil {
+				return
+			}
+			return httpmux.ConnectProxy(ctx, c, connect, header.Clone())
+		}),
+		reverse.WithListenerSynAck(true),
+	)
+	bridge = newBridge(nk, log, l, rawDialer,
+		pool,
+		found, closeDuration, limits,
+		tag, network, addr, opts.URL,
+	)
+	return
+}
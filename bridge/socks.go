@@ -10,18 +10,28 @@ import (
 
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/network"
 	"github.com/powerpuffpenguin/streamf/pool"
 	"github.com/powerpuffpenguin/vnet/reverse"
 	"golang.org/x/net/proxy"
 )
 
-func newSocksBridge(log *slog.Logger, pool *pool.Pool, dialers map[string]dialer.Dialer, opts *config.Bridge, u *url.URL) (bridge *bridge, e error) {
+func newSocksBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[string]dialer.Dialer, opts *config.Bridge, u *url.URL) (bridge *bridge, e error) {
 	found, ok := dialers[opts.Dialer.Tag]
 	if !ok {
 		e = errors.New(`dialer not found: ` + opts.Dialer.Tag)
 		log.Error(`dialer not found`, `dialer`, opts.Dialer.Tag)
 		return
 	}
+	limits := network.NewLimits(log, &opts.Dialer)
+	via, e := dialer.Via(log, dialers, opts.Via)
+	if e != nil {
+		return
+	}
+	limits.Mirror, e = dialer.NewMirror(log, dialers, &opts.Dialer)
+	if e != nil {
+		return
+	}
 	var (
 		network = `tcp`
 		addr    = u.Host
@@ -59,7 +69,17 @@ func newSocksBridge(log *slog.Logger, pool *pool.Pool, dialers map[string]dialer
 		tag = `socks ` + network + `://` + addr
 	}
 	log = log.With(`bridge`, tag, `dialer`, opts.Dialer.Tag)
-	rawDialer, e := proxy.SOCKS5(network, addr, auth, proxy.Direct)
+	var forward proxy.Dialer = proxy.Direct
+	if via != nil {
+		viaDialer, err := dialer.RawDialer(nk, via, network, addr, nil)
+		if err != nil {
+			e = err
+			log.Error(`new dialer fail`, `error`, e)
+			return
+		}
+		forward = dialer.ForwardDialer{Dialer: viaDialer}
+	}
+	rawDialer, e := proxy.SOCKS5(network, addr, auth, forward)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
@@ -93,9 +113,9 @@ func newSocksBridge(log *slog.Logger, pool *pool.Pool, dialers map[string]dialer
 		}),
 		reverse.WithListenerSynAck(true),
 	)
-	bridge = newBridge(log, l, nil,
+	bridge = newBridge(nk, log, l, nil,
 		pool,
-		found, closeDuration,
+		found, closeDuration, limits,
 		tag, network, addr, opts.URL,
 	)
 	return
@@ -27,6 +27,15 @@ func newWebsocketBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool,
 		log.Error(`dialer not found`, `dialer`, opts.Dialer.Tag)
 		return
 	}
+	limits := network.NewLimits(log, &opts.Dialer)
+	via, e := dialer.Via(log, dialers, opts.Via)
+	if e != nil {
+		return
+	}
+	limits.Mirror, e = dialer.NewMirror(log, dialers, &opts.Dialer)
+	if e != nil {
+		return
+	}
 	var (
 		network = `tcp`
 		addr    = u.Host
@@ -46,7 +55,15 @@ func newWebsocketBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool,
 		}
 	}
 	log = log.With(`bridge`, tag, `dialer`, opts.Dialer.Tag, `fast`, opts.Fast)
-	rawDialer, e := nk.Dialer(network, addr, nil)
+	var cfg *tls.Config
+	if secure {
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
+		}
+	}
+	rawDialer, e := dialer.RawDialer(nk, via, network, addr, nil)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
@@ -67,10 +84,7 @@ func newWebsocketBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool,
 		},
 	}
 	if secure {
-		websocketDialer.TLSClientConfig = &tls.Config{
-			ServerName:         u.Hostname(),
-			InsecureSkipVerify: opts.AllowInsecure,
-		}
+		websocketDialer.TLSClientConfig = cfg
 	}
 
 	var closeDuration time.Duration
@@ -106,9 +120,9 @@ func newWebsocketBridge(nk *network.Network, log *slog.Logger, pool *pool.Pool,
 		}),
 		reverse.WithListenerSynAck(true),
 	)
-	bridge = newBridge(log, l, rawDialer,
+	bridge = newBridge(nk, log, l, rawDialer,
 		pool,
-		found, closeDuration,
+		found, closeDuration, limits,
 		tag, network, addr, opts.URL,
 	)
 	return
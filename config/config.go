@@ -20,6 +20,9 @@ type Config struct {
 	Bridge []*Bridge `json:"bridge"`
 	// udp forward
 	UDP []*UDPForward `json:"udp"`
+	// On SIGTERM/SIGINT, how long to wait for bridged connections to finish before closing them
+	// Default "30s"
+	Drain string `json:"drain"`
 }
 
 func (c *Config) Load(filename string) (e error) {
@@ -0,0 +1,24 @@
+package config
+
+// ConnectProxy settings of listener mode "connect"
+type ConnectProxy struct {
+	// Allowed destination patterns, empty allows all destinations.
+	// A pattern is matched against both "host" and "host:port", for example
+	//  * "*.example.com"
+	//  * "example.com:443"
+	//  * "10.0.0.*:22"
+	Allow []string `json:"allow"`
+	// Optional Proxy-Authorization basic auth
+	Auth []BasicAuth `json:"auth"`
+	// Read request header and direct connect timeout, default 10s
+	Timeout string `json:"timeout"`
+}
+
+// HttpConnect settings of "httpconnect://" and "httpsconnect://"
+type HttpConnect struct {
+	// Optional Proxy-Authorization basic auth
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// The final address to be connected to through the proxy
+	Connect string `json:"connect"`
+}
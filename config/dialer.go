@@ -1,5 +1,14 @@
 package config
 
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"os"
+)
+
 type Dialer struct {
 	// Must be unique
 	Tag string `json:"tag"`
@@ -12,19 +21,59 @@ type Dialer struct {
 	//  * "http://host/path"
 	//  * "https://host/path"
 	//  * "socks://host:port"
+	//  * "httpconnect://host:port"
+	//  * "httpsconnect://host:port"
 	//  * "basic://host:port"
 	//  * "basic+tls://host:port"
+	//  * "basic+psk://host:port"
+	//  * "group://"
 	URL string `json:"url"`
 	// optional connect address
 	Addr string `json:"addr"`
 	// optional network
 	Network string `json:"network"`
+	// Optional dialer tag, the transport connection is made by the Connect of that dialer instead of dialing addr.
+	// It must be defined before this dialer
+	Via string `json:"via"`
 	// If true, only websocket handshake is used, and tcp communication is used directly after the handshake is successful.
 	Fast bool `json:"fast"`
-	// If true, do not verify whether the certificate is valid when connecting to the tls server
-	AllowInsecure bool `json:"allowInsecure"`
+	// tls settings when connecting to the tls server
+	DialerTLS
+	// Pre-shared secret of "basic+psk", the connection is encrypted with AES-256-GCM keyed from it
+	PSK string `json:"psk"`
 	// If dialing fails, how many times to retry
 	Retry int `json:"retry"`
+	// Optional PROXY protocol header sent to the destination carrying the client address, "v1" or "v2".
+	// Supported by "basic", "basic+tls", "basic+psk", "ws", "wss", "socks", "httpconnect" and "httpsconnect"
+	ProxyProtocol string `json:"proxyProtocol"`
+
+	// Member dialers of "group://", they must be defined before the group
+	Members []GroupMember `json:"members"`
+	// How "group://" picks a member
+	//  * "round-robin" (default)
+	//  * "weighted"
+	//  * "least-conn"
+	//  * "hash", consistent hash on client address
+	Balance string `json:"balance"`
+
+	// Active health checking
+	Health Health `json:"health"`
+	// Optional dialer tag used while this dialer is unhealthy, it must be defined before this dialer
+	Fallback string `json:"fallback"`
+	// Bandwidth shared by all bridged connections connected by this dialer
+	Rate Rate `json:"rate"`
+	// Open the connections as streams multiplexed on a few carrier connections,
+	// supported by "basic", "basic+tls", "basic+psk", "ws", "wss", "http" and "https"
+	Mux Mux `json:"mux"`
+	// Connections connected in advance and kept ready, Connect hands out one of them without waiting for the handshake.
+	// Supported by "basic", "basic+tls", "basic+psk", "ws", "wss", "socks", "httpconnect" and "httpsconnect"
+	Preconnect int `json:"preconnect"`
+	// How long a preconnected connection is kept unused before it is closed and replaced.
+	// Default '30s', less than '1s' never expires
+	MaxIdle string `json:"maxIdle"`
+	// Compress the connections with this algorithm, the listener or router connected must use the same one.
+	// "deflate", "zstd" or "snappy"
+	Compress string `json:"compress"`
 	// http method, default "POST"
 	Method string `json:"method"`
 	// Optional credentials, only valid for http protocol
@@ -42,6 +91,8 @@ type Dialer struct {
 	UDP UDP `json:"udp"`
 	// Socks settings
 	Socks Socks `json:"socks"`
+	// http CONNECT proxy settings
+	HttpConnect HttpConnect `json:"httpConnect"`
 }
 type Bridge struct {
 	Tag string `json:"tag"`
@@ -50,17 +101,25 @@ type Bridge struct {
 	//  * "wss://host/path"
 	//  * "http://host/path"
 	//  * "https://host/path"
+	//  * "socks://host:port"
+	//  * "httpconnect://host:port"
+	//  * "httpsconnect://host:port"
 	//  * "basic://host:port"
 	//  * "basic+tls://host:port"
+	//  * "basic+psk://host:port"
 	URL string `json:"url"`
 	// optional connect address
 	Addr string `json:"addr"`
 	// optional network
 	Network string `json:"network"`
+	// Optional dialer tag, the transport connection is made by the Connect of that dialer instead of dialing addr
+	Via string `json:"via"`
 	// If true, only websocket handshake is used, and tcp communication is used directly after the handshake is successful.
 	Fast bool `json:"fast"`
-	// If true, do not verify whether the certificate is valid when connecting to the tls server
-	AllowInsecure bool `json:"allowInsecure"`
+	// tls settings when connecting to the tls server
+	DialerTLS
+	// Pre-shared secret of "basic+psk", the connection is encrypted with AES-256-GCM keyed from it
+	PSK string `json:"psk"`
 	// http method, default "POST"
 	Method string `json:"method"`
 	// Optional credentials, only valid for http protocol
@@ -75,4 +134,150 @@ type Bridge struct {
 
 	// Socks settings
 	Socks Socks `json:"socks"`
+	// http CONNECT proxy settings
+	HttpConnect HttpConnect `json:"httpConnect"`
+}
+
+// Mux multiplexes streams over long-lived carrier connections between two streamf
+type Mux struct {
+	// If true, dialers open streams on carrier connections, listeners and routers accept streams on their connections
+	Enable bool `json:"enable"`
+	// Carrier connections kept by a dialer, default 1
+	Connections int `json:"connections"`
+	// How often a ping is sent on a carrier, a carrier receiving nothing for 3 intervals is closed.
+	// Default '30s', less than '1s' disables
+	Keepalive string `json:"keepalive"`
+}
+
+// DialerTLS configures the tls connections of a dialer or bridge
+type DialerTLS struct {
+	// If true, do not verify whether the certificate is valid when connecting to the tls server
+	AllowInsecure bool `json:"allowInsecure"`
+	// PEM of the CAs that verify the server certificate, default the system CAs
+	CA     string `json:"ca"`
+	CAFile string `json:"caFile"`
+	// Optional client certificate presented to the server
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	// Server name sent in SNI and verified, default the host of url
+	ServerName string `json:"serverName"`
+	// Base64 sha256 of the SubjectPublicKeyInfo of the certificates the server is pinned to.
+	// If not empty, a certificate of the verified chain must match one of them,
+	// or the server certificate if allowInsecure is true
+	Pin []string `json:"pin"`
+	// Minimum tls version '1.0' '1.1' '1.2' or '1.3', default '1.2'
+	MinVersion string `json:"minVersion"`
+	// Names of the cipher suites enabled for tls 1.2 and below, such as 'TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256'.
+	// Default go's secure cipher suites
+	CipherSuites []string `json:"cipherSuites"`
+}
+
+// TLSConfig returns the tls config connecting to the server with host name
+func (t *DialerTLS) TLSConfig(host string) (cfg *tls.Config, e error) {
+	cfg = &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: t.AllowInsecure,
+	}
+	if t.ServerName != `` {
+		cfg.ServerName = t.ServerName
+	}
+	var pem []byte
+	if t.CA != `` {
+		pem = []byte(t.CA)
+	} else if t.CAFile != `` {
+		pem, e = os.ReadFile(t.CAFile)
+		if e != nil {
+			return
+		}
+	}
+	if pem != nil {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			e = errors.New(`no certificate found in ca`)
+			return
+		}
+	}
+	var certificate tls.Certificate
+	if t.Cert != `` && t.Key != `` {
+		certificate, e = tls.X509KeyPair([]byte(t.Cert), []byte(t.Key))
+	} else if t.CertFile != `` && t.KeyFile != `` {
+		certificate, e = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	}
+	if e != nil {
+		return
+	} else if certificate.Certificate != nil {
+		cfg.Certificates = []tls.Certificate{certificate}
+	}
+	switch t.MinVersion {
+	case ``:
+	case `1.0`:
+		cfg.MinVersion = tls.VersionTLS10
+	case `1.1`:
+		cfg.MinVersion = tls.VersionTLS11
+	case `1.2`:
+		cfg.MinVersion = tls.VersionTLS12
+	case `1.3`:
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		e = errors.New(`tls version not supported: ` + t.MinVersion)
+		return
+	}
+	if len(t.CipherSuites) != 0 {
+		cfg.CipherSuites, e = cipherSuites(t.CipherSuites)
+		if e != nil {
+			return
+		}
+	}
+	if len(t.Pin) != 0 {
+		pins := make(map[string]bool, len(t.Pin))
+		for _, pin := range t.Pin {
+			pins[pin] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPin(cs, pins)
+		}
+	}
+	return
+}
+func cipherSuites(names []string) (ids []uint16, e error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids = make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			e = errors.New(`cipher suite not supported: ` + name)
+			return
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// verifyPin checks the certificates of the verified chains, or the server certificate if it is not verified
+func verifyPin(cs tls.ConnectionState, pins map[string]bool) error {
+	var certs []*x509.Certificate
+	if len(cs.VerifiedChains) == 0 {
+		if len(cs.PeerCertificates) != 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+	} else {
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return errors.New(`server certificate does not match any pin`)
 }
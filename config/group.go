@@ -0,0 +1,28 @@
+package config
+
+import "encoding/json"
+
+type GroupMember struct {
+	// Member dialer tag
+	Tag string `json:"tag"`
+	// Only valid for "weighted", default 1
+	Weight int `json:"weight"`
+}
+
+// UnmarshalJSON accepts either a dialer tag string or a {tag, weight} object
+func (m *GroupMember) UnmarshalJSON(b []byte) (e error) {
+	var tag string
+	if json.Unmarshal(b, &tag) == nil {
+		m.Tag = tag
+		m.Weight = 0
+		return
+	}
+	type member GroupMember
+	var v member
+	e = json.Unmarshal(b, &v)
+	if e != nil {
+		return
+	}
+	*m = GroupMember(v)
+	return
+}
@@ -0,0 +1,20 @@
+package config
+
+type Health struct {
+	// How to probe the dialer, empty disables health checking
+	//  * "tcp" connect to the dialer address
+	//  * "tls" tls handshake with the dialer address
+	//  * "http" http GET the url through the dialer address, 2xx and 3xx are healthy
+	//  * "websocket" websocket handshake, only valid for ws/wss dialer
+	Type string `json:"type"`
+	// Probe url for "http"
+	URL string `json:"url"`
+	// How often to probe, default 10s
+	Interval string `json:"interval"`
+	// Probe timeout, default 2s
+	Timeout string `json:"timeout"`
+	// How many consecutive successes mark an unhealthy dialer healthy, default 2
+	Rise int `json:"rise"`
+	// How many consecutive failures mark a healthy dialer unhealthy, default 3
+	Fall int `json:"fall"`
+}
@@ -2,6 +2,9 @@ package config
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
 )
 
 type BasicListener struct {
@@ -11,8 +14,45 @@ type BasicListener struct {
 	Addr    string `json:"addr"`
 
 	TLS TLS `json:"tls"`
+	// If not empty, connections are encrypted with this pre-shared secret like "basic+psk" dialers and bridges do,
+	// it can not be used with tls
+	PSK string `json:"psk"`
 	// udp settings
 	UDP UDP `json:"udp"`
+	// If true, every connection must start with a PROXY protocol v1 or v2 header,
+	// the client address it carries is used in place of the connection's remote address
+	ProxyProtocol bool `json:"proxyProtocol"`
+	// Bandwidth shared by all connections of the listener
+	Rate Rate `json:"rate"`
+	// Bandwidth of each client ip
+	ClientRate Rate `json:"clientRate"`
+	Admission
+	ACL
+	// Accept streams multiplexed on the connections by a dialer with mux enabled, supported by "basic" mode
+	Mux Mux `json:"mux"`
+	// Decompress the connections compressed by a dialer with the same compress, supported by "basic" mode
+	Compress string `json:"compress"`
+	// CIDRs of the reverse proxies in front of a http listener,
+	// for requests from them the client address is taken from X-Forwarded-For when checking allow and deny
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// ACL restricts the client addresses, it is checked before any dialer is contacted
+type ACL struct {
+	// If not empty, only clients in these CIDRs or ips are allowed
+	Allow []string `json:"allow"`
+	// Clients in these CIDRs or ips are rejected, deny takes precedence over allow
+	Deny []string `json:"deny"`
+}
+
+// Admission limits the connections accepted, over-limit connections are rejected
+type Admission struct {
+	// Reject new connections while this many are open, 0 disables
+	MaxConnections int `json:"maxConnections"`
+	// Reject new connections of a client ip while it has this many open, 0 disables
+	MaxConnectionsPerIP int `json:"maxConnectionsPerIP"`
+	// Reject new connections accepted faster than this many per second, 0 disables
+	AcceptRate int `json:"acceptRate"`
 }
 type TLS struct {
 	CertFile string   `json:"certFile"`
@@ -20,6 +60,16 @@ type TLS struct {
 	Cert     string   `json:"cert"`
 	Key      string   `json:"key"`
 	Alpn     []string `json:"alpn"`
+	// How often certFile and keyFile are checked for changes, the changed certificate is reloaded.
+	// Default '1m', less than '1s' disables
+	Reload string `json:"reload"`
+	// PEM of the CAs that verify client certificates
+	ClientCA     string `json:"clientCA"`
+	ClientCAFile string `json:"clientCAFile"`
+	// How client certificates are verified, 'none' 'request' 'require' 'verify' or 'require-and-verify'.
+	// 'verify' verifies the certificate if given, 'request' and 'require' do not verify it.
+	// Default 'require-and-verify' if a client CA is set, otherwise 'none'
+	ClientAuth string `json:"clientAuth"`
 }
 
 func (t *TLS) Secure() bool {
@@ -46,19 +96,67 @@ func (t *TLS) Certificate() (secure bool, certificate tls.Certificate, alpn []st
 	return
 }
 
+// ClientVerify returns how the listener verifies client certificates
+func (t *TLS) ClientVerify() (auth tls.ClientAuthType, cas *x509.CertPool, e error) {
+	var pem []byte
+	if t.ClientCA != `` {
+		pem = []byte(t.ClientCA)
+	} else if t.ClientCAFile != `` {
+		pem, e = os.ReadFile(t.ClientCAFile)
+		if e != nil {
+			return
+		}
+	}
+	if pem != nil {
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			e = errors.New(`no certificate found in client CA`)
+			return
+		}
+	}
+	switch t.ClientAuth {
+	case ``:
+		if cas != nil {
+			auth = tls.RequireAndVerifyClientCert
+		}
+	case `none`:
+	case `request`:
+		auth = tls.RequestClientCert
+	case `require`:
+		auth = tls.RequireAnyClientCert
+	case `verify`:
+		auth = tls.VerifyClientCertIfGiven
+	case `require-and-verify`:
+		auth = tls.RequireAndVerifyClientCert
+	default:
+		e = errors.New(`client auth not supported: ` + t.ClientAuth)
+		return
+	}
+	if cas == nil && (auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert) {
+		e = errors.New(`client auth '` + t.ClientAuth + `' requires clientCA or clientCAFile`)
+	}
+	return
+}
+
 // Listener to receive incoming traffic
 type Listener struct {
 	BasicListener
-	// work mode, "basic" or "http" or "portal"
+	// work mode, "basic" or "http" or "portal" or "socks" or "connect"
 	// default is "basic"
 	Mode string `json:"mode"`
-	// Specify forwarding destination in "basic" mode
+	// Specify forwarding destination in "basic" mode.
+	// In "socks" and "connect" mode it is optional and must be a dialer that can connect to any address (socks://),
+	// if empty the destination is dialed directly.
 	Dialer ConnectDialer `json:"dialer"`
 	// http idle timeout default '180s'
 	IdleTimeout string `json:"idleTimeout"`
 	// Specify route for http mode
 	Router []*Router `json:"router"`
 	Portal Portal    `json:"portal"`
+	// socks5 server settings for "socks" mode
+	Socks SocksServer `json:"socks"`
+	// http CONNECT proxy settings for "connect" mode
+	Connect ConnectProxy `json:"connect"`
 	// udp settings
 	UDP UDP `json:"udp"`
 }
@@ -89,12 +187,30 @@ type Router struct {
 
 	// Portal tag, if not emoty, enable portal mode
 	Portal Portal `json:"portal"`
+	// Requests over the limits are rejected with 503
+	Admission
+	// Requests from clients not allowed are rejected with 403
+	ACL
+	// If not empty, requests without a verified client certificate matching it are rejected with 403
+	ClientCert ClientCert `json:"clientCert"`
+	// Accept streams multiplexed on the connection by a dialer with mux enabled, supported by POST PUT PATCH and WS
+	Mux Mux `json:"mux"`
+	// Decompress the connections compressed by a dialer with the same compress, supported by POST PUT PATCH and WS
+	Compress string `json:"compress"`
 
 	// If true, only websocket handshake is used, and tcp communication is used directly after the handshake is successful.
 	Fast bool `json:"fast"`
 
 	FS string `json:"fs"`
 }
+
+// ClientCert matches the verified client certificate of a request, it matches if any value matches
+type ClientCert struct {
+	// Common names of the subject
+	CommonName []string `json:"commonName"`
+	// DNS names, email addresses, ips or URIs of the subject alternative names
+	SAN []string `json:"san"`
+}
 type BasicAuth struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -102,8 +218,35 @@ type BasicAuth struct {
 type ConnectDialer struct {
 	// Connect dialer with tag 'tcp'
 	Tag string `json:"tag"`
-	// After one end of the connection is disconnected, wait for one second before closing the other end
-	// (waiting for untransmitted data to continue transmitting)
+	// After one end of the connection finishes sending, the other end is half-closed,
+	// wait at most this long for the other direction to finish before closing both ends
 	// Default "1s"
 	Close string `json:"close"`
+	// Close both ends if no data is forwarded in either direction for this long, such as '5m'.
+	// Default "" never times out
+	IdleTimeout string `json:"idleTimeout"`
+	// Close both ends when the connection has been bridged for this long, such as '24h'.
+	// Default "" never expires
+	MaxLifetime string `json:"maxLifetime"`
+	// Bandwidth shared by all connections forwarded by this listener or router entry
+	Rate Rate `json:"rate"`
+	// Copy the data sent by clients to connections of another dialer, its responses are discarded
+	Mirror Mirror `json:"mirror"`
+}
+
+// Mirror copies client traffic to a secondary dialer on a best-effort basis,
+// a mirror connection that fails or can not keep up is closed without affecting the client
+type Mirror struct {
+	// Connect dialer with tag 'canary', "" disables
+	Tag string `json:"tag"`
+	// Bytes queued for each mirror connection before it is abandoned, default 1048576
+	Buffer int `json:"buffer"`
+}
+
+// Rate is a token bucket limiting each direction of the connections sharing it
+type Rate struct {
+	// Bytes per second, 0 disables
+	Limit int64 `json:"limit"`
+	// Bytes that can be forwarded at once after being idle, default equal to limit
+	Burst int64 `json:"burst"`
 }
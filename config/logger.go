@@ -4,4 +4,23 @@ type Logger struct {
 	Level string `json:"level"`
 	// add source
 	Source bool `json:"source"`
+	LogOutput
+	// Access log, one record per finished bridged connection
+	Access AccessLogger `json:"access"`
+}
+type AccessLogger struct {
+	Enable bool `json:"enable"`
+	LogOutput
+}
+type LogOutput struct {
+	// 'text' or 'json', default 'text'
+	Format string `json:"format"`
+	// Write to this file instead of stdout
+	File string `json:"file"`
+	// Rotate the file when it grows larger than maxSize megabytes, 0 disables
+	MaxSize int `json:"maxSize"`
+	// Rotate the file when it has been written for longer than maxAge, such as '24h', empty disables
+	MaxAge string `json:"maxAge"`
+	// How many rotated files to keep, 0 keeps all
+	MaxBackups int `json:"maxBackups"`
 }
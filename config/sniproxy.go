@@ -7,6 +7,14 @@ type SNIProxy struct {
 	Addr    string `json:"addr"`
 	// Sniff sni timeout, Default 500ms
 	Timeout string `json:"timeout"`
+	// If true, every connection must start with a PROXY protocol v1 or v2 header
+	ProxyProtocol bool `json:"proxyProtocol"`
+	// Bandwidth shared by all connections of the sniproxy
+	Rate Rate `json:"rate"`
+	// Bandwidth of each client ip
+	ClientRate Rate `json:"clientRate"`
+	Admission
+	ACL
 
 	Default  ConnectDialer `json:"default"`
 	Fallback ConnectDialer `json:"fallback"`
@@ -17,6 +25,8 @@ type SNIRouter struct {
 	Matcher []SNIMatcher `json:"matcher"`
 	// Specify forwarding destination
 	Dialer ConnectDialer `json:"dialer"`
+	// Clients not allowed are closed instead of being forwarded by this router
+	ACL
 }
 type SNIMatcher struct {
 	// 'equal' 'prefix' 'suffix' 'regexp'
@@ -5,3 +5,13 @@ type Socks struct {
 	Password string `json:"password"`
 	Connect  string `json:"connect"`
 }
+
+// SocksServer settings of listener mode "socks"
+type SocksServer struct {
+	// Optional username/password authentication
+	Auth []BasicAuth `json:"auth"`
+	// Enable UDP ASSOCIATE, only supported when the destination is dialed directly
+	UDP bool `json:"udp"`
+	// Handshake and direct connect timeout, default 10s
+	Timeout string `json:"timeout"`
+}
@@ -23,7 +23,7 @@ type BasicDialer struct {
 	rawDialer  network.Dialer
 }
 
-func newBasicDialer(nk *network.Network, log *slog.Logger, opts *config.Dialer, u *url.URL, secure bool) (dialer *BasicDialer, e error) {
+func newBasicDialer(nk *network.Network, log *slog.Logger, via Dialer, opts *config.Dialer, u *url.URL, secure bool) (dialer *BasicDialer, e error) {
 	log = log.With(`dialer`, opts.Tag)
 	var timeout time.Duration
 	if opts.Timeout == `` {
@@ -66,16 +66,30 @@ func newBasicDialer(nk *network.Network, log *slog.Logger, opts *config.Dialer,
 	}
 	var cfg *tls.Config
 	if secure {
-		cfg = &tls.Config{
-			ServerName:         u.Hostname(),
-			InsecureSkipVerify: opts.AllowInsecure,
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
 		}
 	}
-	rawDialer, e := nk.Dialer(network, addr, cfg)
+	version, e := proxyProtocolVersion(log, opts)
+	if e != nil {
+		return
+	}
+	rawDialer, e := newRawDialer(nk, via, version, network, addr, cfg)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
 	}
+	encrypted := u.Scheme == BasicPsk
+	if encrypted {
+		if opts.PSK == `` {
+			e = ErrPskEmpty
+			log.Error(`new dialer fail`, `error`, e)
+			return
+		}
+		rawDialer = PSKDialer(rawDialer, opts.PSK)
+	}
 	log.Info(`new dialer`,
 		`network`, network,
 		`addr`, addr,
@@ -89,7 +103,7 @@ func newBasicDialer(nk *network.Network, log *slog.Logger, opts *config.Dialer,
 			Dialer:  opts.Tag,
 			Network: network,
 			Addr:    addr,
-			Secure:  secure,
+			Secure:  secure || encrypted,
 			URL:     opts.URL,
 		},
 		timeout:   timeout,
@@ -110,6 +124,9 @@ func (d *BasicDialer) Info() any {
 		`retry`:   d.retry,
 	}
 }
+func (d *BasicDialer) transport() (network, addr string) {
+	return d.remoteAddr.Network, d.remoteAddr.Addr
+}
 func (d *BasicDialer) Tag() string {
 	return d.remoteAddr.Dialer
 }
@@ -123,6 +140,7 @@ func (d *BasicDialer) Close() (e error) {
 	return
 }
 func (d *BasicDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	defer observeConnect(d.remoteAddr.Dialer, time.Now(), &e)
 	if d.timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, d.timeout)
@@ -0,0 +1,54 @@
+package dialer
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/powerpuffpenguin/streamf/internal/compress"
+)
+
+// CompressDialer compresses the connections of dialer
+type CompressDialer struct {
+	dialer Dialer
+	stats  *compress.Stats
+}
+
+func newCompressDialer(log *slog.Logger, dialer Dialer, algorithm string) *CompressDialer {
+	log.Info(`new compress dialer`,
+		`dialer`, dialer.Tag(),
+		`compress`, algorithm,
+	)
+	return &CompressDialer{
+		dialer: dialer,
+		stats:  compress.New(algorithm),
+	}
+}
+func (d *CompressDialer) Info() any {
+	info, ok := d.dialer.Info().(map[string]any)
+	if !ok {
+		info = map[string]any{
+			`tag`: d.dialer.Tag(),
+		}
+	}
+	info[`compress`] = d.stats.Info()
+	return info
+}
+func (d *CompressDialer) transport() (network, addr string) {
+	if t, ok := d.dialer.(transporter); ok {
+		return t.transport()
+	}
+	return
+}
+func (d *CompressDialer) Tag() string {
+	return d.dialer.Tag()
+}
+func (d *CompressDialer) Close() error {
+	return d.dialer.Close()
+}
+func (d *CompressDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	conn, e = d.dialer.Connect(ctx)
+	if e == nil {
+		conn.ReadWriteCloser = d.stats.Wrap(conn.ReadWriteCloser)
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package dialer
+
+import (
+	"io"
+	"sync"
+
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+	"github.com/powerpuffpenguin/streamf/third-party/websocket"
+)
+
+type websocketConn interface {
+	Websocket() *websocket.Conn
+}
+
+// newTrackedConn calls onClose once after the connection is closed,
+// websocket connections keep exposing Websocket() so bridging can still forward frames directly.
+func newTrackedConn(rw io.ReadWriteCloser, onClose func()) io.ReadWriteCloser {
+	tracked := &trackedConn{
+		ReadWriteCloser: rw,
+		onClose:         onClose,
+	}
+	if ws, ok := rw.(websocketConn); ok {
+		return &trackedWebsocketConn{
+			trackedConn: tracked,
+			ws:          ws,
+		}
+	}
+	return tracked
+}
+
+type trackedConn struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() (e error) {
+	e = c.ReadWriteCloser.Close()
+	c.once.Do(c.onClose)
+	return
+}
+func (c *trackedConn) CloseWrite() error {
+	return ioutil.CloseWrite(c.ReadWriteCloser)
+}
+
+type trackedWebsocketConn struct {
+	*trackedConn
+	ws websocketConn
+}
+
+func (c *trackedWebsocketConn) Websocket() *websocket.Conn {
+	return c.ws.Websocket()
+}
@@ -0,0 +1,38 @@
+package dialer
+
+import (
+	"context"
+	"net"
+)
+
+type clientAddrKey struct{}
+
+// WithClientAddr returns a copy of ctx that carries the address of the client the connection is made for.
+func WithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	if addr == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddr returns the client address carried by ctx or nil
+func ClientAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr
+}
+
+type localAddrKey struct{}
+
+// WithLocalAddr returns a copy of ctx that carries the address the client connected to.
+func WithLocalAddr(ctx context.Context, addr net.Addr) context.Context {
+	if addr == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, localAddrKey{}, addr)
+}
+
+// LocalAddr returns the address the client connected to carried by ctx or nil
+func LocalAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(localAddrKey{}).(net.Addr)
+	return addr
+}
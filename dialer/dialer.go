@@ -6,20 +6,27 @@ import (
 	"io"
 	"log/slog"
 	"net/url"
+	"time"
 
 	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/compress"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/internal/network"
 	"github.com/powerpuffpenguin/streamf/pool"
 )
 
 const (
 	Socks        = `socks`
+	HttpConnect  = `httpconnect`
+	HttpsConnect = `httpsconnect`
 	Websocket    = `ws`
 	WebsocketTls = `wss`
 	Http         = `http`
 	HttpTls      = `https`
 	Basic        = `basic`
 	BasicTls     = `basic+tls`
+	BasicPsk     = `basic+psk`
+	Group        = `group`
 )
 
 type Dialer interface {
@@ -29,7 +36,8 @@ type Dialer interface {
 	Info() any
 }
 
-func New(nk *network.Network, log *slog.Logger, pool *pool.Pool, opts *config.Dialer) (dialer Dialer, e error) {
+// New creates a dialer, dialers contains the dialers already created that "group://" may refer to.
+func New(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[string]Dialer, opts *config.Dialer) (dialer Dialer, e error) {
 	if opts.Tag == `` {
 		e = errTagEmpty
 		log.Error(`tag must not be empty`)
@@ -40,32 +48,149 @@ func New(nk *network.Network, log *slog.Logger, pool *pool.Pool, opts *config.Di
 		log.Error(`url invalid`, `url`, opts.URL)
 		return
 	}
+	via, e := Via(log, dialers, opts.Via)
+	if e != nil {
+		return
+	} else if via != nil && (u.Scheme == Group ||
+		(u.Scheme == Basic && (opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6`))) {
+		e = errors.New(`via not supported: ` + opts.URL)
+		log.Error(`via not supported`, `url`, opts.URL)
+		return
+	} else if opts.ProxyProtocol != `` && (u.Scheme == Group || u.Scheme == Http || u.Scheme == HttpTls ||
+		(u.Scheme == Basic && (opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6`))) {
+		// http2 shares one connection among clients
+		e = errors.New(`proxyProtocol not supported: ` + opts.URL)
+		log.Error(`proxyProtocol not supported`, `url`, opts.URL)
+		return
+	} else if e = compress.Check(opts.Compress); e != nil {
+		log.Error(`compress not supported`, `compress`, opts.Compress)
+		return
+	} else if opts.Compress != `` && (u.Scheme == Group ||
+		opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6`) {
+		e = errors.New(`compress not supported: ` + opts.URL)
+		log.Error(`compress not supported`, `url`, opts.URL)
+		return
+	} else if u.Scheme == BasicPsk && (opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6`) {
+		e = errors.New(`psk not supported by udp: ` + opts.URL)
+		log.Error(`psk not supported by udp`, `url`, opts.URL)
+		return
+	} else if opts.Mux.Enable && ((u.Scheme != Basic && u.Scheme != BasicTls && u.Scheme != BasicPsk &&
+		u.Scheme != Websocket && u.Scheme != WebsocketTls &&
+		u.Scheme != Http && u.Scheme != HttpTls) ||
+		opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6`) {
+		e = errors.New(`mux not supported: ` + opts.URL)
+		log.Error(`mux not supported`, `url`, opts.URL)
+		return
+	} else if opts.Mux.Enable && opts.ProxyProtocol != `` {
+		// the header would be sent once per carrier instead of once per client
+		e = errors.New(`proxyProtocol not supported with mux: ` + opts.URL)
+		log.Error(`proxyProtocol not supported with mux`, `url`, opts.URL)
+		return
+	} else if opts.Preconnect > 0 && (u.Scheme == Group || u.Scheme == Http || u.Scheme == HttpTls || opts.Mux.Enable ||
+		opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6`) {
+		// http2 and mux already reuse connections
+		e = errors.New(`preconnect not supported: ` + opts.URL)
+		log.Error(`preconnect not supported`, `url`, opts.URL)
+		return
+	} else if opts.Preconnect > 0 && opts.ProxyProtocol != `` {
+		// the header carries the client address which is unknown in advance
+		e = errors.New(`proxyProtocol not supported with preconnect: ` + opts.URL)
+		log.Error(`proxyProtocol not supported with preconnect`, `url`, opts.URL)
+		return
+	}
 	switch u.Scheme {
 	case Socks:
-		dialer, e = newSocksDialer(log, opts, u)
+		dialer, e = newSocksDialer(nk, log, via, opts, u)
+	case HttpConnect:
+		dialer, e = newHttpConnectDialer(nk, log, via, opts, u, false)
+	case HttpsConnect:
+		dialer, e = newHttpConnectDialer(nk, log, via, opts, u, true)
 	case Websocket:
-		dialer, e = newWebsocketDialer(nk, log, opts, u, false, pool)
+		dialer, e = newWebsocketDialer(nk, log, via, opts, u, false, pool)
 	case WebsocketTls:
-		dialer, e = newWebsocketDialer(nk, log, opts, u, true, pool)
+		dialer, e = newWebsocketDialer(nk, log, via, opts, u, true, pool)
 	case Http:
-		dialer, e = newHttpDialer(nk, log, opts, u, false)
+		dialer, e = newHttpDialer(nk, log, via, opts, u, false)
 	case HttpTls:
-		dialer, e = newHttpDialer(nk, log, opts, u, true)
+		dialer, e = newHttpDialer(nk, log, via, opts, u, true)
 	case Basic:
 		if opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6` {
 			dialer, e = newUdpDialer(nk, log, opts, u, pool)
 		} else {
-			dialer, e = newBasicDialer(nk, log, opts, u, false)
+			dialer, e = newBasicDialer(nk, log, via, opts, u, false)
 		}
 	case BasicTls:
-		dialer, e = newBasicDialer(nk, log, opts, u, true)
+		dialer, e = newBasicDialer(nk, log, via, opts, u, true)
+	case BasicPsk:
+		dialer, e = newBasicDialer(nk, log, via, opts, u, false)
+	case Group:
+		dialer, e = newGroupDialer(log, dialers, opts)
 	default:
 		e = errors.New(`url scheme not supported: ` + opts.URL)
 		log.Error(`url scheme not supported`, `url`, opts.URL)
 	}
+	// health probes must not take preconnected connections or reuse mux carriers
+	raw := dialer
+	if e == nil && opts.Mux.Enable {
+		dialer = newMuxDialer(log, dialer, &opts.Mux)
+	}
+	if e == nil && opts.Preconnect > 0 {
+		dialer = newPreconnectDialer(log, dialer, opts.Preconnect, opts.MaxIdle)
+	}
+	if e == nil && opts.Compress != `` {
+		dialer = newCompressDialer(log, dialer, opts.Compress)
+	}
+	if e == nil && opts.Health.Type != `` {
+		var health *HealthDialer
+		health, e = newHealthDialer(nk, log, dialers, opts, u, raw, dialer)
+		if e == nil {
+			dialer = health
+		} else {
+			dialer.Close()
+			dialer = nil
+		}
+	} else if e == nil && opts.Fallback != `` {
+		dialer.Close()
+		dialer = nil
+		e = errors.New(`fallback requires health check: ` + opts.Tag)
+		log.Error(`fallback requires health check`, `dialer`, opts.Tag)
+	}
 	return
 }
 
+// AddrDialer is implemented by dialers that can connect to any address, such as a proxy
+type AddrDialer interface {
+	Tag() string
+	// ConnectAddr connects to addr instead of the configured destination
+	ConnectAddr(ctx context.Context, network, addr string) (conn *Conn, e error)
+}
+
+// addressable is implemented by wrappers that can connect to any address only if the dialers they wrap can
+type addressable interface {
+	addressable() bool
+}
+
+// AsAddrDialer returns d if it can connect to any address. Health checked and preconnect dialers can if
+// the dialers they wrap can, mux and compress dialers can not as they only apply to the configured destination.
+func AsAddrDialer(d Dialer) (AddrDialer, bool) {
+	a, ok := d.(AddrDialer)
+	if !ok {
+		return nil, false
+	} else if w, ok := d.(addressable); ok && !w.addressable() {
+		return nil, false
+	}
+	return a, true
+}
+
+// observeConnect records a connect started at at in metrics, call it with defer
+func observeConnect(tag string, at time.Time, e *error) {
+	if *e == nil {
+		metrics.ConnectDuration.With(tag).Observe(time.Since(at).Seconds())
+	} else {
+		metrics.ConnectFailures.With(tag).Inc()
+	}
+}
+
 type Conn struct {
 	io.ReadWriteCloser
 	remoteAddr RemoteAddr
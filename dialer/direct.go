@@ -0,0 +1,46 @@
+package dialer
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const Direct = `direct`
+
+// DirectDialer connects to the requested address without any proxy
+type DirectDialer struct {
+	log    *slog.Logger
+	dialer net.Dialer
+}
+
+func NewDirectDialer(log *slog.Logger, timeout time.Duration) *DirectDialer {
+	return &DirectDialer{
+		log: log.With(`dialer`, Direct),
+		dialer: net.Dialer{
+			Timeout: timeout,
+		},
+	}
+}
+func (d *DirectDialer) Tag() string {
+	return Direct
+}
+func (d *DirectDialer) ConnectAddr(ctx context.Context, network, addr string) (conn *Conn, e error) {
+	defer observeConnect(Direct, time.Now(), &e)
+	c, e := d.dialer.DialContext(ctx, network, addr)
+	if e != nil {
+		d.log.Debug(`direct connect fail`, `error`, e, `connect`, addr)
+		return
+	}
+	d.log.Debug(`direct connect success`, `connect`, addr)
+	conn = &Conn{
+		ReadWriteCloser: c,
+		remoteAddr: RemoteAddr{
+			Dialer:  Direct,
+			Network: network,
+			Addr:    addr,
+		},
+	}
+	return
+}
@@ -6,7 +6,9 @@ import (
 )
 
 var ErrClosed = errors.New(`dialer already closed`)
+var ErrUnhealthy = errors.New(`dialer unhealthy`)
 var errTagEmpty = errors.New(`tag must not be empty`)
+var ErrPskEmpty = errors.New(`psk must not be empty`)
 
 // var errClosed = errors.New(`conn already closed`)
 var errHttpMethod = errors.New(`method must be "` + http.MethodPost + `" or "` + http.MethodPut + `" or "` + http.MethodPatch + `"`)
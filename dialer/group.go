@@ -0,0 +1,238 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+)
+
+const (
+	balanceRoundRobin = `round-robin`
+	balanceWeighted   = `weighted`
+	balanceLeastConn  = `least-conn`
+	balanceHash       = `hash`
+)
+
+type groupMember struct {
+	dialer Dialer
+	weight int
+	// smooth weighted round-robin state, guarded by GroupDialer.mutex
+	current int
+	// number of connections currently open through this member
+	active int64
+}
+
+// GroupDialer fans connections across several member dialers
+type GroupDialer struct {
+	log     *slog.Logger
+	done    chan struct{}
+	closed  uint32
+	tag     string
+	url     string
+	balance string
+	members []*groupMember
+	next    uint64
+	mutex   sync.Mutex
+}
+
+func newGroupDialer(log *slog.Logger, dialers map[string]Dialer, opts *config.Dialer) (dialer *GroupDialer, e error) {
+	log = log.With(`dialer`, opts.Tag)
+	balance := opts.Balance
+	switch balance {
+	case ``:
+		balance = balanceRoundRobin
+	case balanceRoundRobin, balanceWeighted, balanceLeastConn, balanceHash:
+	default:
+		e = errors.New(`group balance not supported: ` + opts.Balance)
+		log.Error(`group balance not supported`, `balance`, opts.Balance)
+		return
+	}
+	if len(opts.Members) == 0 {
+		e = errors.New(`group members must not be empty: ` + opts.Tag)
+		log.Error(`group members must not be empty`)
+		return
+	}
+	members := make([]*groupMember, 0, len(opts.Members))
+	tags := make([]string, 0, len(opts.Members))
+	for _, member := range opts.Members {
+		found, ok := dialers[member.Tag]
+		if !ok {
+			e = errors.New(`dialer not found: ` + member.Tag)
+			log.Error(`dialer not found`, `member`, member.Tag)
+			return
+		}
+		weight := member.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		members = append(members, &groupMember{
+			dialer: found,
+			weight: weight,
+		})
+		tags = append(tags, member.Tag)
+	}
+	log.Info(`new dialer`,
+		`url`, opts.URL,
+		`balance`, balance,
+		`members`, tags,
+	)
+	dialer = &GroupDialer{
+		log:     log,
+		done:    make(chan struct{}),
+		tag:     opts.Tag,
+		url:     opts.URL,
+		balance: balance,
+		members: members,
+	}
+	return
+}
+func (d *GroupDialer) Info() any {
+	members := make([]any, 0, len(d.members))
+	for _, m := range d.members {
+		members = append(members, map[string]any{
+			`tag`:    m.dialer.Tag(),
+			`weight`: m.weight,
+			`active`: atomic.LoadInt64(&m.active),
+		})
+	}
+	return map[string]any{
+		`tag`:     d.tag,
+		`url`:     d.url,
+		`balance`: d.balance,
+		`members`: members,
+	}
+}
+func (d *GroupDialer) Tag() string {
+	return d.tag
+}
+
+// Close only closes the group, member dialers are owned by the application.
+func (d *GroupDialer) Close() (e error) {
+	if d.closed == 0 && atomic.CompareAndSwapUint32(&d.closed, 0, 1) {
+		close(d.done)
+	} else {
+		e = ErrClosed
+	}
+	return
+}
+
+// Connect connects through the picked member, if it fails or is unhealthy the following members are tried in turn.
+func (d *GroupDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	defer observeConnect(d.tag, time.Now(), &e)
+	select {
+	case <-d.done:
+		e = ErrClosed
+		return
+	default:
+	}
+	var (
+		count = len(d.members)
+		first = d.pick(ctx)
+		m     *groupMember
+	)
+	e = ErrUnhealthy
+	for i := 0; i < count; i++ {
+		m = d.members[(first+i)%count]
+		if !isHealthy(m.dialer) {
+			continue
+		}
+		atomic.AddInt64(&m.active, 1)
+		conn, e = m.dialer.Connect(ctx)
+		if e == nil {
+			conn.ReadWriteCloser = newTrackedConn(conn.ReadWriteCloser, m.release)
+			d.log.Debug(`group connect success`, `member`, m.dialer.Tag())
+			return
+		}
+		m.release()
+		d.log.Debug(`group connect fail`,
+			`member`, m.dialer.Tag(),
+			`error`, e,
+		)
+		select {
+		case <-d.done:
+			e = ErrClosed
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+	return
+}
+func (m *groupMember) release() {
+	atomic.AddInt64(&m.active, -1)
+}
+func (d *GroupDialer) pick(ctx context.Context) int {
+	switch d.balance {
+	case balanceWeighted:
+		return d.pickWeighted()
+	case balanceLeastConn:
+		return d.pickLeastConn()
+	case balanceHash:
+		if addr := ClientAddr(ctx); addr != nil {
+			return d.pickHash(addr)
+		}
+	}
+	return int(atomic.AddUint64(&d.next, 1) % uint64(len(d.members)))
+}
+
+// smooth weighted round-robin, the same algorithm as nginx upstream
+func (d *GroupDialer) pickWeighted() (found int) {
+	d.mutex.Lock()
+	var total int
+	for i, m := range d.members {
+		m.current += m.weight
+		total += m.weight
+		if m.current > d.members[found].current {
+			found = i
+		}
+	}
+	d.members[found].current -= total
+	d.mutex.Unlock()
+	return
+}
+func (d *GroupDialer) pickLeastConn() (found int) {
+	var (
+		count  = len(d.members)
+		offset = int(atomic.AddUint64(&d.next, 1) % uint64(count))
+		min    int64
+		i      int
+		active int64
+	)
+	for j := 0; j < count; j++ {
+		i = (offset + j) % count
+		active = atomic.LoadInt64(&d.members[i].active)
+		if j == 0 || active < min {
+			found = i
+			min = active
+		}
+	}
+	return
+}
+
+// rendezvous hashing, a client keeps its member while the member list is unchanged
+func (d *GroupDialer) pickHash(addr net.Addr) (found int) {
+	key := addr.String()
+	if host, _, e := net.SplitHostPort(key); e == nil {
+		key = host
+	}
+	var max uint64
+	for i, m := range d.members {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(m.dialer.Tag()))
+		if score := h.Sum64(); i == 0 || score > max {
+			found = i
+			max = score
+		}
+	}
+	return
+}
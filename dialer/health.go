@@ -0,0 +1,391 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/internal/proxyproto"
+)
+
+const (
+	healthTcp       = `tcp`
+	healthTls       = `tls`
+	healthHttp      = `http`
+	healthWebsocket = `websocket`
+)
+
+// transporter is implemented by dialers that connect to a fixed network address
+type transporter interface {
+	transport() (network, addr string)
+}
+
+// healthChecker is implemented by dialers with active health checking
+type healthChecker interface {
+	Healthy() bool
+}
+
+func isHealthy(d Dialer) bool {
+	if checker, ok := d.(healthChecker); ok {
+		return checker.Healthy()
+	}
+	return true
+}
+
+// HealthDialer probes its dialer on an interval, it fails fast or uses the fallback dialer while unhealthy.
+type HealthDialer struct {
+	dialer   Dialer
+	fallback Dialer
+	log      *slog.Logger
+	done     chan struct{}
+	closed   uint32
+
+	probe      func(ctx context.Context) error
+	probeType  string
+	interval   time.Duration
+	timeout    time.Duration
+	rise, fall int
+
+	healthy uint32
+
+	mutex     sync.Mutex
+	lastCheck time.Time
+	lastError string
+}
+
+// newHealthDialer returns dialer with health checking, the probes use raw which is dialer before mux, preconnect and compress
+func newHealthDialer(nk *network.Network, log *slog.Logger, dialers map[string]Dialer, opts *config.Dialer, u *url.URL, raw, dialer Dialer) (health *HealthDialer, e error) {
+	log = log.With(`dialer`, opts.Tag)
+	var fallback Dialer
+	if opts.Fallback != `` {
+		var ok bool
+		fallback, ok = dialers[opts.Fallback]
+		if !ok {
+			e = errors.New(`dialer not found: ` + opts.Fallback)
+			log.Error(`dialer not found`, `fallback`, opts.Fallback)
+			return
+		}
+	}
+	var interval time.Duration
+	if opts.Health.Interval == `` {
+		interval = time.Second * 10
+	} else {
+		var err error
+		interval, err = time.ParseDuration(opts.Health.Interval)
+		if err != nil {
+			interval = time.Second * 10
+			log.Warn(`parse duration fail, used default health interval duration.`,
+				`error`, err,
+				`interval`, interval,
+			)
+		} else if interval < time.Second {
+			log.Warn(`health interval too small, used default health interval duration.`,
+				`interval`, opts.Health.Interval,
+				`default`, time.Second*10,
+			)
+			interval = time.Second * 10
+		}
+	}
+	var timeout time.Duration
+	if opts.Health.Timeout == `` {
+		timeout = time.Second * 2
+	} else {
+		var err error
+		timeout, err = time.ParseDuration(opts.Health.Timeout)
+		if err != nil {
+			timeout = time.Second * 2
+			log.Warn(`parse duration fail, used default health timeout duration.`,
+				`error`, err,
+				`timeout`, timeout,
+			)
+		} else if timeout <= 0 {
+			log.Warn(`health timeout too small, used default health timeout duration.`,
+				`timeout`, opts.Health.Timeout,
+				`default`, time.Second*2,
+			)
+			timeout = time.Second * 2
+		}
+	}
+	rise := opts.Health.Rise
+	if rise < 1 {
+		rise = 2
+	}
+	fall := opts.Health.Fall
+	if fall < 1 {
+		fall = 3
+	}
+	probe, e := newProbe(nk, dialers[opts.Via], opts, u, raw)
+	if e != nil {
+		log.Error(`new health check fail`, `error`, e)
+		return
+	}
+	log.Info(`new health check`,
+		`type`, opts.Health.Type,
+		`interval`, interval,
+		`timeout`, timeout,
+		`rise`, rise,
+		`fall`, fall,
+		`fallback`, opts.Fallback,
+	)
+	health = &HealthDialer{
+		dialer:   dialer,
+		fallback: fallback,
+		log:      log,
+		done:     make(chan struct{}),
+
+		probe:     probe,
+		probeType: opts.Health.Type,
+		interval:  interval,
+		timeout:   timeout,
+		rise:      rise,
+		fall:      fall,
+
+		healthy: 1,
+	}
+	go health.run()
+	return
+}
+func newProbe(nk *network.Network, via Dialer, opts *config.Dialer, u *url.URL, dialer Dialer) (probe func(ctx context.Context) error, e error) {
+	if opts.Health.Type == healthWebsocket {
+		if u.Scheme != Websocket && u.Scheme != WebsocketTls {
+			e = errors.New(`health type websocket only supported by ws/wss dialer`)
+			return
+		}
+		probe = func(ctx context.Context) error {
+			conn, e := dialer.Connect(ctx)
+			if e != nil {
+				return e
+			}
+			return conn.Close()
+		}
+		return
+	}
+	t, ok := dialer.(transporter)
+	if !ok {
+		e = errors.New(`health type ` + opts.Health.Type + ` not supported by dialer: ` + opts.URL)
+		return
+	}
+	// probes carry no client, backends that require the header receive v1 "UNKNOWN" or v2 "LOCAL"
+	var version int
+	if opts.ProxyProtocol != `` {
+		version, e = proxyproto.ParseVersion(opts.ProxyProtocol)
+		if e != nil {
+			return
+		}
+	}
+	network, addr := t.transport()
+	switch opts.Health.Type {
+	case healthTcp:
+		rawDialer, err := newRawDialer(nk, via, version, network, addr, nil)
+		if err != nil {
+			e = err
+			return
+		}
+		probe = func(ctx context.Context) error {
+			conn, e := rawDialer.DialContext(ctx)
+			if e != nil {
+				return e
+			}
+			return conn.Close()
+		}
+	case healthTls:
+		cfg, err := opts.TLSConfig(u.Hostname())
+		if err != nil {
+			e = err
+			return
+		}
+		rawDialer, err := newRawDialer(nk, via, version, network, addr, cfg)
+		if err != nil {
+			e = err
+			return
+		}
+		probe = func(ctx context.Context) error {
+			conn, e := rawDialer.DialContext(ctx)
+			if e != nil {
+				return e
+			}
+			return conn.Close()
+		}
+	case healthHttp:
+		if opts.Health.URL == `` {
+			e = errors.New(`health type http requires url`)
+			return
+		}
+		var target *url.URL
+		target, e = url.ParseRequestURI(opts.Health.URL)
+		if e != nil {
+			return
+		}
+		rawDialer, err := newRawDialer(nk, via, version, network, addr, nil)
+		if err != nil {
+			e = err
+			return
+		}
+		cfg, err := opts.TLSConfig(target.Hostname())
+		if err != nil {
+			e = err
+			return
+		}
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return rawDialer.DialContext(ctx)
+				},
+				TLSClientConfig:   cfg,
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		probe = func(ctx context.Context) error {
+			req, e := http.NewRequestWithContext(ctx, http.MethodGet, opts.Health.URL, nil)
+			if e != nil {
+				return e
+			}
+			resp, e := client.Do(req)
+			if e != nil {
+				return e
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+				return errors.New(resp.Status)
+			}
+			return nil
+		}
+	default:
+		e = errors.New(`health type not supported: ` + opts.Health.Type)
+	}
+	return
+}
+func (d *HealthDialer) run() {
+	var (
+		timer     = time.NewTimer(0)
+		successes int
+		failures  int
+		e         error
+	)
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-timer.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		e = d.probe(ctx)
+		cancel()
+
+		d.mutex.Lock()
+		d.lastCheck = time.Now()
+		if e == nil {
+			d.lastError = ``
+		} else {
+			d.lastError = e.Error()
+		}
+		d.mutex.Unlock()
+
+		if e == nil {
+			failures = 0
+			successes++
+			if successes == d.rise && atomic.CompareAndSwapUint32(&d.healthy, 0, 1) {
+				d.log.Info(`dialer healthy`)
+			}
+		} else {
+			successes = 0
+			failures++
+			d.log.Debug(`health check fail`, `error`, e)
+			if failures == d.fall && atomic.CompareAndSwapUint32(&d.healthy, 1, 0) {
+				d.log.Warn(`dialer unhealthy`, `error`, e)
+			}
+		}
+		timer.Reset(d.interval)
+	}
+}
+func (d *HealthDialer) Healthy() bool {
+	return atomic.LoadUint32(&d.healthy) != 0
+}
+func (d *HealthDialer) Info() any {
+	d.mutex.Lock()
+	health := map[string]any{
+		`type`:      d.probeType,
+		`healthy`:   d.Healthy(),
+		`interval`:  d.interval.String(),
+		`timeout`:   d.timeout.String(),
+		`rise`:      d.rise,
+		`fall`:      d.fall,
+		`lastCheck`: d.lastCheck,
+		`lastError`: d.lastError,
+	}
+	d.mutex.Unlock()
+	if d.fallback != nil {
+		health[`fallback`] = d.fallback.Tag()
+	}
+	info, ok := d.dialer.Info().(map[string]any)
+	if !ok {
+		info = map[string]any{
+			`tag`: d.dialer.Tag(),
+		}
+	}
+	info[`health`] = health
+	return info
+}
+func (d *HealthDialer) Tag() string {
+	return d.dialer.Tag()
+}
+func (d *HealthDialer) Close() (e error) {
+	if d.closed == 0 && atomic.CompareAndSwapUint32(&d.closed, 0, 1) {
+		close(d.done)
+		e = d.dialer.Close()
+	} else {
+		e = ErrClosed
+	}
+	return
+}
+func (d *HealthDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	if d.Healthy() {
+		return d.dialer.Connect(ctx)
+	} else if d.fallback != nil {
+		d.log.Debug(`dialer unhealthy, connect fallback`, `fallback`, d.fallback.Tag())
+		return d.fallback.Connect(ctx)
+	}
+	e = ErrUnhealthy
+	return
+}
+
+func (d *HealthDialer) addressable() bool {
+	_, ok := AsAddrDialer(d.dialer)
+	if ok && d.fallback != nil {
+		_, ok = AsAddrDialer(d.fallback)
+	}
+	return ok
+}
+
+// ConnectAddr is like Connect but connects to addr, see AsAddrDialer
+func (d *HealthDialer) ConnectAddr(ctx context.Context, network, addr string) (conn *Conn, e error) {
+	dialer := d.dialer
+	if !d.Healthy() {
+		if d.fallback == nil {
+			e = ErrUnhealthy
+			return
+		}
+		d.log.Debug(`dialer unhealthy, connect fallback`, `fallback`, d.fallback.Tag())
+		dialer = d.fallback
+	}
+	a, ok := AsAddrDialer(dialer)
+	if !ok {
+		e = errors.New(`dialer cannot connect to any address: ` + dialer.Tag())
+		return
+	}
+	return a.ConnectAddr(ctx, network, addr)
+}
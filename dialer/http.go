@@ -32,7 +32,7 @@ type HttpDialer struct {
 	rawDialer  network.Dialer
 }
 
-func newHttpDialer(nk *network.Network, log *slog.Logger, opts *config.Dialer, u *url.URL, secure bool) (dialer *HttpDialer, e error) {
+func newHttpDialer(nk *network.Network, log *slog.Logger, via Dialer, opts *config.Dialer, u *url.URL, secure bool) (dialer *HttpDialer, e error) {
 	log = log.With(`dialer`, opts.Tag)
 	var timeout time.Duration
 	if opts.Timeout == `` {
@@ -117,13 +117,14 @@ func newHttpDialer(nk *network.Network, log *slog.Logger, opts *config.Dialer, u
 		cfg *tls.Config
 	)
 	if secure {
-		cfg = &tls.Config{
-			NextProtos:         []string{`h2`},
-			ServerName:         u.Hostname(),
-			InsecureSkipVerify: opts.AllowInsecure,
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
 		}
+		cfg.NextProtos = []string{`h2`}
 	}
-	rawDialer, e := nk.Dialer(network, addr, cfg)
+	rawDialer, e := RawDialer(nk, via, network, addr, cfg)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
@@ -197,6 +198,9 @@ func (d *HttpDialer) Info() any {
 		`retry`:   d.retry,
 	}
 }
+func (d *HttpDialer) transport() (network, addr string) {
+	return d.remoteAddr.Network, d.remoteAddr.Addr
+}
 func (d *HttpDialer) Tag() string {
 	return d.remoteAddr.Dialer
 }
@@ -211,6 +215,7 @@ func (d *HttpDialer) Close() (e error) {
 }
 
 func (d *HttpDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	defer observeConnect(d.remoteAddr.Dialer, time.Now(), &e)
 	if d.timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, d.timeout)
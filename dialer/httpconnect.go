@@ -0,0 +1,236 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/httpmux"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+)
+
+// HttpConnectDialer connects to the destination through a http CONNECT proxy
+type HttpConnectDialer struct {
+	network, addr string
+
+	log        *slog.Logger
+	done       chan struct{}
+	closed     uint32
+	remoteAddr RemoteAddr
+
+	timeout   time.Duration
+	retry     int
+	header    http.Header
+	rawDialer network.Dialer
+	version   int
+}
+
+func newHttpConnectDialer(nk *network.Network, log *slog.Logger, via Dialer, opts *config.Dialer, u *url.URL, secure bool) (dialer *HttpConnectDialer, e error) {
+	log = log.With(`dialer`, opts.Tag)
+	var timeout time.Duration
+	if opts.Timeout == `` {
+		timeout = time.Millisecond * 500
+	} else {
+		var err error
+		timeout, err = time.ParseDuration(opts.Timeout)
+		if err != nil {
+			timeout = time.Millisecond * 500
+			log.Warn(`parse duration fail, used default timeout duration.`,
+				`error`, err,
+				`timeout`, timeout,
+			)
+		}
+	}
+	var (
+		network = `tcp`
+		addr    = u.Host
+		query   url.Values
+	)
+	if opts.Network != `` {
+		network = opts.Network
+	} else {
+		query = u.Query()
+		s := query.Get(`network`)
+		if s != `` {
+			network = s
+		}
+	}
+	if opts.Addr != `` {
+		addr = opts.Addr
+	} else {
+		if query == nil {
+			query = u.Query()
+		}
+		s := query.Get(`addr`)
+		if s != `` {
+			addr = s
+		}
+	}
+	version, e := proxyProtocolVersion(log, opts)
+	if e != nil {
+		return
+	}
+	var cfg *tls.Config
+	if secure {
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
+		}
+	}
+	rawDialer, e := RawDialer(nk, via, network, addr, cfg)
+	if e != nil {
+		log.Error(`new dialer fail`, `error`, e)
+		return
+	}
+	header := make(http.Header, len(opts.Header)+1)
+	for k, vs := range opts.Header {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+	if opts.HttpConnect.User != `` || opts.HttpConnect.Password != `` {
+		header.Set(`Proxy-Authorization`, httpmux.ProxyAuthorization(opts.HttpConnect.User, opts.HttpConnect.Password))
+	}
+	log.Info(`new dialer`,
+		`network`, network,
+		`addr`, addr,
+		`url`, opts.URL,
+		`timeout`, timeout,
+		`connect`, opts.HttpConnect.Connect,
+	)
+	dialer = &HttpConnectDialer{
+		network: network,
+		addr:    addr,
+
+		log:  log,
+		done: make(chan struct{}),
+		remoteAddr: RemoteAddr{
+			Dialer:  opts.Tag,
+			Network: `tcp`,
+			Addr:    opts.HttpConnect.Connect,
+			Secure:  secure,
+			URL:     opts.URL,
+		},
+		timeout:   timeout,
+		retry:     opts.Retry,
+		header:    header,
+		rawDialer: rawDialer,
+		version:   version,
+	}
+	return
+}
+func (d *HttpConnectDialer) Info() any {
+	return map[string]any{
+		`tag`:     d.remoteAddr.Dialer,
+		`network`: d.network,
+		`addr`:    d.addr,
+		`url`:     d.remoteAddr.URL,
+		`secure`:  d.remoteAddr.Secure,
+
+		`connect`: d.remoteAddr.Addr,
+
+		`timeout`: d.timeout.String(),
+		`retry`:   d.retry,
+	}
+}
+func (d *HttpConnectDialer) transport() (network, addr string) {
+	return d.network, d.addr
+}
+func (d *HttpConnectDialer) Tag() string {
+	return d.remoteAddr.Dialer
+}
+func (d *HttpConnectDialer) Close() (e error) {
+	if d.closed == 0 && atomic.CompareAndSwapUint32(&d.closed, 0, 1) {
+		close(d.done)
+		e = d.rawDialer.Close()
+	} else {
+		e = ErrClosed
+	}
+	return
+}
+func (d *HttpConnectDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	return d.ConnectAddr(ctx, d.remoteAddr.Network, d.remoteAddr.Addr)
+}
+func (d *HttpConnectDialer) ConnectAddr(ctx context.Context, network, addr string) (conn *Conn, e error) {
+	defer observeConnect(d.remoteAddr.Dialer, time.Now(), &e)
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	ch := make(chan connectResult)
+	go func() {
+		c, e := d.connect(ctx, addr)
+		if e == nil {
+			remoteAddr := d.remoteAddr
+			remoteAddr.Network = network
+			remoteAddr.Addr = addr
+			select {
+			case ch <- connectResult{
+				Conn: &Conn{
+					ReadWriteCloser: c,
+					remoteAddr:      remoteAddr,
+				},
+			}:
+			case <-d.done:
+				c.Close()
+			case <-ctx.Done():
+				c.Close()
+			}
+		} else {
+			select {
+			case ch <- connectResult{
+				Error: e,
+			}:
+			case <-d.done:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	select {
+	case <-d.done:
+		e = ErrClosed
+	case <-ctx.Done():
+		e = ctx.Err()
+	case result := <-ch:
+		conn, e = result.Conn, result.Error
+	}
+	if e == nil {
+		d.log.Debug(`httpconnect connect success`, `connect`, addr)
+	} else {
+		d.log.Debug(`httpconnect connect fail`, `error`, e, `connect`, addr)
+	}
+	return
+}
+func (d *HttpConnectDialer) connect(ctx context.Context, addr string) (conn net.Conn, e error) {
+	for i := 0; ; i++ {
+		conn, e = d.rawDialer.DialContext(ctx)
+		if e == nil {
+			conn, e = httpmux.ConnectProxy(ctx, conn, addr, d.header.Clone())
+			if e == nil && d.version != 0 {
+				e = writeProxyHeader(ctx, conn, d.version)
+				if e != nil {
+					conn.Close()
+				}
+			}
+		}
+		if e == nil || i >= d.retry {
+			break
+		}
+		select {
+		case <-d.done:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+	return
+}
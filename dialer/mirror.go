@@ -0,0 +1,33 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+)
+
+// NewMirror returns the mirror of conf connecting with the dialer of its tag, it returns nil if conf has no mirror
+func NewMirror(log *slog.Logger, dialers map[string]Dialer, conf *config.ConnectDialer) (mirror *network.Mirror, e error) {
+	tag := conf.Mirror.Tag
+	if tag == `` {
+		return
+	}
+	dialer, ok := dialers[tag]
+	if !ok {
+		e = errors.New(`mirror dialer not found: ` + tag)
+		log.Error(`mirror dialer not found`, `mirror`, tag)
+		return
+	}
+	mirror = network.NewMirror(log, tag, conf.Mirror.Buffer, func(ctx context.Context) (io.ReadWriteCloser, error) {
+		conn, e := dialer.Connect(ctx)
+		if e != nil {
+			return nil, e
+		}
+		return conn.ReadWriteCloser, nil
+	})
+	return
+}
@@ -0,0 +1,228 @@
+package dialer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/mux"
+)
+
+// muxCarrier is a connection of the dialer carrying multiplexed streams
+type muxCarrier struct {
+	session    *mux.Session
+	remoteAddr RemoteAddr
+}
+
+// MuxDialer opens streams on a few long-lived carrier connections connected by dialer
+type MuxDialer struct {
+	dialer      Dialer
+	log         *slog.Logger
+	done        chan struct{}
+	closed      uint32
+	connections int
+	keepalive   time.Duration
+
+	mutex    sync.Mutex
+	carriers []*muxCarrier
+	dialing  bool
+	// the carrier connected when there is none, nil if it is not being connected
+	first *muxDial
+}
+
+// muxDial is a carrier being connected, done is closed when carrier or e is set
+type muxDial struct {
+	done    chan struct{}
+	carrier *muxCarrier
+	e       error
+}
+
+func newMuxDialer(log *slog.Logger, dialer Dialer, opts *config.Mux) *MuxDialer {
+	log = log.With(`dialer`, dialer.Tag())
+	connections := opts.Connections
+	if connections < 1 {
+		connections = 1
+	}
+	keepalive := mux.Keepalive(log, opts.Keepalive)
+	log.Info(`new mux dialer`,
+		`connections`, connections,
+		`keepalive`, keepalive,
+	)
+	return &MuxDialer{
+		dialer:      dialer,
+		log:         log,
+		done:        make(chan struct{}),
+		connections: connections,
+		keepalive:   keepalive,
+	}
+}
+func (d *MuxDialer) Info() any {
+	info, ok := d.dialer.Info().(map[string]any)
+	if !ok {
+		info = map[string]any{
+			`tag`: d.dialer.Tag(),
+		}
+	}
+	d.mutex.Lock()
+	carriers := make([]any, 0, len(d.carriers))
+	for _, carrier := range d.carriers {
+		if carrier.session.Available() {
+			carriers = append(carriers, map[string]any{
+				`streams`: carrier.session.NumStreams(),
+			})
+		}
+	}
+	d.mutex.Unlock()
+	info[`mux`] = map[string]any{
+		`connections`: d.connections,
+		`keepalive`:   d.keepalive.String(),
+		`carriers`:    carriers,
+	}
+	return info
+}
+func (d *MuxDialer) transport() (network, addr string) {
+	if t, ok := d.dialer.(transporter); ok {
+		return t.transport()
+	}
+	return
+}
+func (d *MuxDialer) Tag() string {
+	return d.dialer.Tag()
+}
+func (d *MuxDialer) Close() (e error) {
+	if d.closed == 0 && atomic.CompareAndSwapUint32(&d.closed, 0, 1) {
+		close(d.done)
+		d.mutex.Lock()
+		for _, carrier := range d.carriers {
+			carrier.session.Close()
+		}
+		d.carriers = nil
+		d.mutex.Unlock()
+		e = d.dialer.Close()
+	} else {
+		e = ErrClosed
+	}
+	return
+}
+
+// Connect opens a stream on the carrier with the fewest streams. If there is no carrier one is connected,
+// if there are fewer carriers than connections one is connected in the background.
+func (d *MuxDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	d.mutex.Lock()
+	carrier, count := d.pick()
+	if carrier == nil {
+		// the clients wait for the first carrier instead of each connecting one
+		first := d.first
+		if first == nil {
+			first = &muxDial{done: make(chan struct{})}
+			d.first = first
+			go d.dialFirst(first)
+		}
+		d.mutex.Unlock()
+		select {
+		case <-first.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-d.done:
+			return nil, ErrClosed
+		}
+		if first.e != nil {
+			return nil, first.e
+		}
+		return d.open(first.carrier)
+	} else if count < d.connections && !d.dialing {
+		d.dialing = true
+		go func() {
+			// the connect timeout of d.dialer applies
+			carrier, e := d.dial(context.Background())
+			d.mutex.Lock()
+			d.dialing = false
+			if e == nil {
+				d.add(carrier)
+			}
+			d.mutex.Unlock()
+			if e != nil {
+				d.log.Warn(`connect mux carrier fail`, `error`, e)
+			}
+		}()
+	}
+	d.mutex.Unlock()
+	return d.open(carrier)
+}
+
+// dialFirst connects the carrier waited for by the clients without d.mutex locked,
+// so Info and Close do not wait for the connect timeout
+func (d *MuxDialer) dialFirst(first *muxDial) {
+	// the connect timeout of d.dialer applies, a client giving up does not fail the others
+	first.carrier, first.e = d.dial(context.Background())
+	d.mutex.Lock()
+	d.first = nil
+	if first.e == nil {
+		d.add(first.carrier)
+	}
+	d.mutex.Unlock()
+	close(first.done)
+}
+
+// open opens a stream on carrier
+func (d *MuxDialer) open(carrier *muxCarrier) (conn *Conn, e error) {
+	stream, e := carrier.session.Open()
+	if e != nil {
+		return
+	}
+	conn = &Conn{
+		ReadWriteCloser: stream,
+		remoteAddr:      carrier.remoteAddr,
+	}
+	return
+}
+
+// pick removes the carriers that can not open streams and returns the one with the fewest streams,
+// a carrier removed but not closed is closed by the peer after its streams finish. d.mutex must be locked
+func (d *MuxDialer) pick() (carrier *muxCarrier, count int) {
+	var (
+		carriers = d.carriers[:0]
+		min      int
+	)
+	for _, item := range d.carriers {
+		if !item.session.Available() {
+			continue
+		}
+		carriers = append(carriers, item)
+		if n := item.session.NumStreams(); carrier == nil || n < min {
+			carrier, min = item, n
+		}
+	}
+	for i := len(carriers); i < len(d.carriers); i++ {
+		d.carriers[i] = nil
+	}
+	d.carriers = carriers
+	count = len(carriers)
+	return
+}
+
+// dial connects a new carrier
+func (d *MuxDialer) dial(ctx context.Context) (carrier *muxCarrier, e error) {
+	conn, e := d.dialer.Connect(ctx)
+	if e != nil {
+		return
+	}
+	carrier = &muxCarrier{
+		session:    mux.Client(conn.ReadWriteCloser, d.keepalive),
+		remoteAddr: conn.RemoteAddr(),
+	}
+	return
+}
+
+// add adds carrier to d, it is closed if d is closed. d.mutex must be locked
+func (d *MuxDialer) add(carrier *muxCarrier) {
+	if d.closed != 0 && atomic.LoadUint32(&d.closed) != 0 {
+		carrier.session.Close()
+		return
+	}
+	d.carriers = append(d.carriers, carrier)
+	d.log.Info(`new mux carrier`, `carriers`, len(d.carriers))
+}
@@ -0,0 +1,242 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn is a preconnected connection waiting to be handed out
+type idleConn struct {
+	conn *Conn
+	at   time.Time
+}
+
+// PreconnectDialer keeps connections of dialer connected in advance, so Connect does not wait for the handshake
+type PreconnectDialer struct {
+	dialer  Dialer
+	log     *slog.Logger
+	done    chan struct{}
+	closed  uint32
+	size    int
+	maxIdle time.Duration
+	// wakes run to replenish the connections
+	signal       chan struct{}
+	hits, misses uint64
+
+	mutex   sync.Mutex
+	idle    []idleConn
+	dialing int
+	// after a failure nothing is connected in advance before retry, backoff doubles up to 30s
+	retry   time.Time
+	backoff time.Duration
+}
+
+func newPreconnectDialer(log *slog.Logger, dialer Dialer, size int, maxIdle string) *PreconnectDialer {
+	log = log.With(`dialer`, dialer.Tag())
+	idle := 30 * time.Second
+	if maxIdle != `` {
+		var err error
+		idle, err = time.ParseDuration(maxIdle)
+		if err != nil {
+			idle = 30 * time.Second
+			log.Warn(`parse duration fail, used default maxIdle duration.`,
+				`error`, err,
+				`maxIdle`, maxIdle,
+				`default`, idle,
+			)
+		} else if idle < time.Second {
+			idle = 0
+		}
+	}
+	log.Info(`new preconnect dialer`,
+		`preconnect`, size,
+		`maxIdle`, idle,
+	)
+	d := &PreconnectDialer{
+		dialer:  dialer,
+		log:     log,
+		done:    make(chan struct{}),
+		size:    size,
+		maxIdle: idle,
+		signal:  make(chan struct{}, 1),
+	}
+	go d.run()
+	return d
+}
+func (d *PreconnectDialer) Info() any {
+	info, ok := d.dialer.Info().(map[string]any)
+	if !ok {
+		info = map[string]any{
+			`tag`: d.dialer.Tag(),
+		}
+	}
+	d.mutex.Lock()
+	idle, dialing := len(d.idle), d.dialing
+	d.mutex.Unlock()
+	info[`preconnect`] = map[string]any{
+		`size`:    d.size,
+		`maxIdle`: d.maxIdle.String(),
+		`idle`:    idle,
+		`dialing`: dialing,
+		`hits`:    atomic.LoadUint64(&d.hits),
+		`misses`:  atomic.LoadUint64(&d.misses),
+	}
+	return info
+}
+func (d *PreconnectDialer) transport() (network, addr string) {
+	if t, ok := d.dialer.(transporter); ok {
+		return t.transport()
+	}
+	return
+}
+func (d *PreconnectDialer) Tag() string {
+	return d.dialer.Tag()
+}
+func (d *PreconnectDialer) Close() (e error) {
+	if d.closed == 0 && atomic.CompareAndSwapUint32(&d.closed, 0, 1) {
+		close(d.done)
+		d.mutex.Lock()
+		for _, item := range d.idle {
+			item.conn.Close()
+		}
+		d.idle = nil
+		d.mutex.Unlock()
+		e = d.dialer.Close()
+	} else {
+		e = ErrClosed
+	}
+	return
+}
+
+// Connect hands out the oldest preconnected connection, if there is none it connects one as usual
+func (d *PreconnectDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	d.mutex.Lock()
+	conn = d.take()
+	d.mutex.Unlock()
+	select {
+	case d.signal <- struct{}{}:
+	default:
+	}
+	if conn != nil {
+		atomic.AddUint64(&d.hits, 1)
+		return
+	}
+	atomic.AddUint64(&d.misses, 1)
+	return d.dialer.Connect(ctx)
+}
+func (d *PreconnectDialer) addressable() bool {
+	_, ok := AsAddrDialer(d.dialer)
+	return ok
+}
+
+// ConnectAddr connects to addr with the wrapped dialer, the ready connections are only for the configured destination
+func (d *PreconnectDialer) ConnectAddr(ctx context.Context, network, addr string) (conn *Conn, e error) {
+	a, ok := AsAddrDialer(d.dialer)
+	if !ok {
+		e = errors.New(`dialer cannot connect to any address: ` + d.dialer.Tag())
+		return
+	}
+	return a.ConnectAddr(ctx, network, addr)
+}
+
+// take removes the oldest connection not expired, the expired ones before it are closed. d.mutex must be locked
+func (d *PreconnectDialer) take() *Conn {
+	for len(d.idle) != 0 {
+		item := d.idle[0]
+		d.idle[0] = idleConn{}
+		d.idle = d.idle[1:]
+		if d.maxIdle > 0 && time.Since(item.at) > d.maxIdle {
+			item.conn.Close()
+			continue
+		}
+		return item.conn
+	}
+	return nil
+}
+func (d *PreconnectDialer) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		d.fill()
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.expire()
+		case <-d.signal:
+		}
+	}
+}
+
+// expire closes the connections kept longer than maxIdle
+func (d *PreconnectDialer) expire() {
+	if d.maxIdle <= 0 {
+		return
+	}
+	d.mutex.Lock()
+	// connections are appended in the order they are connected
+	i := 0
+	for ; i < len(d.idle) && time.Since(d.idle[i].at) > d.maxIdle; i++ {
+		d.idle[i].conn.Close()
+		d.idle[i] = idleConn{}
+	}
+	d.idle = d.idle[i:]
+	d.mutex.Unlock()
+}
+
+// fill connects the missing connections in the background
+func (d *PreconnectDialer) fill() {
+	d.mutex.Lock()
+	if time.Now().Before(d.retry) {
+		d.mutex.Unlock()
+		return
+	}
+	n := d.size - len(d.idle) - d.dialing
+	if n > 0 {
+		d.dialing += n
+	}
+	d.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		go d.preconnect()
+	}
+}
+func (d *PreconnectDialer) preconnect() {
+	// the connect timeout of d.dialer applies
+	conn, e := d.dialer.Connect(context.Background())
+	d.mutex.Lock()
+	d.dialing--
+	if e != nil {
+		// connections failing at the same time back off once
+		if !time.Now().Before(d.retry) {
+			if d.backoff == 0 {
+				d.backoff = time.Second
+			} else if d.backoff < 30*time.Second {
+				d.backoff = min(d.backoff*2, 30*time.Second)
+			}
+			d.retry = time.Now().Add(d.backoff)
+		}
+	} else {
+		d.backoff = 0
+		if atomic.LoadUint32(&d.closed) == 0 {
+			d.idle = append(d.idle, idleConn{
+				conn: conn,
+				at:   time.Now(),
+			})
+			conn = nil
+		}
+	}
+	backoff := d.backoff
+	d.mutex.Unlock()
+	if e != nil {
+		d.log.Warn(`preconnect fail`,
+			`error`, e,
+			`retry`, backoff,
+		)
+	} else if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/internal/proxyproto"
+)
+
+// proxyProtocolVersion returns the PROXY protocol version the dialer sends, 0 if it sends none
+func proxyProtocolVersion(log *slog.Logger, opts *config.Dialer) (version int, e error) {
+	if opts.ProxyProtocol == `` {
+		return
+	}
+	version, e = proxyproto.ParseVersion(opts.ProxyProtocol)
+	if e != nil {
+		log.Error(`proxyProtocol invalid`, `error`, e)
+	}
+	return
+}
+
+// writeProxyHeader writes the PROXY protocol header carrying the client address of ctx
+func writeProxyHeader(ctx context.Context, w io.Writer, version int) (e error) {
+	_, e = w.Write(proxyproto.Header(version, ClientAddr(ctx), LocalAddr(ctx)))
+	return
+}
+
+// newRawDialer is like RawDialer, if version is not 0 the PROXY protocol header is written
+// at the start of every transport connection before the tls handshake.
+func newRawDialer(nk *network.Network, via Dialer, version int, network, addr string, cfg *tls.Config) (rawDialer network.Dialer, e error) {
+	if version == 0 {
+		return RawDialer(nk, via, network, addr, cfg)
+	}
+	plain, e := RawDialer(nk, via, network, addr, nil)
+	if e != nil {
+		return
+	}
+	rawDialer = nk.ViaDialer(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		conn, e := plain.DialContext(ctx)
+		if e != nil {
+			return nil, e
+		}
+		e = writeProxyHeader(ctx, conn, version)
+		if e != nil {
+			conn.Close()
+			return nil, e
+		}
+		return conn, nil
+	}, cfg)
+	return
+}
@@ -0,0 +1,49 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/internal/psk"
+)
+
+type pskDialer struct {
+	network.Dialer
+	secret string
+}
+
+// PSKDialer returns a dialer whose connections, connected by rawDialer, are encrypted with secret
+func PSKDialer(rawDialer network.Dialer, secret string) network.Dialer {
+	return &pskDialer{
+		Dialer: rawDialer,
+		secret: secret,
+	}
+}
+func (d *pskDialer) DialContext(ctx context.Context) (conn net.Conn, e error) {
+	conn, e = d.Dialer.DialContext(ctx)
+	if e != nil {
+		return
+	}
+	timeout := psk.DefaultTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			// a timeout of 0 would wait for the handshake forever
+			conn.Close()
+			conn = nil
+			e = context.DeadlineExceeded
+			return
+		}
+	}
+	c := psk.Client(conn, d.secret, timeout)
+	e = c.Handshake()
+	if e == nil {
+		conn = c
+	} else {
+		conn.Close()
+		conn = nil
+	}
+	return
+}
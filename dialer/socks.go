@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/network"
 	"golang.org/x/net/proxy"
 )
 
@@ -22,9 +23,10 @@ type SocksDialer struct {
 	timeout   time.Duration
 	retry     int
 	rawDialer proxy.ContextDialer
+	version   int
 }
 
-func newSocksDialer(log *slog.Logger, opts *config.Dialer, u *url.URL) (dialer *SocksDialer, e error) {
+func newSocksDialer(nk *network.Network, log *slog.Logger, via Dialer, opts *config.Dialer, u *url.URL) (dialer *SocksDialer, e error) {
 	log = log.With(`dialer`, opts.Tag)
 	var timeout time.Duration
 	if opts.Timeout == `` {
@@ -72,7 +74,21 @@ func newSocksDialer(log *slog.Logger, opts *config.Dialer, u *url.URL) (dialer *
 			Password: opts.Socks.Password,
 		}
 	}
-	rawDialer, e := proxy.SOCKS5(network, addr, auth, proxy.Direct)
+	version, e := proxyProtocolVersion(log, opts)
+	if e != nil {
+		return
+	}
+	var forward proxy.Dialer = proxy.Direct
+	if via != nil {
+		viaDialer, err := RawDialer(nk, via, network, addr, nil)
+		if err != nil {
+			e = err
+			log.Error(`new dialer fail`, `error`, e)
+			return
+		}
+		forward = ForwardDialer{Dialer: viaDialer}
+	}
+	rawDialer, e := proxy.SOCKS5(network, addr, auth, forward)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
@@ -101,6 +117,7 @@ func newSocksDialer(log *slog.Logger, opts *config.Dialer, u *url.URL) (dialer *
 		timeout:   timeout,
 		retry:     opts.Retry,
 		rawDialer: rawDialer.(proxy.ContextDialer),
+		version:   version,
 	}
 	return
 }
@@ -117,6 +134,9 @@ func (d *SocksDialer) Info() any {
 		`retry`:   d.retry,
 	}
 }
+func (d *SocksDialer) transport() (network, addr string) {
+	return d.network, d.addr
+}
 func (d *SocksDialer) Tag() string {
 	return d.remoteAddr.Dialer
 }
@@ -129,20 +149,33 @@ func (d *SocksDialer) Close() (e error) {
 	return
 }
 func (d *SocksDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	return d.ConnectAddr(ctx, d.remoteAddr.Network, d.remoteAddr.Addr)
+}
+func (d *SocksDialer) ConnectAddr(ctx context.Context, network, addr string) (conn *Conn, e error) {
+	defer observeConnect(d.remoteAddr.Dialer, time.Now(), &e)
 	if d.timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, d.timeout)
 		defer cancel()
 	}
-	c, e := d.rawDialer.DialContext(ctx, d.remoteAddr.Network, d.remoteAddr.Addr)
+	c, e := d.rawDialer.DialContext(ctx, network, addr)
+	if e == nil && d.version != 0 {
+		e = writeProxyHeader(ctx, c, d.version)
+		if e != nil {
+			c.Close()
+		}
+	}
 	if e == nil {
-		d.log.Debug(`socks connect success`)
+		d.log.Debug(`socks connect success`, `connect`, addr)
+		remoteAddr := d.remoteAddr
+		remoteAddr.Network = network
+		remoteAddr.Addr = addr
 		conn = &Conn{
 			ReadWriteCloser: c,
-			remoteAddr:      d.remoteAddr,
+			remoteAddr:      remoteAddr,
 		}
 	} else {
-		d.log.Debug(`socks connect fail`, `error`, e)
+		d.log.Debug(`socks connect fail`, `error`, e, `connect`, addr)
 	}
 	return
 }
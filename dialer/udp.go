@@ -109,6 +109,7 @@ func (u *udpDialer) Tag() string {
 	return u.remoteAddr.Dialer
 }
 func (u *udpDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	defer observeConnect(u.remoteAddr.Dialer, time.Now(), &e)
 	addr, e := net.ResolveUDPAddr(u.remoteAddr.Network, u.remoteAddr.Addr)
 	if e != nil {
 		return
@@ -0,0 +1,53 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/powerpuffpenguin/streamf/internal/network"
+)
+
+// Via returns the dialer tag refers to, it is nil if tag is empty
+func Via(log *slog.Logger, dialers map[string]Dialer, tag string) (via Dialer, e error) {
+	if tag == `` {
+		return
+	}
+	via, ok := dialers[tag]
+	if !ok {
+		e = errors.New(`via dialer not found: ` + tag)
+		log.Error(`via dialer not found`, `via`, tag)
+	}
+	return
+}
+
+// RawDialer creates the dialer that produces the transport connections,
+// if via is not nil the connections are produced by via.Connect instead of dialing network and addr.
+func RawDialer(nk *network.Network, via Dialer, network, addr string, cfg *tls.Config) (rawDialer network.Dialer, e error) {
+	if via == nil {
+		return nk.Dialer(network, addr, cfg)
+	}
+	rawDialer = nk.ViaDialer(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		conn, e := via.Connect(ctx)
+		if e != nil {
+			return nil, e
+		}
+		return conn.ReadWriteCloser, nil
+	}, cfg)
+	return
+}
+
+// ForwardDialer adapts a transport dialer to the forward dialer of proxy.SOCKS5, the network and address are ignored
+type ForwardDialer struct {
+	network.Dialer
+}
+
+func (d ForwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.Dialer.DialContext(context.Background())
+}
+func (d ForwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.Dialer.DialContext(ctx)
+}
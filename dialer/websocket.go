@@ -31,7 +31,7 @@ type WebsocketDialer struct {
 	rawDialer  network.Dialer
 }
 
-func newWebsocketDialer(nk *network.Network, log *slog.Logger, opts *config.Dialer, u *url.URL,
+func newWebsocketDialer(nk *network.Network, log *slog.Logger, via Dialer, opts *config.Dialer, u *url.URL,
 	secure bool,
 	pool *pool.Pool,
 ) (dialer *WebsocketDialer, e error) {
@@ -70,7 +70,19 @@ func newWebsocketDialer(nk *network.Network, log *slog.Logger, opts *config.Dial
 	} else {
 		addr = opts.Addr
 	}
-	rawDialer, e := nk.Dialer(network, addr, nil)
+	var cfg *tls.Config
+	if secure {
+		cfg, e = opts.TLSConfig(u.Hostname())
+		if e != nil {
+			log.Error(`new dialer fail`, `error`, e)
+			return
+		}
+	}
+	version, e := proxyProtocolVersion(log, opts)
+	if e != nil {
+		return
+	}
+	rawDialer, e := newRawDialer(nk, via, version, network, addr, nil)
 	if e != nil {
 		log.Error(`new dialer fail`, `error`, e)
 		return
@@ -126,10 +138,7 @@ func newWebsocketDialer(nk *network.Network, log *slog.Logger, opts *config.Dial
 		rawDialer: rawDialer,
 	}
 	if secure {
-		dialer.dialer.TLSClientConfig = &tls.Config{
-			ServerName:         u.Hostname(),
-			InsecureSkipVerify: opts.AllowInsecure,
-		}
+		dialer.dialer.TLSClientConfig = cfg
 	}
 	return
 }
@@ -146,6 +155,9 @@ func (d *WebsocketDialer) Info() any {
 		`retry`:   d.retry,
 	}
 }
+func (d *WebsocketDialer) transport() (network, addr string) {
+	return d.remoteAddr.Network, d.remoteAddr.Addr
+}
 func (d *WebsocketDialer) Tag() string {
 	return d.remoteAddr.Dialer
 }
@@ -160,6 +172,7 @@ func (d *WebsocketDialer) Close() (e error) {
 }
 
 func (d *WebsocketDialer) Connect(ctx context.Context) (conn *Conn, e error) {
+	defer observeConnect(d.remoteAddr.Dialer, time.Now(), &e)
 	if d.timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, d.timeout)
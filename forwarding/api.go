@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"runtime"
+	"strconv"
 
 	"github.com/powerpuffpenguin/streamf/internal/httpmux"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/version"
 )
 
@@ -27,6 +29,11 @@ func (a *Application) api() []httpmux.ApiHandler {
 			Path:    `/listener`,
 			Handler: a.apiListener,
 		},
+		{
+			Method:  []string{http.MethodGet},
+			Path:    `/sniproxy`,
+			Handler: a.apiSNIProxy,
+		},
 		{
 			Method:  []string{http.MethodGet},
 			Path:    `/dialer`,
@@ -47,10 +54,37 @@ func (a *Application) api() []httpmux.ApiHandler {
 			Path:    `/runtime`,
 			Handler: a.apiRuntime,
 		},
+		{
+			Method:  []string{http.MethodGet},
+			Path:    `/connections`,
+			Handler: a.apiConnections,
+		},
+		{
+			Method:  []string{http.MethodDelete},
+			Path:    `/connections/{id}`,
+			Handler: a.apiKill,
+		},
+		{
+			Method:  []string{http.MethodGet},
+			Path:    `/bandwidth`,
+			Handler: a.apiBandwidth,
+		},
+		{
+			Method:  []string{http.MethodGet},
+			Path:    `/metrics`,
+			Handler: a.apiMetrics,
+		},
+		{
+			Method:  []string{http.MethodPost},
+			Path:    `/reload`,
+			Handler: a.apiReload,
+		},
 	}
 }
 func (a *Application) apiApplication(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	m := make(map[string]any)
 	items := make([]any, 0, len(a.listeners))
 	for _, item := range a.listeners {
@@ -84,6 +118,8 @@ func (a *Application) apiApplication(w http.ResponseWriter, r *http.Request) {
 }
 func (a *Application) apiListener(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	items := make([]any, 0, len(a.listeners))
 	for _, item := range a.listeners {
 		items = append(items, item.Info())
@@ -94,8 +130,24 @@ func (a *Application) apiListener(w http.ResponseWriter, r *http.Request) {
 	}
 	jw.Encode(items)
 }
+func (a *Application) apiSNIProxy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	items := make([]any, 0, len(a.sniproxys))
+	for _, item := range a.sniproxys {
+		items = append(items, item.Info())
+	}
+	jw := json.NewEncoder(w)
+	if beauty := r.URL.Query().Get(`beauty`); beauty == `1` || beauty == `true` {
+		jw.SetIndent("", "\t")
+	}
+	jw.Encode(items)
+}
 func (a *Application) apiDialer(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	items := make([]any, 0, len(a.dialers))
 	for _, item := range a.dialers {
 		items = append(items, item.Info())
@@ -108,6 +160,8 @@ func (a *Application) apiDialer(w http.ResponseWriter, r *http.Request) {
 }
 func (a *Application) apiBridge(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	items := make([]any, 0, len(a.bridges))
 	for _, item := range a.bridges {
 		items = append(items, item.Info())
@@ -120,6 +174,8 @@ func (a *Application) apiBridge(w http.ResponseWriter, r *http.Request) {
 }
 func (a *Application) apiUDP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	items := make([]any, 0, len(a.udps))
 	for _, item := range a.udps {
 		items = append(items, item.Info())
@@ -130,6 +186,46 @@ func (a *Application) apiUDP(w http.ResponseWriter, r *http.Request) {
 	}
 	jw.Encode(items)
 }
+func (a *Application) apiConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	jw := json.NewEncoder(w)
+	if beauty := r.URL.Query().Get(`beauty`); beauty == `1` || beauty == `true` {
+		jw.SetIndent("", "\t")
+	}
+	jw.Encode(a.nk.Sessions())
+}
+func (a *Application) apiBandwidth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	jw := json.NewEncoder(w)
+	if beauty := r.URL.Query().Get(`beauty`); beauty == `1` || beauty == `true` {
+		jw.SetIndent("", "\t")
+	}
+	jw.Encode(a.nk.Bandwidth())
+}
+func (a *Application) apiKill(w http.ResponseWriter, r *http.Request) {
+	id, e := strconv.ParseUint(r.PathValue(`id`), 10, 64)
+	if e != nil {
+		http.Error(w, `invalid id`, http.StatusBadRequest)
+		return
+	} else if !a.nk.Kill(id) {
+		http.Error(w, `connection not found`, http.StatusNotFound)
+		return
+	}
+	a.log.Info(`kill connection`, `id`, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+func (a *Application) apiMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, metrics.ContentType)
+	metrics.Default.Write(w)
+}
+func (a *Application) apiReload(w http.ResponseWriter, r *http.Request) {
+	e := a.Reload()
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.apiApplication(w, r)
+}
 func (a *Application) apiRuntime(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
 	jw := json.NewEncoder(w)
@@ -169,10 +265,14 @@ func (a *Application) apiRoot(w http.ResponseWriter, r *http.Request) {
 	<ul>
 	<li><a href="application?beauty=1">application</a></li>
 	<li><a href="listener?beauty=1">listener</a></li>
+	<li><a href="sniproxy?beauty=1">sniproxy</a></li>
 	<li><a href="dialer?beauty=1">dialer</a></li>
 	<li><a href="bridge?beauty=1">bridge</a></li>
 	<li><a href="udp?beauty=1">udp</a></li>
 	<li><a href="runtime?beauty=1">runtime</a></li>
+	<li><a href="connections?beauty=1">connections</a></li>
+	<li><a href="bandwidth?beauty=1">bandwidth</a></li>
+	<li><a href="metrics">metrics</a></li>
 	</ul>
 </p>
 </body></html>`))
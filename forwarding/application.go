@@ -1,154 +1,157 @@
 package forwarding
 
 import (
-	"fmt"
+	"context"
 	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/powerpuffpenguin/streamf/bridge"
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/httpmux"
 	"github.com/powerpuffpenguin/streamf/internal/network"
-	"github.com/powerpuffpenguin/streamf/internal/udp"
 	"github.com/powerpuffpenguin/streamf/listener"
 	"github.com/powerpuffpenguin/streamf/pool"
-	"github.com/powerpuffpenguin/streamf/sniproxy"
 )
 
 type Application struct {
-	bridges   []bridge.Bridge
-	listeners []listener.Listener
-	sniproxys []*sniproxy.Listener
+	nk    *network.Network
+	pool  *pool.Pool
+	apis  []httpmux.ApiHandler
+	log   *slog.Logger
+	drain time.Duration
+	// load re-evaluates the configuration for Reload
+	load func() (*config.Config, error)
+
+	// guards the running items below
+	mutex     sync.Mutex
+	bridges   []*running
+	listeners []*running
+	sniproxys []*running
+	udps      []*running
 	dialers   map[string]dialer.Dialer
-	udps      []*udp.UDP
-	log       *slog.Logger
+	// json of the configuration each dialer was created from
+	dialerConf map[string]string
+
+	started bool
+	// services serving, idle is signaled with mutex when it drops to 0
+	serving int
+	idle    *sync.Cond
+	closed  uint32
+	done    chan struct{}
 }
 
-func NewApplication(conf *config.Config) (app *Application, e error) {
-	log, e := newLogger(&conf.Logger)
+// NewApplication creates the application from conf, load is used by Reload to get the new configuration.
+func NewApplication(conf *config.Config, load func() (*config.Config, error)) (app *Application, e error) {
+	log, access, e := newLogger(&conf.Logger)
 	if e != nil {
+		slog.Error(`new logger fail`, `error`, e)
 		return
 	}
-	app, bridges, dialers, listeners, sniproxys, udps, e := newApplication(log, conf)
-	if e != nil {
-		for _, d := range dialers {
-			d.Close()
-		}
-		for _, b := range bridges {
-			b.Close()
-		}
-		for _, l := range listeners {
-			l.Close()
-		}
-		for _, l := range sniproxys {
-			l.Close()
-		}
-		for _, u := range udps {
-			u.Close()
+	var drain time.Duration
+	if conf.Drain == `` {
+		drain = time.Second * 30
+	} else {
+		var err error
+		drain, err = time.ParseDuration(conf.Drain)
+		if err != nil {
+			drain = time.Second * 30
+			log.Warn(`parse duration fail, used default drain duration.`,
+				`error`, err,
+				`drain`, conf.Drain,
+				`default`, drain,
+			)
 		}
 	}
-	return
-}
-func newApplication(log *slog.Logger, conf *config.Config) (app *Application,
-	bridges []bridge.Bridge,
-	dialers map[string]dialer.Dialer,
-	listeners []listener.Listener,
-	sniproxys []*sniproxy.Listener,
-	udps []*udp.UDP,
-	e error) {
-	bridges = make([]bridge.Bridge, 0, len(conf.Bridge))
-	dialers = make(map[string]dialer.Dialer, len(conf.Dialer))
-	listeners = make([]listener.Listener, 0, len(conf.Listener))
-	udps = make([]*udp.UDP, 0, len(conf.UDP))
-	var (
-		tag    string
-		exists bool
-		pool   = pool.New(&conf.Pool)
-		nk     = network.New()
-	)
 	app = &Application{
-		log: log,
-	}
-	api := app.api()
-	var d dialer.Dialer
-	for _, opts := range conf.Dialer {
-		tag = opts.Tag
-		if _, exists = dialers[tag]; exists {
-			e = fmt.Errorf(`dialer tag repeat: %s`, opts.Tag)
-			log.Error(`dialer tag repeat`, `tag`, opts.Tag)
-			return
-		}
-		d, e = dialer.New(nk, log, pool, opts)
-		if e != nil {
-			return
-		}
-		dialers[opts.Tag] = d
-	}
-	var b bridge.Bridge
-	for _, opts := range conf.Bridge {
-		b, e = bridge.New(nk, log, pool, dialers, opts)
-		if e != nil {
-			return
-		}
-		bridges = append(bridges, b)
-	}
-	var l listener.Listener
-	for _, opts := range conf.Listener {
-		l, e = listener.New(nk, log, pool, dialers, api, opts)
-		if e != nil {
-			return
-		}
-		listeners = append(listeners, l)
-	}
-	var sni *sniproxy.Listener
-	for _, opts := range conf.SNIProxy {
-		sni, e = sniproxy.New(nk, log, pool, dialers, opts)
-		if e != nil {
-			return
-		}
-		sniproxys = append(sniproxys, sni)
+		nk:    network.New(log, access),
+		pool:  pool.New(&conf.Pool),
+		log:   log,
+		drain: drain,
+		load:  load,
+
+		dialers:    make(map[string]dialer.Dialer),
+		dialerConf: make(map[string]string),
+		done:       make(chan struct{}),
 	}
-	var u *udp.UDP
-	for _, opts := range conf.UDP {
-		u, e = udp.New(log, opts)
-		if e != nil {
-			return
-		}
-		udps = append(udps, u)
+	app.idle = sync.NewCond(&app.mutex)
+	app.apis = app.api()
+	e = app.reload(conf)
+	if e != nil {
+		app = nil
 	}
-	app.dialers = dialers
-	app.bridges = bridges
-	app.listeners = listeners
-	app.sniproxys = sniproxys
-	app.udps = udps
 	return
 }
 func (a *Application) Serve() {
-	var wait sync.WaitGroup
-	for _, bridge := range a.bridges {
-		wait.Add(1)
-		go serveWait(&wait, bridge)
-	}
-	for _, listener := range a.listeners {
-		wait.Add(1)
-		go serveWait(&wait, listener)
+	a.mutex.Lock()
+	a.started = true
+	for _, items := range [][]*running{a.bridges, a.listeners, a.sniproxys, a.udps} {
+		for _, item := range items {
+			a.serve(item)
+		}
 	}
-	for _, sniproxy := range a.sniproxys {
-		wait.Add(1)
-		go serveWait(&wait, sniproxy)
+	// a reload holds the mutex, so services it replaces are never all seen stopped
+	for a.serving != 0 {
+		a.idle.Wait()
 	}
-	for _, udp := range a.udps {
-		wait.Add(1)
-		go serveWait(&wait, udp)
+	a.mutex.Unlock()
+	if atomic.LoadUint32(&a.closed) != 0 {
+		<-a.done
 	}
-	wait.Wait()
 }
 
-type iserve interface {
-	Serve() error
+// serve serves item in a goroutine, a.mutex must be locked
+func (a *Application) serve(item *running) {
+	a.serving++
+	go func() {
+		item.Serve()
+		a.mutex.Lock()
+		a.serving--
+		if a.serving == 0 {
+			a.idle.Broadcast()
+		}
+		a.mutex.Unlock()
+	}()
+}
+
+// Drain returns the configured drain duration of Shutdown
+func (a *Application) Drain() time.Duration {
+	return a.drain
 }
 
-func serveWait(wait *sync.WaitGroup, item iserve) {
-	defer wait.Done()
-	item.Serve()
+// Shutdown stops accepting on all listeners, sniproxys, bridges and udp forwards,
+// then waits for the bridged connections to finish until ctx is done, after which they are closed.
+// Serve returns after Shutdown has finished.
+func (a *Application) Shutdown(ctx context.Context) (e error) {
+	if !atomic.CompareAndSwapUint32(&a.closed, 0, 1) {
+		return listener.ErrClosed
+	}
+	defer close(a.done)
+	// Reload does nothing once closed is set, the api must not wait for the drain
+	a.mutex.Lock()
+	services := make([]*running, 0, len(a.listeners)+len(a.sniproxys)+len(a.bridges)+len(a.udps))
+	for _, items := range [][]*running{a.listeners, a.sniproxys, a.bridges, a.udps} {
+		services = append(services, items...)
+	}
+	dialers := make([]dialer.Dialer, 0, len(a.dialers))
+	for _, d := range a.dialers {
+		dialers = append(dialers, d)
+	}
+	a.mutex.Unlock()
+
+	a.log.Info(`shutdown`, `active`, a.nk.Active())
+	for _, item := range services {
+		item.Close()
+	}
+	e = a.nk.Drain(ctx)
+	if e == nil {
+		a.log.Info(`drain completed`)
+	} else {
+		a.log.Warn(`drain timeout, remaining connections closed`, `error`, e)
+	}
+	for _, d := range dialers {
+		d.Close()
+	}
+	return
 }
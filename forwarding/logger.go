@@ -1,14 +1,19 @@
 package forwarding
 
 import (
+	"errors"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/rotate"
 )
 
-func newLogger(conf *config.Logger) (log *slog.Logger, e error) {
+// newLogger returns the logger and the access logger, access is nil if not enabled
+func newLogger(conf *config.Logger) (log, access *slog.Logger, e error) {
 	var level slog.Level
 	switch strings.ToLower(conf.Level) {
 	case "debug":
@@ -20,9 +25,47 @@ func newLogger(conf *config.Logger) (log *slog.Logger, e error) {
 	default:
 		level = slog.LevelInfo
 	}
-	log = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	handler, e := newHandler(&conf.LogOutput, &slog.HandlerOptions{
 		Level:     level,
 		AddSource: conf.Source,
-	}))
+	})
+	if e != nil {
+		return
+	}
+	log = slog.New(handler)
+	if conf.Access.Enable {
+		handler, e = newHandler(&conf.Access.LogOutput, &slog.HandlerOptions{})
+		if e != nil {
+			return
+		}
+		access = slog.New(handler)
+	}
+	return
+}
+func newHandler(conf *config.LogOutput, opts *slog.HandlerOptions) (handler slog.Handler, e error) {
+	format := strings.ToLower(conf.Format)
+	if format != `` && format != `text` && format != `json` {
+		e = errors.New(`log format not supported: ` + conf.Format)
+		return
+	}
+	var w io.Writer = os.Stdout
+	if conf.File != `` {
+		var maxAge time.Duration
+		if conf.MaxAge != `` {
+			maxAge, e = time.ParseDuration(conf.MaxAge)
+			if e != nil {
+				return
+			}
+		}
+		w, e = rotate.New(conf.File, int64(conf.MaxSize)*1024*1024, maxAge, conf.MaxBackups)
+		if e != nil {
+			return
+		}
+	}
+	if format == `json` {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
 	return
 }
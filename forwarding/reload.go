@@ -0,0 +1,360 @@
+package forwarding
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/powerpuffpenguin/streamf/bridge"
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/udp"
+	"github.com/powerpuffpenguin/streamf/listener"
+	"github.com/powerpuffpenguin/streamf/sniproxy"
+)
+
+type service interface {
+	Serve() error
+	Close() error
+	Info() any
+}
+
+// running is a bridge, listener, sniproxy or udp forward with the configuration it was created from
+type running struct {
+	service
+	// json of the configuration
+	conf string
+}
+
+// kind creates one type of service from its json configuration
+type kind struct {
+	name    string
+	running *[]*running
+	confs   []string
+	deps    [][]string
+	create  func(dialers map[string]dialer.Dialer, conf string) (service, error)
+
+	keep    []*running
+	remove  []*running
+	created []*running
+}
+
+// Reload loads the configuration again and applies the difference:
+// new dialers, bridges, listeners, sniproxys and udp forwards are started, removed ones are closed,
+// changed ones and the ones using a changed dialer are restarted, the others and their connections are left untouched.
+// If anything fails the running configuration is restored. logger, pool and drain are not reloaded.
+func (a *Application) Reload() (e error) {
+	if a.load == nil {
+		return errors.New(`reload not supported`)
+	}
+	conf, e := a.load()
+	if e != nil {
+		a.log.Error(`reload fail`, `error`, e)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if atomic.LoadUint32(&a.closed) != 0 {
+		return listener.ErrClosed
+	}
+	e = a.reload(conf)
+	if e != nil {
+		a.log.Error(`reload fail`, `error`, e)
+	}
+	return
+}
+func (a *Application) reload(conf *config.Config) (e error) {
+	// dialers are created first, this does not affect the running services
+	var (
+		dialers    = make(map[string]dialer.Dialer, len(conf.Dialer))
+		dialerConf = make(map[string]string, len(conf.Dialer))
+		changed    = make(map[string]bool)
+		created    []dialer.Dialer
+	)
+	for _, opts := range conf.Dialer {
+		if _, exists := dialers[opts.Tag]; exists {
+			e = fmt.Errorf(`dialer tag repeat: %s`, opts.Tag)
+			a.log.Error(`dialer tag repeat`, `tag`, opts.Tag)
+			break
+		}
+		var b []byte
+		b, e = json.Marshal(opts)
+		if e != nil {
+			break
+		}
+		s := string(b)
+		deps := []string{opts.Fallback, opts.Via}
+		for _, member := range opts.Members {
+			deps = append(deps, member.Tag)
+		}
+		if old, ok := a.dialers[opts.Tag]; ok && a.dialerConf[opts.Tag] == s && !anyChanged(changed, deps) {
+			dialers[opts.Tag] = old
+		} else {
+			var d dialer.Dialer
+			d, e = dialer.New(a.nk, a.log, a.pool, dialers, opts)
+			if e != nil {
+				break
+			}
+			created = append(created, d)
+			dialers[opts.Tag] = d
+			changed[opts.Tag] = true
+		}
+		dialerConf[opts.Tag] = s
+	}
+	if e != nil {
+		for _, d := range created {
+			d.Close()
+		}
+		return
+	}
+	for tag := range a.dialers {
+		if _, ok := dialers[tag]; !ok {
+			changed[tag] = true
+		}
+	}
+
+	kinds, e := a.kinds(conf)
+	if e != nil {
+		for _, d := range created {
+			d.Close()
+		}
+		return
+	}
+	for _, k := range kinds {
+		k.plan(changed)
+	}
+	// close removed services first, so that their addresses can be listened again
+	for _, k := range kinds {
+		for _, item := range k.remove {
+			item.Close()
+		}
+	}
+	for _, k := range kinds {
+		e = k.start(dialers)
+		if e != nil {
+			a.log.Error(`start `+k.name+` fail`, `error`, e)
+			if err := a.rollback(kinds); err != nil {
+				e = fmt.Errorf(`%w, %w`, e, err)
+			}
+			for _, d := range created {
+				d.Close()
+			}
+			return
+		}
+	}
+
+	// commit
+	for _, k := range kinds {
+		items := make([]*running, 0, len(k.keep))
+		for _, item := range k.keep {
+			if item != nil {
+				items = append(items, item)
+			}
+		}
+		*k.running = append(items, k.created...)
+		if a.started {
+			for _, item := range k.created {
+				a.serve(item)
+			}
+		}
+	}
+	var closed int
+	for tag, d := range a.dialers {
+		if dialers[tag] != d {
+			d.Close()
+			closed++
+		}
+	}
+	a.dialers = dialers
+	a.dialerConf = dialerConf
+	a.nk.Shape(conf.Dialer)
+	if a.started {
+		args := []any{`dialer`, fmt.Sprintf(`+%d -%d`, len(created), closed)}
+		for _, k := range kinds {
+			args = append(args, k.name, fmt.Sprintf(`+%d -%d`, len(k.created), len(k.remove)))
+		}
+		a.log.Info(`reload`, args...)
+	}
+	return
+}
+
+// rollback closes the services created by a failed reload and restarts the removed ones,
+// the ones that fail to restart are dropped and returned as an error
+func (a *Application) rollback(kinds []*kind) (e error) {
+	for _, k := range kinds {
+		for _, item := range k.created {
+			item.Close()
+		}
+	}
+	var errs []error
+	for _, k := range kinds {
+		failed := make(map[*running]bool)
+		for _, item := range k.remove {
+			s, err := k.create(a.dialers, item.conf)
+			if err != nil {
+				a.log.Error(`restore `+k.name+` fail`, `error`, err)
+				errs = append(errs, fmt.Errorf(`restore %s fail: %w`, k.name, err))
+				failed[item] = true
+				continue
+			}
+			item.service = s
+			if a.started {
+				a.serve(item)
+			}
+		}
+		if len(failed) != 0 {
+			items := make([]*running, 0, len(*k.running))
+			for _, item := range *k.running {
+				if !failed[item] {
+					items = append(items, item)
+				}
+			}
+			*k.running = items
+		}
+	}
+	return errors.Join(errs...)
+}
+func (a *Application) kinds(conf *config.Config) (kinds []*kind, e error) {
+	bridges := &kind{
+		name:    `bridge`,
+		running: &a.bridges,
+		create: func(dialers map[string]dialer.Dialer, conf string) (s service, e error) {
+			var opts config.Bridge
+			e = json.Unmarshal([]byte(conf), &opts)
+			if e != nil {
+				return
+			}
+			return bridge.New(a.nk, a.log, a.pool, dialers, &opts)
+		},
+	}
+	for _, opts := range conf.Bridge {
+		e = bridges.add(opts, opts.Dialer.Tag, opts.Dialer.Mirror.Tag, opts.Via)
+		if e != nil {
+			return
+		}
+	}
+	listeners := &kind{
+		name:    `listener`,
+		running: &a.listeners,
+		create: func(dialers map[string]dialer.Dialer, conf string) (s service, e error) {
+			var opts config.Listener
+			e = json.Unmarshal([]byte(conf), &opts)
+			if e != nil {
+				return
+			}
+			return listener.New(a.nk, a.log, a.pool, dialers, a.apis, &opts)
+		},
+	}
+	for _, opts := range conf.Listener {
+		deps := []string{opts.Dialer.Tag, opts.Dialer.Mirror.Tag}
+		for _, router := range opts.Router {
+			deps = append(deps, router.Dialer.Tag, router.Dialer.Mirror.Tag)
+		}
+		e = listeners.add(opts, deps...)
+		if e != nil {
+			return
+		}
+	}
+	sniproxys := &kind{
+		name:    `sniproxy`,
+		running: &a.sniproxys,
+		create: func(dialers map[string]dialer.Dialer, conf string) (s service, e error) {
+			var opts config.SNIProxy
+			e = json.Unmarshal([]byte(conf), &opts)
+			if e != nil {
+				return
+			}
+			return sniproxy.New(a.nk, a.log, a.pool, dialers, &opts)
+		},
+	}
+	for _, opts := range conf.SNIProxy {
+		deps := []string{opts.Default.Tag, opts.Default.Mirror.Tag, opts.Fallback.Tag, opts.Fallback.Mirror.Tag}
+		for _, router := range opts.SNIRouter {
+			deps = append(deps, router.Dialer.Tag, router.Dialer.Mirror.Tag)
+		}
+		e = sniproxys.add(opts, deps...)
+		if e != nil {
+			return
+		}
+	}
+	udps := &kind{
+		name:    `udp`,
+		running: &a.udps,
+		create: func(dialers map[string]dialer.Dialer, conf string) (s service, e error) {
+			var opts config.UDPForward
+			e = json.Unmarshal([]byte(conf), &opts)
+			if e != nil {
+				return
+			}
+			return udp.New(a.log, &opts)
+		},
+	}
+	for _, opts := range conf.UDP {
+		e = udps.add(opts)
+		if e != nil {
+			return
+		}
+	}
+	kinds = []*kind{bridges, listeners, sniproxys, udps}
+	return
+}
+func (k *kind) add(opts any, deps ...string) (e error) {
+	b, e := json.Marshal(opts)
+	if e != nil {
+		return
+	}
+	k.confs = append(k.confs, string(b))
+	k.deps = append(k.deps, deps)
+	return
+}
+
+// plan keeps the running services whose configuration and dialers did not change
+func (k *kind) plan(changed map[string]bool) {
+	used := make(map[*running]bool, len(*k.running))
+	k.keep = make([]*running, len(k.confs))
+	for i, conf := range k.confs {
+		if anyChanged(changed, k.deps[i]) {
+			continue
+		}
+		for _, item := range *k.running {
+			if !used[item] && item.conf == conf {
+				used[item] = true
+				k.keep[i] = item
+				break
+			}
+		}
+	}
+	for _, item := range *k.running {
+		if !used[item] {
+			k.remove = append(k.remove, item)
+		}
+	}
+}
+
+// start creates the services that are not kept
+func (k *kind) start(dialers map[string]dialer.Dialer) (e error) {
+	for i, item := range k.keep {
+		if item != nil {
+			continue
+		}
+		var s service
+		s, e = k.create(dialers, k.confs[i])
+		if e != nil {
+			return
+		}
+		k.created = append(k.created, &running{
+			service: s,
+			conf:    k.confs[i],
+		})
+	}
+	return
+}
+func anyChanged(changed map[string]bool, tags []string) bool {
+	for _, tag := range tags {
+		if tag != `` && changed[tag] {
+			return true
+		}
+	}
+	return false
+}
@@ -6,14 +6,15 @@ toolchain go1.23.11
 
 require (
 	github.com/google/go-jsonnet v0.20.0
+	github.com/klauspost/compress v1.17.11
 	github.com/powerpuffpenguin/vnet v0.0.0-20220526055934-26fa1e357938
+	golang.org/x/crypto v0.40.0
 	golang.org/x/net v0.42.0
 )
 
 require (
 	github.com/dreadl0ck/tlsx v1.0.3 // indirect
 	github.com/google/gopacket v1.1.17 // indirect
-	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 	gopkg.in/yaml.v2 v2.2.7 // indirect
 	sigs.k8s.io/yaml v1.1.0 // indirect
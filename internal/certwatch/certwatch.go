@@ -0,0 +1,176 @@
+// Package certwatch serves tls certificates that are reloaded when their files change
+package certwatch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+)
+
+// Watcher serves a certificate through GetCertificate, the certificate loaded from files is reloaded
+// when the files change
+type Watcher struct {
+	certFile, keyFile string
+	reload            string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	leaf        *x509.Certificate
+	// modification time and size of certFile and keyFile when certificate was loaded
+	stats [2]stat
+
+	done   chan struct{}
+	closed uint32
+}
+type stat struct {
+	modTime time.Time
+	size    int64
+}
+
+// New returns a watcher serving certificate, which was loaded from conf.
+// If it was loaded from certFile and keyFile they are watched after Watch is called.
+func New(conf *config.TLS, certificate tls.Certificate) *Watcher {
+	w := &Watcher{
+		reload:      conf.Reload,
+		certificate: &certificate,
+		leaf:        leaf(&certificate),
+		done:        make(chan struct{}),
+	}
+	if conf.Cert == `` || conf.Key == `` {
+		w.certFile, w.keyFile = conf.CertFile, conf.KeyFile
+		w.stats, _ = w.stat()
+	}
+	return w
+}
+func leaf(certificate *tls.Certificate) *x509.Certificate {
+	if certificate.Leaf != nil {
+		return certificate.Leaf
+	} else if len(certificate.Certificate) == 0 {
+		return nil
+	}
+	cert, e := x509.ParseCertificate(certificate.Certificate[0])
+	if e != nil {
+		return nil
+	}
+	return cert
+}
+func (w *Watcher) stat() (stats [2]stat, e error) {
+	for i, name := range [2]string{w.certFile, w.keyFile} {
+		var info os.FileInfo
+		info, e = os.Stat(name)
+		if e != nil {
+			return
+		}
+		stats[i] = stat{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+	}
+	return
+}
+
+// GetCertificate returns the current certificate, it is set as tls.Config.GetCertificate
+func (w *Watcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mutex.RLock()
+	certificate := w.certificate
+	w.mutex.RUnlock()
+	return certificate, nil
+}
+
+// Watch checks the files for changes every conf.Reload, default '1m'. It does nothing if w is nil
+// or the certificate was not loaded from files.
+func (w *Watcher) Watch(log *slog.Logger) {
+	if w == nil || w.certFile == `` || w.keyFile == `` {
+		return
+	}
+	interval := time.Minute
+	if w.reload != `` {
+		var err error
+		interval, err = time.ParseDuration(w.reload)
+		if err != nil {
+			interval = time.Minute
+			log.Warn(`parse duration fail, used default certificate reload duration.`,
+				`error`, err,
+				`reload`, w.reload,
+				`default`, interval,
+			)
+		} else if interval < time.Second {
+			log.Info(`certificate reload disabled`)
+			return
+		}
+	}
+	go w.watch(log, interval)
+}
+func (w *Watcher) watch(log *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		stats, e := w.stat()
+		if e != nil {
+			log.Warn(`stat certificate fail`, `error`, e)
+			continue
+		}
+		w.mutex.RLock()
+		changed := stats != w.stats
+		w.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+		// if the files are changed again while loading they are loaded again at the next check
+		certificate, e := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+		if e != nil {
+			log.Warn(`reload certificate fail`, `error`, e)
+			continue
+		}
+		cert := leaf(&certificate)
+		w.mutex.Lock()
+		w.certificate = &certificate
+		w.leaf = cert
+		w.stats = stats
+		w.mutex.Unlock()
+		if cert == nil {
+			log.Info(`certificate reloaded`)
+		} else {
+			log.Info(`certificate reloaded`,
+				`subject`, cert.Subject.String(),
+				`expiry`, cert.NotAfter,
+			)
+		}
+	}
+}
+
+// Close stops watching, it does nothing if w is nil
+func (w *Watcher) Close() {
+	if w != nil && w.closed == 0 && atomic.CompareAndSwapUint32(&w.closed, 0, 1) {
+		close(w.done)
+	}
+}
+
+// Info returns nil if w is nil
+func (w *Watcher) Info() any {
+	if w == nil {
+		return nil
+	}
+	w.mutex.RLock()
+	cert := w.leaf
+	w.mutex.RUnlock()
+	if cert == nil {
+		return map[string]any{}
+	}
+	return map[string]any{
+		`subject`: cert.Subject.String(),
+		`dns`:     cert.DNSNames,
+		`expiry`:  cert.NotAfter.Format(time.RFC3339),
+	}
+}
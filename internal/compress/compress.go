@@ -0,0 +1,199 @@
+// Package compress wraps streams with a streaming compressor that flushes every write,
+// both ends of a stream must use the same algorithm.
+//
+// The compressors use their fastest levels and small windows, because every stream, including each
+// stream multiplexed on a carrier, keeps its own.
+package compress
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+)
+
+const (
+	Deflate = `deflate`
+	Zstd    = `zstd`
+	// Snappy is the framed snappy format
+	Snappy = `snappy`
+)
+
+const (
+	// zstdWindow is the window of the zstd encoder, the decoder accepts up to zstdMaxWindow from the peer
+	zstdWindow    = 64 * 1024
+	zstdMaxWindow = 8 * 1024 * 1024
+	// snappyBlock is the largest block of the snappy format
+	snappyBlock = 64 * 1024
+)
+
+// Check returns an error if algorithm is not empty and not supported
+func Check(algorithm string) error {
+	switch algorithm {
+	case ``, Deflate, Zstd, Snappy:
+		return nil
+	}
+	return errors.New(`compress algorithm not supported: ` + algorithm)
+}
+
+// Stats counts the bytes of the streams wrapped by it before and after compression
+type Stats struct {
+	algorithm string
+	// uncompressed bytes read and written
+	in, out int64
+	// compressed bytes read from and written to the underlying streams
+	wireIn, wireOut int64
+}
+
+// New returns the stats of algorithm, it returns nil if algorithm is empty.
+// algorithm must have been checked by Check
+func New(algorithm string) *Stats {
+	if algorithm == `` {
+		return nil
+	}
+	return &Stats{
+		algorithm: algorithm,
+	}
+}
+
+// Wrap returns rw compressed by the algorithm of s, or rw itself if s is nil
+func (s *Stats) Wrap(rw io.ReadWriteCloser) io.ReadWriteCloser {
+	if s == nil {
+		return rw
+	}
+	c := &conn{
+		rw:    rw,
+		stats: s,
+	}
+	var (
+		src = &counter{r: rw, n: &s.wireIn}
+		dst = &counter{w: rw, n: &s.wireOut}
+	)
+	switch s.algorithm {
+	case Zstd:
+		// the options are valid, so the errors are always nil
+		c.w, _ = zstd.NewWriter(dst,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithWindowSize(zstdWindow),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithLowerEncoderMem(true),
+		)
+		d, _ := zstd.NewReader(src,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(zstdMaxWindow),
+		)
+		// without concurrency the decoder runs no goroutines, it is not closed because Close races with Read
+		c.r = io.NopCloser(d)
+	case Snappy:
+		c.w = s2.NewWriter(dst,
+			s2.WriterSnappyCompat(),
+			s2.WriterBlockSize(snappyBlock),
+			s2.WriterConcurrency(1),
+		)
+		c.r = io.NopCloser(s2.NewReader(src, s2.ReaderMaxBlockSize(snappyBlock)))
+	default:
+		c.w, _ = flate.NewWriter(dst, flate.BestSpeed)
+		c.r = flate.NewReader(src)
+	}
+	return c
+}
+func (s *Stats) Info() any {
+	if s == nil {
+		return nil
+	}
+	return map[string]any{
+		`algorithm`: s.algorithm,
+		`in`:        atomic.LoadInt64(&s.in),
+		`out`:       atomic.LoadInt64(&s.out),
+		`wireIn`:    atomic.LoadInt64(&s.wireIn),
+		`wireOut`:   atomic.LoadInt64(&s.wireOut),
+	}
+}
+
+// MarshalJSON reports the current counts when s is stored in static info
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Info())
+}
+
+// counter counts the bytes read from r or written to w
+type counter struct {
+	r io.Reader
+	w io.Writer
+	n *int64
+}
+
+func (c *counter) Read(b []byte) (n int, e error) {
+	n, e = c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return
+}
+func (c *counter) Write(b []byte) (n int, e error) {
+	n, e = c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return
+}
+
+// writer is the compressor of an algorithm, Close ends the compressed stream
+type writer interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type conn struct {
+	rw    io.ReadWriteCloser
+	stats *Stats
+	r     io.ReadCloser
+
+	mutex  sync.Mutex
+	w      writer
+	closed bool
+}
+
+func (c *conn) Read(b []byte) (n int, e error) {
+	n, e = c.r.Read(b)
+	atomic.AddInt64(&c.stats.in, int64(n))
+	return
+}
+
+// Write compresses b and flushes it, so the peer can read it without waiting for more data
+func (c *conn) Write(b []byte) (n int, e error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, e = c.w.Write(b)
+	if e == nil {
+		e = c.w.Flush()
+	}
+	atomic.AddInt64(&c.stats.out, int64(n))
+	return
+}
+
+// CloseWrite ends the compressed stream and half-closes the underlying stream.
+// The end of a deflate stream is read as io.EOF, zstd and snappy streams end with the underlying stream
+func (c *conn) CloseWrite() (e error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	e = c.w.Close()
+	if e == nil {
+		// the peer reads io.EOF from the end of a deflate stream even if rw can not be half-closed
+		ioutil.CloseWrite(c.rw)
+	}
+	return
+}
+func (c *conn) Close() error {
+	c.r.Close()
+	return c.rw.Close()
+}
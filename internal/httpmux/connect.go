@@ -0,0 +1,72 @@
+package httpmux
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+)
+
+// ProxyAuthorization returns the Proxy-Authorization header value for basic auth
+func ProxyAuthorization(user, password string) string {
+	return `Basic ` + base64.StdEncoding.EncodeToString([]byte(user+`:`+password))
+}
+
+// ConnectProxy sends "CONNECT addr" to the http proxy over conn and returns the tunnelled connection.
+// conn is closed if it fails.
+func ConnectProxy(ctx context.Context, conn net.Conn, addr string, header http.Header) (c net.Conn, e error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: header,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	e = req.Write(conn)
+	if e != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			e = ctx.Err()
+		}
+		return
+	}
+	r := bufio.NewReader(conn)
+	resp, e := http.ReadResponse(r, req)
+	if e != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			e = ctx.Err()
+		}
+		return
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		resp.Body.Close()
+		conn.Close()
+		e = errors.New(`http connect fail: ` + resp.Status)
+		return
+	}
+	if !stop() {
+		conn.Close()
+		e = ctx.Err()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c = ioutil.NewBufferedConn(conn, r)
+	return
+}
@@ -100,4 +100,9 @@ func (c *httpCloser) Close() (e error) {
 	return
 }
 
+// CloseWrite ends the request body
+func (c *httpCloser) CloseWrite() error {
+	return c.w.Close()
+}
+
 var ErrDialerClosed = errors.New(`dialer already closed`)
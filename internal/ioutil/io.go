@@ -1,12 +1,27 @@
 package ioutil
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"time"
 )
 
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of w if it supports half-close,
+// such as *net.TCPConn, *net.UnixConn and *tls.Conn, otherwise errors.ErrUnsupported is returned.
+func CloseWrite(w any) error {
+	if cw, ok := w.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
 type unknowAddr struct {
 }
 
@@ -92,6 +107,9 @@ func (rw *rwfReaderFrom) ReadFrom(r io.Reader) (int64, error) {
 func (rw *rwfReaderFrom) Close() error {
 	return rw.c.Close()
 }
+func (rw *rwfReaderFrom) CloseWrite() error {
+	return CloseWrite(rw.c)
+}
 
 type rwf struct {
 	conn
@@ -112,6 +130,9 @@ func (rw *rwf) Write(b []byte) (int, error) {
 func (rw *rwf) Close() error {
 	return rw.c.Close()
 }
+func (rw *rwf) CloseWrite() error {
+	return CloseWrite(rw.c)
+}
 
 type rwReaderFrom struct {
 	conn
@@ -131,6 +152,9 @@ func (rw *rwReaderFrom) ReadFrom(r io.Reader) (int64, error) {
 func (rw *rwReaderFrom) Close() error {
 	return rw.c.Close()
 }
+func (rw *rwReaderFrom) CloseWrite() error {
+	return CloseWrite(rw.c)
+}
 
 type rw struct {
 	conn
@@ -142,3 +166,37 @@ type rw struct {
 func (rw *rw) Close() error {
 	return rw.c.Close()
 }
+func (rw *rw) CloseWrite() error {
+	return CloseWrite(rw.c)
+}
+
+// NewBufferedConn returns a connection that reads the data already buffered by r before reading c,
+// such as what an http server or client read past the header. If nothing is buffered c is returned.
+func NewBufferedConn(c net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return c
+	}
+	return &bufferedConn{
+		Conn: c,
+		r:    r,
+	}
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+func (c *bufferedConn) Read(b []byte) (n int, e error) {
+	if c.r == nil {
+		return c.Conn.Read(b)
+	}
+	n, e = c.r.Read(b)
+	if c.r.Buffered() == 0 {
+		c.r = nil
+	}
+	return
+}
@@ -0,0 +1,109 @@
+// Package metrics implements the counters exported in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+)
+
+// ContentType of the Prometheus text format
+const ContentType = `text/plain; version=0.0.4; charset=utf-8`
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mutex.Unlock()
+}
+
+// Write writes all metrics in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := r.metrics
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Default is the registry served by the api
+var Default = &Registry{}
+
+var (
+	Accepted = NewCounterVec(`streamf_accepted_total`,
+		`Connections accepted by listeners, sniproxys and bridges.`,
+		`listener`,
+	)
+	Rejected = NewCounterVec(`streamf_rejected_total`,
+		`Connections rejected by admission control or allow and deny lists, reason is 'max connections', 'max connections per ip', 'accept rate' or 'denied'.`,
+		`listener`, `reason`,
+	)
+	Bridges = NewGaugeVec(`streamf_bridges_active`,
+		`Bridged connections currently open.`,
+		`listener`, `dialer`,
+	)
+	BytesIn = NewCounterVec(`streamf_bridge_in_bytes_total`,
+		`Bytes read from clients and written to upstreams.`,
+		`listener`, `dialer`,
+	)
+	BytesOut = NewCounterVec(`streamf_bridge_out_bytes_total`,
+		`Bytes read from upstreams and written to clients.`,
+		`listener`, `dialer`,
+	)
+	ConnectFailures = NewCounterVec(`streamf_dialer_connect_failures_total`,
+		`Failed connects of dialers.`,
+		`dialer`,
+	)
+	ConnectDuration = NewHistogramVec(`streamf_dialer_connect_duration_seconds`,
+		`Time taken by successful connects of dialers.`,
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		`dialer`,
+	)
+	SNIMatches = NewCounterVec(`streamf_sniproxy_matches_total`,
+		`Connections routed by sniproxys, route is the matcher, 'fallback', 'default' or 'none'.`,
+		`sniproxy`, `route`,
+	)
+	PortalIdle = NewGaugeVec(`streamf_portal_idle_connections`,
+		`Connections bridges have opened to portals that are waiting to be used.`,
+		`portal`,
+	)
+	UDPSessions = NewGaugeVec(`streamf_udp_sessions`,
+		`Client sessions of udp forwards.`,
+		`udp`,
+	)
+)
+
+// Listener counts the connections accepted by l
+func Listener(l net.Listener, accepted *Counter) net.Listener {
+	return &listener{
+		Listener: l,
+		accepted: accepted,
+	}
+}
+
+type listener struct {
+	net.Listener
+	accepted *Counter
+}
+
+func (l *listener) Accept() (c net.Conn, e error) {
+	c, e = l.Listener.Accept()
+	if e == nil {
+		l.accepted.Inc()
+	}
+	return
+}
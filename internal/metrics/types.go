@@ -0,0 +1,291 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a value that only goes up
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+func (c *Counter) Add(n int64) {
+	if n > 0 {
+		atomic.AddInt64(&c.value, n)
+	}
+}
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, upper := range h.buckets {
+		if v <= upper {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+}
+
+// vec holds the children of a metric by label values
+type vec[T any] struct {
+	name, help, typ string
+	labels          []string
+	create          func() *T
+
+	mutex    sync.Mutex
+	children map[string]*child[T]
+}
+type child[T any] struct {
+	values []string
+	metric *T
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(`metrics: ` + v.name + ` expects ` + strconv.Itoa(len(v.labels)) + ` label values`)
+	}
+	key := strings.Join(values, "\xff")
+	v.mutex.Lock()
+	c, ok := v.children[key]
+	if !ok {
+		if v.children == nil {
+			v.children = make(map[string]*child[T])
+		}
+		c = &child[T]{
+			values: append([]string(nil), values...),
+			metric: v.create(),
+		}
+		v.children[key] = c
+	}
+	v.mutex.Unlock()
+	return c.metric
+}
+func (v *vec[T]) delete(values []string) {
+	key := strings.Join(values, "\xff")
+	v.mutex.Lock()
+	delete(v.children, key)
+	v.mutex.Unlock()
+}
+
+// sorted returns the children ordered by label values so the output is stable
+func (v *vec[T]) sorted() []*child[T] {
+	v.mutex.Lock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*child[T], len(keys))
+	for i, key := range keys {
+		children[i] = v.children[key]
+	}
+	v.mutex.Unlock()
+	return children
+}
+func (v *vec[T]) writeHeader(w *bufio.Writer) {
+	w.WriteString(`# HELP `)
+	w.WriteString(v.name)
+	w.WriteByte(' ')
+	w.WriteString(helpReplacer.Replace(v.help))
+	w.WriteString("\n# TYPE ")
+	w.WriteString(v.name)
+	w.WriteByte(' ')
+	w.WriteString(v.typ)
+	w.WriteByte('\n')
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// writeSample writes one line, extra is an additional label pair such as le
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra, extraValue string, value string) {
+	w.WriteString(name)
+	if len(labels) != 0 || extra != `` {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label)
+			w.WriteString(`="`)
+			w.WriteString(labelReplacer.Replace(values[i]))
+			w.WriteByte('"')
+		}
+		if extra != `` {
+			if len(labels) != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+			w.WriteString(`="`)
+			w.WriteString(extraValue)
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return `+Inf`
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+// NewCounterVec creates a counter and registers it in Default
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		vec: vec[Counter]{
+			name:   name,
+			help:   help,
+			typ:    `counter`,
+			labels: labels,
+			create: func() *Counter { return &Counter{} },
+		},
+	}
+	Default.register(v)
+	return v
+}
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+func (v *CounterVec) Delete(values ...string) {
+	v.delete(values)
+}
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		writeSample(w, v.name, v.labels, c.values, ``, ``, strconv.FormatInt(c.metric.Value(), 10))
+	}
+}
+
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+// NewGaugeVec creates a gauge and registers it in Default
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{
+		vec: vec[Gauge]{
+			name:   name,
+			help:   help,
+			typ:    `gauge`,
+			labels: labels,
+			create: func() *Gauge { return &Gauge{} },
+		},
+	}
+	Default.register(v)
+	return v
+}
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+func (v *GaugeVec) Delete(values ...string) {
+	v.delete(values)
+}
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		writeSample(w, v.name, v.labels, c.values, ``, ``, strconv.FormatInt(c.metric.Value(), 10))
+	}
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+// NewHistogramVec creates a histogram with the upper bounds buckets in increasing order and registers it in Default
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		vec: vec[Histogram]{
+			name:   name,
+			help:   help,
+			typ:    `histogram`,
+			labels: labels,
+			create: func() *Histogram {
+				return &Histogram{
+					buckets: buckets,
+					counts:  make([]uint64, len(buckets)),
+				}
+			},
+		},
+	}
+	Default.register(v)
+	return v
+}
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+func (v *HistogramVec) Delete(values ...string) {
+	v.delete(values)
+}
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		var (
+			h          = c.metric
+			cumulative uint64
+		)
+		for i, upper := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			writeSample(w, v.name+`_bucket`, v.labels, c.values, `le`, formatFloat(upper), strconv.FormatUint(cumulative, 10))
+		}
+		count := strconv.FormatUint(atomic.LoadUint64(&h.count), 10)
+		writeSample(w, v.name+`_bucket`, v.labels, c.values, `le`, `+Inf`, count)
+		writeSample(w, v.name+`_sum`, v.labels, c.values, ``, ``, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum))))
+		writeSample(w, v.name+`_count`, v.labels, c.values, ``, ``, count)
+	}
+}
@@ -0,0 +1,376 @@
+// Package mux multiplexes streams over a single carrier connection.
+//
+// Every frame starts with a 7 bytes header: command (1 byte), stream id (4 bytes) and payload length (2 bytes),
+// integers are big endian. Streams opened by the client have odd ids and streams opened by the server even ids.
+// Each stream has a receive window of 256KiB, the receiver returns the consumed bytes with cmdWND
+// and closes the session if the peer sends more than the window.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// open a stream
+	cmdSYN byte = iota
+	// data
+	cmdPSH
+	// the sender finished writing
+	cmdFIN
+	// the stream is aborted
+	cmdRST
+	// the receiver consumed bytes, the payload is the uint32 increment of the send window
+	cmdWND
+	// keepalive
+	cmdPING
+	cmdPONG
+	// the sender accepts no more streams
+	cmdGOAWAY
+)
+const (
+	headerSize = 7
+	maxPayload = 32 * 1024
+	window     = 256 * 1024
+	backlog    = 128
+)
+
+var (
+	ErrClosed = errors.New(`mux session already closed`)
+	ErrReset  = errors.New(`mux stream reset`)
+	ErrGoAway = errors.New(`mux session accepts no more streams`)
+
+	errKeepalive = errors.New(`mux keepalive timeout`)
+	errCommand   = errors.New(`mux unknown command`)
+	errWindow    = errors.New(`mux receive window exceeded`)
+	errControl   = errors.New(`mux too many streams reset`)
+)
+
+// Session multiplexes streams over conn
+type Session struct {
+	conn      io.ReadWriteCloser
+	keepalive time.Duration
+
+	writeMutex sync.Mutex
+	// control frames are sent by a single goroutine so that recv never waits for a write,
+	// pings and pongs not sent yet are coalesced
+	pings, pongs chan struct{}
+	resets       chan uint32
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accept chan *Stream
+	done   chan struct{}
+	closed uint32
+	// GoAway was called, the peer called GoAway
+	goAway, remoteGoAway uint32
+	// unix nano of the last frame received
+	received int64
+}
+
+// Client returns the session of the end that opens streams on conn,
+// if keepalive > 0 a ping is sent every keepalive and conn is closed if nothing is received for 3 keepalives.
+func Client(conn io.ReadWriteCloser, keepalive time.Duration) *Session {
+	return newSession(conn, keepalive, 1)
+}
+
+// Server returns the session of the end that accepts streams on conn
+func Server(conn io.ReadWriteCloser, keepalive time.Duration) *Session {
+	return newSession(conn, keepalive, 2)
+}
+func newSession(conn io.ReadWriteCloser, keepalive time.Duration, id uint32) *Session {
+	s := &Session{
+		conn:      conn,
+		keepalive: keepalive,
+		streams:   make(map[uint32]*Stream),
+		nextID:    id,
+		accept:    make(chan *Stream, backlog),
+		done:      make(chan struct{}),
+		received:  time.Now().UnixNano(),
+		pings:     make(chan struct{}, 1),
+		pongs:     make(chan struct{}, 1),
+		resets:    make(chan uint32, backlog),
+	}
+	go s.recv()
+	go s.control()
+	if keepalive > 0 {
+		go s.ping()
+	}
+	return s
+}
+
+// Open opens a new stream
+func (s *Session) Open() (stream *Stream, e error) {
+	s.mutex.Lock()
+	if s.IsClosed() {
+		s.mutex.Unlock()
+		e = ErrClosed
+		return
+	} else if atomic.LoadUint32(&s.remoteGoAway) != 0 {
+		s.mutex.Unlock()
+		e = ErrGoAway
+		return
+	}
+	stream = newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[stream.id] = stream
+	s.mutex.Unlock()
+
+	e = s.write(cmdSYN, stream.id, nil)
+	if e != nil {
+		s.remove(stream.id)
+		stream = nil
+	}
+	return
+}
+
+// Accept waits for the next stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Close closes the carrier connection and all the streams
+func (s *Session) Close() error {
+	if !s.close(ErrClosed) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// GoAway tells the peer not to open more streams, the streams it opens later are reset
+func (s *Session) GoAway() error {
+	if s.goAway == 0 && atomic.CompareAndSwapUint32(&s.goAway, 0, 1) {
+		return s.write(cmdGOAWAY, 0, nil)
+	}
+	return nil
+}
+
+// IsClosed reports whether the carrier connection is closed
+func (s *Session) IsClosed() bool {
+	return atomic.LoadUint32(&s.closed) != 0
+}
+
+// Available reports whether new streams can be opened
+func (s *Session) Available() bool {
+	return !s.IsClosed() && atomic.LoadUint32(&s.remoteGoAway) == 0
+}
+
+// Done is closed when the carrier connection is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session was closed
+func (s *Session) Err() (e error) {
+	s.mutex.Lock()
+	e = s.err
+	s.mutex.Unlock()
+	return
+}
+
+// NumStreams returns the number of streams not closed
+func (s *Session) NumStreams() (n int) {
+	s.mutex.Lock()
+	n = len(s.streams)
+	s.mutex.Unlock()
+	return
+}
+func (s *Session) close(err error) bool {
+	if s.closed == 0 && atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		s.mutex.Lock()
+		s.err = err
+		s.mutex.Unlock()
+		close(s.done)
+		s.conn.Close()
+		return true
+	}
+	return false
+}
+
+// write sends a frame, if it fails the session is closed
+func (s *Session) write(cmd byte, id uint32, payload []byte) (e error) {
+	b := make([]byte, headerSize+len(payload))
+	b[0] = cmd
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(payload)))
+	copy(b[headerSize:], payload)
+
+	s.writeMutex.Lock()
+	if s.IsClosed() {
+		e = ErrClosed
+	} else {
+		_, e = s.conn.Write(b)
+	}
+	s.writeMutex.Unlock()
+	if e != nil {
+		s.close(e)
+	}
+	return
+}
+
+// recv reads the frames until the carrier is closed. It never waits for a write,
+// so that both ends blocked on writing can not deadlock.
+func (s *Session) recv() {
+	header := make([]byte, headerSize)
+	for {
+		_, e := io.ReadFull(s.conn, header)
+		if e != nil {
+			s.close(e)
+			return
+		}
+		atomic.StoreInt64(&s.received, time.Now().UnixNano())
+		var (
+			cmd     = header[0]
+			id      = binary.BigEndian.Uint32(header[1:])
+			payload []byte
+		)
+		if n := binary.BigEndian.Uint16(header[5:]); n != 0 {
+			payload = make([]byte, n)
+			_, e = io.ReadFull(s.conn, payload)
+			if e != nil {
+				s.close(e)
+				return
+			}
+		}
+		switch cmd {
+		case cmdSYN:
+			s.opened(id)
+		case cmdPSH:
+			if stream := s.get(id); stream != nil && !stream.push(payload) {
+				// a peer ignoring the window could make the stream buffer without limit
+				s.close(errWindow)
+				return
+			}
+		case cmdFIN:
+			if stream := s.get(id); stream != nil {
+				stream.finished()
+			}
+		case cmdRST:
+			if stream := s.get(id); stream != nil {
+				s.remove(id)
+				stream.reset()
+			}
+		case cmdWND:
+			if stream := s.get(id); stream != nil && len(payload) == 4 {
+				stream.grow(binary.BigEndian.Uint32(payload))
+			}
+		case cmdPING:
+			notify(s.pongs)
+		case cmdPONG:
+		case cmdGOAWAY:
+			atomic.StoreUint32(&s.remoteGoAway, 1)
+		default:
+			s.close(errCommand)
+			return
+		}
+	}
+}
+
+// opened adds the stream opened by the peer, it is reset if the accept backlog is full
+func (s *Session) opened(id uint32) {
+	if atomic.LoadUint32(&s.goAway) != 0 {
+		s.reset(id)
+		return
+	}
+	stream := newStream(s, id)
+	s.mutex.Lock()
+	if s.streams[id] != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.streams[id] = stream
+	s.mutex.Unlock()
+	select {
+	case s.accept <- stream:
+	default:
+		s.remove(id)
+		s.reset(id)
+	}
+}
+
+// reset queues a reset of the stream opened by the peer, the session is closed if the peer opens
+// streams faster than they can be reset
+func (s *Session) reset(id uint32) {
+	select {
+	case s.resets <- id:
+	default:
+		s.close(errControl)
+	}
+}
+
+// control sends the queued control frames until the session is closed
+func (s *Session) control() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.pings:
+			s.write(cmdPING, 0, nil)
+		case <-s.pongs:
+			s.write(cmdPONG, 0, nil)
+		case id := <-s.resets:
+			s.write(cmdRST, id, nil)
+		}
+	}
+}
+func (s *Session) get(id uint32) (stream *Stream) {
+	s.mutex.Lock()
+	stream = s.streams[id]
+	s.mutex.Unlock()
+	return
+}
+func (s *Session) remove(id uint32) {
+	s.mutex.Lock()
+	delete(s.streams, id)
+	s.mutex.Unlock()
+}
+func (s *Session) ping() {
+	ticker := time.NewTicker(s.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.received))) > 3*s.keepalive {
+			s.close(errKeepalive)
+			return
+		}
+		// a carrier blocked on writing must not stop the timeout check
+		notify(s.pings)
+	}
+}
+
+// Keepalive parses the keepalive interval s, default '30s'. If it is less than 1s keepalive is disabled
+func Keepalive(log *slog.Logger, s string) (keepalive time.Duration) {
+	keepalive = 30 * time.Second
+	if s != `` {
+		var err error
+		keepalive, err = time.ParseDuration(s)
+		if err != nil {
+			keepalive = 30 * time.Second
+			log.Warn(`parse duration fail, used default mux keepalive duration.`,
+				`error`, err,
+				`keepalive`, s,
+				`default`, keepalive,
+			)
+		} else if keepalive < time.Second {
+			keepalive = 0
+		}
+	}
+	return
+}
@@ -0,0 +1,192 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Stream is a logical connection of a session, it supports half-close with CloseWrite
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mutex sync.Mutex
+	// received payloads not read yet and their size
+	buffers  [][]byte
+	buffered uint32
+	// bytes read since the last window update
+	consumed uint32
+	// bytes that can be sent before the peer updates the window
+	window uint32
+	// the peer finished writing, the peer aborted the stream, CloseWrite was called
+	fin, rst, finSent bool
+
+	readable, writable chan struct{}
+	done               chan struct{}
+	closed             uint32
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:       id,
+		session:  session,
+		window:   window,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push buffers a received payload, it returns false if the peer sent more than the window allows
+func (st *Stream) push(payload []byte) bool {
+	st.mutex.Lock()
+	// the bytes consumed are not returned to the peer yet, so they still count against the window
+	if uint64(st.buffered)+uint64(st.consumed)+uint64(len(payload)) > window {
+		st.mutex.Unlock()
+		return false
+	}
+	st.buffers = append(st.buffers, payload)
+	st.buffered += uint32(len(payload))
+	st.mutex.Unlock()
+	notify(st.readable)
+	return true
+}
+func (st *Stream) finished() {
+	st.mutex.Lock()
+	st.fin = true
+	st.mutex.Unlock()
+	notify(st.readable)
+}
+func (st *Stream) reset() {
+	st.mutex.Lock()
+	st.rst = true
+	st.mutex.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+func (st *Stream) grow(n uint32) {
+	st.mutex.Lock()
+	st.window += n
+	st.mutex.Unlock()
+	notify(st.writable)
+}
+
+// Read returns io.EOF after the peer called CloseWrite and all data was read
+func (st *Stream) Read(b []byte) (n int, e error) {
+	for {
+		st.mutex.Lock()
+		if len(st.buffers) != 0 {
+			n = copy(b, st.buffers[0])
+			if n == len(st.buffers[0]) {
+				st.buffers[0] = nil
+				st.buffers = st.buffers[1:]
+			} else {
+				st.buffers[0] = st.buffers[0][n:]
+			}
+			var increment uint32
+			st.buffered -= uint32(n)
+			st.consumed += uint32(n)
+			if st.consumed >= window/2 {
+				increment, st.consumed = st.consumed, 0
+			}
+			st.mutex.Unlock()
+			if increment != 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], increment)
+				st.session.write(cmdWND, st.id, payload[:])
+			}
+			return
+		}
+		fin, rst := st.fin, st.rst
+		st.mutex.Unlock()
+		if rst {
+			return 0, ErrReset
+		} else if fin {
+			return 0, io.EOF
+		}
+		select {
+		case <-st.readable:
+		case <-st.done:
+			return 0, io.ErrClosedPipe
+		case <-st.session.done:
+			return 0, ErrClosed
+		}
+	}
+}
+
+// Write waits for the peer to update the window if it is exhausted
+func (st *Stream) Write(b []byte) (n int, e error) {
+	for len(b) != 0 {
+		st.mutex.Lock()
+		if st.rst {
+			st.mutex.Unlock()
+			return n, ErrReset
+		} else if st.finSent {
+			st.mutex.Unlock()
+			return n, io.ErrClosedPipe
+		} else if st.window == 0 {
+			st.mutex.Unlock()
+			select {
+			case <-st.writable:
+				continue
+			case <-st.done:
+				return n, io.ErrClosedPipe
+			case <-st.session.done:
+				return n, ErrClosed
+			}
+		}
+		size := uint32(len(b))
+		if size > maxPayload {
+			size = maxPayload
+		}
+		if size > st.window {
+			size = st.window
+		}
+		st.window -= size
+		st.mutex.Unlock()
+
+		e = st.session.write(cmdPSH, st.id, b[:size])
+		if e != nil {
+			return
+		}
+		n += int(size)
+		b = b[size:]
+	}
+	return
+}
+
+// CloseWrite tells the peer that no more data will be written
+func (st *Stream) CloseWrite() error {
+	st.mutex.Lock()
+	if st.finSent || st.rst {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mutex.Unlock()
+	return st.session.write(cmdFIN, st.id, nil)
+}
+
+// Close removes the stream, the peer is reset unless both ends finished writing
+func (st *Stream) Close() error {
+	if st.closed == 0 && atomic.CompareAndSwapUint32(&st.closed, 0, 1) {
+		close(st.done)
+		st.session.remove(st.id)
+		st.mutex.Lock()
+		abort := !st.rst && !(st.fin && st.finSent)
+		st.mutex.Unlock()
+		if abort {
+			st.session.write(cmdRST, st.id, nil)
+		}
+		return nil
+	}
+	return io.ErrClosedPipe
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
+)
+
+const rejectDenied = `denied`
+
+// ACL checks client addresses against allow and deny lists
+type ACL struct {
+	allow, deny []netip.Prefix
+	denied      *metrics.Counter
+}
+
+// NewACL returns nil if conf is empty, denied connections are counted with the label tag
+func NewACL(tag string, conf *config.ACL) (acl *ACL, e error) {
+	if len(conf.Allow) == 0 && len(conf.Deny) == 0 {
+		return
+	}
+	allow, e := ParsePrefixes(conf.Allow)
+	if e != nil {
+		return
+	}
+	deny, e := ParsePrefixes(conf.Deny)
+	if e != nil {
+		return
+	}
+	acl = &ACL{
+		allow:  allow,
+		deny:   deny,
+		denied: metrics.Rejected.With(tag, rejectDenied),
+	}
+	return
+}
+
+// ParsePrefixes parses CIDRs or ips, an ip is a prefix of its full length
+func ParsePrefixes(items []string) (prefixes []netip.Prefix, e error) {
+	prefixes = make([]netip.Prefix, 0, len(items))
+	for _, item := range items {
+		var prefix netip.Prefix
+		if strings.Contains(item, `/`) {
+			prefix, e = netip.ParsePrefix(item)
+		} else {
+			var addr netip.Addr
+			addr, e = netip.ParseAddr(item)
+			if e == nil {
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if e != nil {
+			e = errors.New(`invalid CIDR or ip: ` + item)
+			return
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+// ContainsAddr reports whether addr is in one of prefixes, addr may be an ip or ip:port
+func ContainsAddr(prefixes []netip.Prefix, addr string) bool {
+	ip, e := netip.ParseAddr(clientIP(addr))
+	if e != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the client addr is allowed, the denied ones are counted.
+// If acl is nil all clients are allowed.
+func (acl *ACL) Allowed(addr string) bool {
+	if acl == nil {
+		return true
+	}
+	if ContainsAddr(acl.deny, addr) ||
+		(len(acl.allow) != 0 && !ContainsAddr(acl.allow, addr)) {
+		acl.denied.Inc()
+		return false
+	}
+	return true
+}
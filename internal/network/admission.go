@@ -0,0 +1,299 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
+	"github.com/powerpuffpenguin/streamf/internal/proxyproto"
+	"github.com/powerpuffpenguin/streamf/internal/ratelimit"
+)
+
+const (
+	rejectMax    = `max connections`
+	rejectPerIP  = `max connections per ip`
+	rejectAccept = `accept rate`
+)
+
+// Admission limits the connections admitted by a listener or router
+type Admission struct {
+	conf   config.Admission
+	accept *ratelimit.Bucket
+
+	mutex sync.Mutex
+	count int
+	ips   map[string]int
+
+	rejectedMax, rejectedPerIP, rejectedAccept *metrics.Counter
+}
+
+// NewAdmission returns nil if conf has no limit, SetTag must be called before it is used
+func NewAdmission(conf *config.Admission) *Admission {
+	if conf.MaxConnections < 1 && conf.MaxConnectionsPerIP < 1 && conf.AcceptRate < 1 {
+		return nil
+	}
+	a := &Admission{
+		conf: *conf,
+	}
+	if conf.AcceptRate > 0 {
+		a.accept = ratelimit.New(int64(conf.AcceptRate), 0)
+	}
+	if conf.MaxConnectionsPerIP > 0 {
+		a.ips = make(map[string]int)
+	}
+	return a
+}
+
+// SetTag sets the label of the rejected connections in metrics, the listener tag is not known before listening
+func (a *Admission) SetTag(tag string) {
+	if a == nil {
+		return
+	}
+	a.rejectedMax = metrics.Rejected.With(tag, rejectMax)
+	a.rejectedPerIP = metrics.Rejected.With(tag, rejectPerIP)
+	a.rejectedAccept = metrics.Rejected.With(tag, rejectAccept)
+}
+
+// Admit returns false and the reason if a connection from addr is over the limits,
+// otherwise release must be called when the connection is closed
+func (a *Admission) Admit(addr string) (release func(), reason string, ok bool) {
+	return a.admit(clientIP(addr), true, true)
+}
+
+// admit checks maxConnections and acceptRate if conn is true, maxConnectionsPerIP if perIP is true,
+// release only undoes what was checked
+func (a *Admission) admit(ip string, conn, perIP bool) (release func(), reason string, ok bool) {
+	perIP = perIP && a.ips != nil
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if conn && a.conf.MaxConnections > 0 && a.count >= a.conf.MaxConnections {
+		a.rejectedMax.Inc()
+		reason = rejectMax
+		return
+	} else if perIP && a.ips[ip] >= a.conf.MaxConnectionsPerIP {
+		a.rejectedPerIP.Inc()
+		reason = rejectPerIP
+		return
+	} else if conn && a.accept != nil && !a.accept.Allow(1) {
+		a.rejectedAccept.Inc()
+		reason = rejectAccept
+		return
+	}
+	if conn {
+		a.count++
+	}
+	if perIP {
+		a.ips[ip]++
+	}
+	var released uint32
+	release = func() {
+		if released == 0 && atomic.CompareAndSwapUint32(&released, 0, 1) {
+			a.mutex.Lock()
+			if conn {
+				a.count--
+			}
+			if perIP {
+				if a.ips[ip] > 1 {
+					a.ips[ip]--
+				} else {
+					delete(a.ips, ip)
+				}
+			}
+			a.mutex.Unlock()
+		}
+	}
+	ok = true
+	return
+}
+
+// Info returns nil if a is nil
+func (a *Admission) Info() any {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	count := a.count
+	a.mutex.Unlock()
+	return map[string]any{
+		`maxConnections`:      a.conf.MaxConnections,
+		`maxConnectionsPerIP`: a.conf.MaxConnectionsPerIP,
+		`acceptRate`:          a.conf.AcceptRate,
+		`connections`:         count,
+		`rejected`: map[string]int64{
+			rejectMax:    a.rejectedMax.Value(),
+			rejectPerIP:  a.rejectedPerIP.Value(),
+			rejectAccept: a.rejectedAccept.Value(),
+		},
+	}
+}
+
+func (a *Admission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Info())
+}
+
+// Listener closes the accepted connections that a rejects, if a is nil l is returned.
+// It should wrap the raw listener so that tls and PROXY protocol are not read before admission.
+// If proxy is true the connections start with a PROXY protocol header, maxConnectionsPerIP is
+// not checked here but by ProxyListener, so that it counts the clients and not the proxy.
+func (a *Admission) Listener(l net.Listener, proxy bool) net.Listener {
+	if a == nil {
+		return l
+	}
+	return &admissionListener{
+		Listener:  l,
+		admission: a,
+		perIP:     !proxy,
+	}
+}
+
+type admissionListener struct {
+	net.Listener
+	admission *Admission
+	perIP     bool
+}
+
+func (l *admissionListener) Accept() (c net.Conn, e error) {
+	for {
+		c, e = l.Listener.Accept()
+		if e != nil {
+			return
+		}
+		release, _, ok := l.admission.admit(clientIP(c.RemoteAddr().String()), true, l.perIP)
+		if ok {
+			c = &admittedConn{
+				Conn:    c,
+				release: release,
+			}
+			return
+		}
+		c.Close()
+	}
+}
+
+type admittedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+func (c *admittedConn) CloseWrite() error {
+	return ioutil.CloseWrite(c.Conn)
+}
+
+// ReadFrom keeps the fast path of the underlying connection
+func (c *admittedConn) ReadFrom(r io.Reader) (n int64, e error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+// ProxyListener checks maxConnectionsPerIP of the connections accepted by l, which reads the PROXY protocol header,
+// against the client address in the header. Accept does not wait for the header, a connection is checked by
+// proxyproto.Handshake or its first Read or Write and closed if it is rejected. If a is nil or has no per ip limit l is returned.
+func (a *Admission) ProxyListener(l net.Listener) net.Listener {
+	if a == nil || a.ips == nil {
+		return l
+	}
+	return &proxyListener{
+		Listener:  l,
+		admission: a,
+	}
+}
+
+type proxyListener struct {
+	net.Listener
+	admission *Admission
+}
+
+func (l *proxyListener) Accept() (c net.Conn, e error) {
+	c, e = l.Listener.Accept()
+	if e != nil {
+		return
+	}
+	c = &proxiedConn{
+		Conn:      c,
+		admission: l.admission,
+	}
+	return
+}
+
+type proxiedConn struct {
+	net.Conn
+	admission *Admission
+
+	once    sync.Once
+	release func()
+	e       error
+}
+
+// admit checks the client address once, RemoteAddr reads the PROXY protocol header
+func (c *proxiedConn) admit() error {
+	c.once.Do(func() {
+		release, reason, ok := c.admission.admit(clientIP(c.Conn.RemoteAddr().String()), false, true)
+		if ok {
+			c.release = release
+		} else {
+			c.e = errors.New(`connection rejected: ` + reason)
+			c.Conn.Close()
+		}
+	})
+	return c.e
+}
+
+// ProxyHandshake reads the PROXY protocol header and checks the client address in it
+func (c *proxiedConn) ProxyHandshake() (e error) {
+	e = proxyproto.Handshake(c.Conn)
+	if e != nil {
+		return
+	}
+	return c.admit()
+}
+func (c *proxiedConn) Read(b []byte) (n int, e error) {
+	e = c.admit()
+	if e != nil {
+		return
+	}
+	return c.Conn.Read(b)
+}
+func (c *proxiedConn) Write(b []byte) (n int, e error) {
+	e = c.admit()
+	if e != nil {
+		return
+	}
+	return c.Conn.Write(b)
+}
+func (c *proxiedConn) Close() error {
+	// a connection closed before it was checked is never counted
+	c.once.Do(func() {
+		c.e = net.ErrClosed
+	})
+	if c.release != nil {
+		c.release()
+	}
+	return c.Conn.Close()
+}
+func (c *proxiedConn) CloseWrite() error {
+	return ioutil.CloseWrite(c.Conn)
+}
+
+// ReadFrom keeps the fast path of the underlying connection
+func (c *proxiedConn) ReadFrom(r io.Reader) (n int64, e error) {
+	e = c.admit()
+	if e != nil {
+		return
+	}
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
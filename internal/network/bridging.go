@@ -5,6 +5,7 @@ import (
 	"io"
 	"time"
 
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
 	"github.com/powerpuffpenguin/streamf/pool"
 	"github.com/powerpuffpenguin/streamf/third-party/websocket"
 )
@@ -15,73 +16,115 @@ type websocketConn interface {
 
 func Copy(dst io.Writer, src io.Reader, pool *pool.Pool) {
 	var b = pool.Get()
-	copyBuffer(dst, src, b)
+	copyBuffer(dst, src, b, nil)
 	pool.Put(b)
 }
-func Bridging(c0, c1 io.ReadWriteCloser, pool *pool.Pool, duration time.Duration) {
+
+// Counter receives the number of bytes forwarded in one direction as they are written
+type Counter func(n int64)
+
+// spliceChunk is how many bytes ReadFrom forwards at most before they are counted
+const spliceChunk = 64 * 1024
+
+// Bridging forwards data between c0 and c1, the bytes written to c1 are counted by in and the bytes written to c0 by out.
+// When one side finishes sending, the other side is half-closed and the opposite direction keeps forwarding until it
+// finishes too, duration is the upper bound of that wait. If duration <= time.Millisecond both sides are closed at once.
+// If exact is false plain streams are forwarded with ReadFrom or WriteTo, so the kernel can splice them, and ReadFrom
+// is counted every spliceChunk bytes, set it if the counters must see every write as it happens.
+// client is true if reading from c0 finished before reading from c1.
+func Bridging(c0, c1 io.ReadWriteCloser, pool *pool.Pool, duration time.Duration, exact bool, in, out Counter) (client bool) {
 	defer c0.Close()
 	defer c1.Close()
 	w0, ok0 := c0.(websocketConn)
 	w1, ok1 := c1.(websocketConn)
-	done := make(chan bool, 1)
+	// receives true when reading from c0 finished and false when reading from c1 finished
+	done := make(chan bool, 2)
+	// fromClient runs f which reads from c0, fromRemote runs f which reads from c1
+	fromClient := func(f func()) {
+		f()
+		done <- true
+	}
+	fromRemote := func(f func()) {
+		f()
+		done <- false
+	}
 	if ok0 {
+		ws0 := w0.Websocket()
+		// the close frame is forwarded as a half-close, don't echo it before the other direction finishes
+		ws0.SetCloseHandler(ignoreClose)
 		if ok1 {
-			ws0 := w0.Websocket()
 			ws1 := w1.Websocket()
-			go forwardingWebsocket(ws0, ws1, done)
-			go forwardingWebsocket(ws1, ws0, done)
+			ws1.SetCloseHandler(ignoreClose)
+			go fromRemote(func() { forwardingWebsocket(ws0, ws1, out) })
+			go fromClient(func() { forwardingWebsocket(ws1, ws0, in) })
 		} else {
-			go readWebsocket(c1, w0.Websocket(), done, pool)
-			go writeWebsocket(w0.Websocket(), c1, done, pool)
+			go fromClient(func() { readWebsocket(c1, ws0, pool, in) })
+			go fromRemote(func() { writeWebsocket(ws0, c1, pool, out) })
 		}
 	} else if ok1 {
-		go readWebsocket(c0, w1.Websocket(), done, pool)
-		go writeWebsocket(w1.Websocket(), c0, done, pool)
+		ws1 := w1.Websocket()
+		ws1.SetCloseHandler(ignoreClose)
+		go fromRemote(func() { readWebsocket(c0, ws1, pool, out) })
+		go fromClient(func() { writeWebsocket(ws1, c0, pool, in) })
 	} else {
-		go forwarding(c0, c1, done, pool)
-		go forwarding(c1, c0, done, pool)
+		go fromRemote(func() { forwarding(c0, c1, pool, exact, out) })
+		go fromClient(func() { forwarding(c1, c0, pool, exact, in) })
 	}
-	<-done
+	client = <-done
+	// the other direction gets up to duration to finish, also when the end could not be propagated
+	// because the other side can not be half-closed, such as the body of a http2 request
 	if duration <= time.Millisecond {
 		return
 	}
-	select {
-	case <-done:
-		return
-	default:
-	}
-
-	if duration < time.Second*10 {
-		time.Sleep(duration)
-		return
-	}
 	timer := time.NewTimer(duration)
 	select {
 	case <-timer.C:
 	case <-done:
-		if !timer.Stop() {
-			<-timer.C
-		}
+		timer.Stop()
 	}
+	return
+}
+func ignoreClose(code int, text string) error {
+	return nil
+}
+
+// closeWebsocket sends a normal close frame, the peer sees it as the end of the stream
+func closeWebsocket(w *websocket.Conn) {
+	w.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ``),
+		time.Now().Add(time.Second),
+	)
 }
-func forwardingWebsocket(w, r *websocket.Conn, done chan<- bool) {
-	defer forwardingDone(done)
+
+// isClose reports whether e is a close frame received from the peer
+func isClose(e error) bool {
+	var ce *websocket.CloseError
+	return errors.As(e, &ce)
+}
+
+// forwardingWebsocket forwards the messages of r to w, a close frame from r is forwarded to w
+func forwardingWebsocket(w, r *websocket.Conn, count Counter) {
 	var (
 		e   error
 		t   int
+		n   int64
 		src io.Reader
 		dst io.WriteCloser
 	)
 	for {
 		t, src, e = r.NextReader()
 		if e != nil {
+			if isClose(e) {
+				closeWebsocket(w)
+			}
 			break
 		}
 		dst, e = w.NextWriter(t)
 		if e != nil {
 			break
 		}
-		_, e = io.Copy(dst, src)
+		n, e = io.Copy(dst, src)
+		count(n)
 		if e != nil {
 			dst.Close()
 			break
@@ -91,13 +134,15 @@ func forwardingWebsocket(w, r *websocket.Conn, done chan<- bool) {
 			break
 		}
 	}
+	return
 }
 
-func readWebsocket(w io.WriteCloser, r *websocket.Conn, done chan<- bool, pool *pool.Pool) {
-	defer forwardingDone(done)
+// readWebsocket forwards the messages of r to w, w is half-closed when r sends a close frame
+func readWebsocket(w io.WriteCloser, r *websocket.Conn, pool *pool.Pool, count Counter) {
 	var (
 		e   error
 		src io.Reader
+		n   int64
 	)
 	if rt, ok := w.(io.ReaderFrom); ok {
 		for {
@@ -105,7 +150,8 @@ func readWebsocket(w io.WriteCloser, r *websocket.Conn, done chan<- bool, pool *
 			if e != nil {
 				break
 			}
-			_, e = rt.ReadFrom(src)
+			n, e = rt.ReadFrom(src)
+			count(n)
 			if e != nil {
 				break
 			}
@@ -117,16 +163,20 @@ func readWebsocket(w io.WriteCloser, r *websocket.Conn, done chan<- bool, pool *
 			if e != nil {
 				break
 			}
-			_, e = copyBuffer(w, src, buf)
+			_, e = copyBuffer(w, src, buf, count)
 			if e != nil {
 				break
 			}
 		}
 		pool.Put(buf)
 	}
+	if isClose(e) {
+		ioutil.CloseWrite(w)
+	}
 }
-func writeWebsocket(w *websocket.Conn, r io.ReadCloser, done chan<- bool, pool *pool.Pool) {
-	defer forwardingDone(done)
+
+// writeWebsocket forwards r to w as binary messages, a close frame is sent to w when r reaches EOF
+func writeWebsocket(w *websocket.Conn, r io.ReadCloser, pool *pool.Pool, count Counter) {
 	var (
 		b      = pool.Get()
 		n      int
@@ -136,28 +186,68 @@ func writeWebsocket(w *websocket.Conn, r io.ReadCloser, done chan<- bool, pool *
 		n, er = r.Read(b)
 		if n > 0 {
 			ew = w.WriteMessage(websocket.BinaryMessage, b[:n])
+			if ew == nil {
+				count(int64(n))
+			}
 		}
 	}
 	pool.Put(b)
+	if er == io.EOF && ew == nil {
+		closeWebsocket(w)
+	}
 }
-func forwardingDone(done chan<- bool) {
-	done <- true
-}
-func forwarding(w io.WriteCloser, r io.ReadCloser, done chan<- bool, pool *pool.Pool) {
-	defer forwardingDone(done)
-	// var b = pool.Get()
-	// copyBuffer(w, r, b)
-	// pool.Put(b)
-	if rt, ok := w.(io.ReaderFrom); ok {
-		rt.ReadFrom(r)
-	} else if wt, ok := r.(io.WriterTo); ok {
-		wt.WriteTo(w)
+
+// forwarding forwards r to w, w is half-closed when r reaches EOF.
+// Unless exact is set it keeps the ReadFrom/WriteTo fast path of w or r, otherwise it copies with a buffer
+// so that the bytes are counted as they are written.
+func forwarding(w io.WriteCloser, r io.ReadCloser, pool *pool.Pool, exact bool, count Counter) {
+	var e error
+	if rt, ok := w.(io.ReaderFrom); ok && !exact {
+		e = readFrom(rt, r, count)
+	} else if wt, ok := r.(io.WriterTo); ok && !exact {
+		_, e = wt.WriteTo(&countWriter{w: w, count: count})
 	} else {
-		var b = pool.Get()
-		copyBuffer(w, r, b)
+		b := pool.Get()
+		_, e = copyBuffer(w, r, b, count)
 		pool.Put(b)
 	}
+	if e == nil {
+		ioutil.CloseWrite(w)
+	}
+}
 
+// readFrom copies r to w with ReadFrom until EOF, counting every spliceChunk bytes.
+// splice and sendfile accept an io.LimitedReader of the connection or file, so limiting r keeps them.
+func readFrom(w io.ReaderFrom, r io.Reader, count Counter) (e error) {
+	var (
+		src = &io.LimitedReader{R: r}
+		n   int64
+	)
+	for {
+		src.N = spliceChunk
+		n, e = w.ReadFrom(src)
+		if n > 0 {
+			count(n)
+		}
+		if e != nil || src.N > 0 {
+			// ReadFrom returns before the limit only at EOF or on errors
+			return
+		}
+	}
+}
+
+// countWriter counts the bytes written to w
+type countWriter struct {
+	w     io.Writer
+	count Counter
+}
+
+func (c *countWriter) Write(b []byte) (n int, e error) {
+	n, e = c.w.Write(b)
+	if n > 0 {
+		c.count(int64(n))
+	}
+	return
 }
 
 // errInvalidWrite means that a write returned an impossible count.
@@ -165,16 +255,8 @@ var errInvalidWrite = errors.New("invalid write result")
 
 // copyBuffer is the actual implementation of Copy and CopyBuffer.
 // if buf is nil, one is allocated.
-func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
-	// // If the reader has a WriteTo method, use it to do the copy.
-	// // Avoids an allocation and a copy.
-	// if wt, ok := src.(WriterTo); ok {
-	// 	return wt.WriteTo(dst)
-	// }
-	// // Similarly, if the writer has a ReadFrom method, use it to do the copy.
-	// if rt, ok := dst.(ReaderFrom); ok {
-	// 	return rt.ReadFrom(src)
-	// }
+// if count is not nil it is called after every write.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte, count Counter) (written int64, err error) {
 	for {
 		nr, er := src.Read(buf)
 		if nr > 0 {
@@ -186,6 +268,9 @@ func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (written int64, err er
 				}
 			}
 			written += int64(nw)
+			if count != nil && nw > 0 {
+				count(int64(nw))
+			}
 			if ew != nil {
 				err = ew
 				break
@@ -3,10 +3,12 @@ package network
 import (
 	"context"
 	"crypto/tls"
+	"io"
 	"net"
+	"sync"
+	"time"
 
-	"github.com/powerpuffpenguin/vnet"
-	"github.com/powerpuffpenguin/vnet/reverse"
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
 )
 
 type Dialer interface {
@@ -41,21 +43,18 @@ func (d *rawDialer) Close() error {
 }
 
 type pipeDialer struct {
+	n    *Network
 	addr string
 	cfg  *tls.Config
-	pipe *vnet.PipeListener
-	done chan struct{}
 }
 
 func (d *pipeDialer) DialContext(ctx context.Context) (conn net.Conn, e error) {
-	select {
-	case <-d.done:
-	case <-ctx.Done():
-		e = ctx.Err()
+	pipe, e := d.n.getPipe(ctx, d.addr)
+	if e != nil {
 		return
 	}
 
-	conn, e = d.pipe.DialContext(ctx, `pipe`, d.addr)
+	conn, e = pipe.DialContext(ctx, `pipe`, d.addr)
 	if d.cfg == nil || e != nil {
 		return
 	}
@@ -75,20 +74,17 @@ func (d *pipeDialer) Close() error {
 }
 
 type portalDialer struct {
-	addr   string
-	cfg    *tls.Config
-	portal *reverse.Dialer
-	done   chan struct{}
+	n    *Network
+	addr string
+	cfg  *tls.Config
 }
 
 func (d *portalDialer) DialContext(ctx context.Context) (conn net.Conn, e error) {
-	select {
-	case <-d.done:
-	case <-ctx.Done():
-		e = ctx.Err()
+	portal, e := d.n.getPortal(ctx, d.addr)
+	if e != nil {
 		return
 	}
-	conn, e = d.portal.DialContext(ctx, `portal`, d.addr)
+	conn, e = portal.DialContext(ctx, `portal`, d.addr)
 	if d.cfg == nil || e != nil {
 		return
 	}
@@ -106,3 +102,97 @@ func (d *portalDialer) DialContext(ctx context.Context) (conn net.Conn, e error)
 func (d *portalDialer) Close() error {
 	return nil
 }
+
+type viaDialer struct {
+	dial func(ctx context.Context) (io.ReadWriteCloser, error)
+	cfg  *tls.Config
+}
+
+func (d *viaDialer) DialContext(ctx context.Context) (conn net.Conn, e error) {
+	rw, e := d.dial(ctx)
+	if e != nil {
+		return
+	}
+	if c, ok := rw.(net.Conn); ok {
+		conn = c
+	} else {
+		conn = &viaConn{ReadWriteCloser: rw}
+	}
+	if d.cfg == nil {
+		return
+	}
+
+	tlsConn := tls.Client(conn, d.cfg.Clone())
+	e = tlsConn.HandshakeContext(ctx)
+	if e == nil {
+		conn = tlsConn
+	} else {
+		conn.Close()
+		conn = nil
+	}
+	return
+}
+func (d *viaDialer) Close() error {
+	return nil
+}
+
+// viaConn lets a stream that is not a net.Conn be used as the transport of another dialer.
+// The deadlines are forwarded to the stream if it supports them, otherwise a deadline that passes closes the stream,
+// so handshakes waiting on a stalled stream still time out.
+type viaConn struct {
+	io.ReadWriteCloser
+
+	mutex       sync.Mutex
+	read, write *time.Timer
+}
+
+func (c *viaConn) CloseWrite() error {
+	return ioutil.CloseWrite(c.ReadWriteCloser)
+}
+func (c *viaConn) LocalAddr() net.Addr {
+	return NewAddr(`via`, `via`)
+}
+func (c *viaConn) RemoteAddr() net.Addr {
+	return NewAddr(`via`, `via`)
+}
+func (c *viaConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	c.mutex.Lock()
+	c.read = c.deadline(c.read, t)
+	c.write = c.deadline(c.write, t)
+	c.mutex.Unlock()
+	return nil
+}
+func (c *viaConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	c.mutex.Lock()
+	c.read = c.deadline(c.read, t)
+	c.mutex.Unlock()
+	return nil
+}
+func (c *viaConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	c.mutex.Lock()
+	c.write = c.deadline(c.write, t)
+	c.mutex.Unlock()
+	return nil
+}
+
+// deadline stops timer and returns a timer that closes the stream at t, or nil if t is zero. c.mutex must be locked
+func (c *viaConn) deadline(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.ReadWriteCloser.Close()
+	})
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+)
+
+// Limits closes bridged connections that are idle or live too long and shapes their bandwidth
+type Limits struct {
+	// Close both ends if no data is forwarded in either direction for this long, 0 disables
+	Idle time.Duration
+	// Close both ends when the connection has been bridged for this long, 0 disables
+	Lifetime time.Duration
+	// Shapers of the router entry and the listener, nil if not limited
+	Route, Listener *Shaper
+	// Shapers of each client ip, nil if not limited
+	Clients *Clients
+	// Receives a copy of the data sent by clients, nil if not mirrored
+	Mirror *Mirror
+}
+
+// NewLimits parses idleTimeout, maxLifetime and rate of conf, invalid durations are disabled with a warning
+func NewLimits(log *slog.Logger, conf *config.ConnectDialer) (limits Limits) {
+	limits.Route = NewShaper(`route`, &conf.Rate)
+	if conf.IdleTimeout != `` {
+		var err error
+		limits.Idle, err = time.ParseDuration(conf.IdleTimeout)
+		if err != nil {
+			limits.Idle = 0
+			log.Warn(`parse duration fail, idle timeout disabled.`,
+				`error`, err,
+				`idleTimeout`, conf.IdleTimeout,
+			)
+		}
+	}
+	if conf.MaxLifetime != `` {
+		var err error
+		limits.Lifetime, err = time.ParseDuration(conf.MaxLifetime)
+		if err != nil {
+			limits.Lifetime = 0
+			log.Warn(`parse duration fail, max lifetime disabled.`,
+				`error`, err,
+				`maxLifetime`, conf.MaxLifetime,
+			)
+		}
+	}
+	return
+}
+
+// watch starts the timers of limits for key, the returned function stops them and must be called after remove
+func (n *Network) watch(key *session, limits Limits) (stop func()) {
+	var (
+		s              = &n.sessions
+		idle, lifetime *time.Timer
+	)
+	if limits.Idle > 0 {
+		s.Lock()
+		idle = time.AfterFunc(limits.Idle, func() {
+			s.Lock()
+			defer s.Unlock()
+			if s.keys[key.id] != key {
+				return
+			}
+			// key.active is the offset from key.at of the last forwarded data
+			wait := limits.Idle - (time.Since(key.at) - time.Duration(atomic.LoadInt64(&key.active)))
+			if wait > 0 {
+				idle.Reset(wait)
+			} else {
+				n.expire(key, `idle timeout`)
+			}
+		})
+		s.Unlock()
+	}
+	if limits.Lifetime > 0 {
+		lifetime = time.AfterFunc(limits.Lifetime, func() {
+			s.Lock()
+			if s.keys[key.id] == key {
+				n.expire(key, `max lifetime`)
+			}
+			s.Unlock()
+		})
+	}
+	return func() {
+		if idle != nil {
+			idle.Stop()
+		}
+		if lifetime != nil {
+			lifetime.Stop()
+		}
+	}
+}
+
+// expire closes key because it exceeded the limits, n.sessions must be locked
+func (n *Network) expire(key *session, reason string) {
+	n.sessions.close(key, reason)
+	if n.log != nil {
+		n.log.Info(`close bridged connection`,
+			`id`, key.id,
+			`listener`, key.md.Listener,
+			`client`, key.md.Client,
+			`dialer`, key.md.Dialer,
+			`reason`, reason,
+		)
+	}
+}
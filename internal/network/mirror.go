@@ -0,0 +1,243 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+)
+
+// DefaultMirrorBuffer is how many bytes are queued for a mirror connection by default
+const DefaultMirrorBuffer = 1024 * 1024
+
+// Mirror copies the data sent by clients to connections of another dialer, the responses of which are discarded.
+// It is best-effort, a mirror connection that fails or can not keep up is closed without affecting the client.
+type Mirror struct {
+	log     *slog.Logger
+	tag     string
+	connect func(ctx context.Context) (io.ReadWriteCloser, error)
+	buffer  int
+
+	// mirror connections connected, failed to connect, closed because the buffer was full
+	connected, failed, overflowed int64
+	// bytes written to the mirror connections
+	written int64
+}
+
+// NewMirror returns a mirror that connects with connect, at most buffer bytes are queued for each connection
+func NewMirror(log *slog.Logger, tag string, buffer int, connect func(ctx context.Context) (io.ReadWriteCloser, error)) *Mirror {
+	if buffer < 1 {
+		buffer = DefaultMirrorBuffer
+	}
+	return &Mirror{
+		log:     log.With(`mirror`, tag),
+		tag:     tag,
+		connect: connect,
+		buffer:  buffer,
+	}
+}
+func (m *Mirror) Info() any {
+	if m == nil {
+		return nil
+	}
+	return map[string]any{
+		`tag`:        m.tag,
+		`buffer`:     m.buffer,
+		`connected`:  atomic.LoadInt64(&m.connected),
+		`failed`:     atomic.LoadInt64(&m.failed),
+		`overflowed`: atomic.LoadInt64(&m.overflowed),
+		`written`:    atomic.LoadInt64(&m.written),
+	}
+}
+func (m *Mirror) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Info())
+}
+
+// tee returns c0 and c1 of Bridging with the data read from c0 also queued for a new mirror connection.
+// The returned function tells the mirror connection that the client finished, the queued data and the
+// responses get at most linger, but no less than a second, before it is closed. If m is nil c0 and c1 are returned.
+func (m *Mirror) tee(c0, c1 io.ReadWriteCloser, linger time.Duration) (io.ReadWriteCloser, io.ReadWriteCloser, func()) {
+	if m == nil {
+		return c0, c1, func() {}
+	}
+	mc := &mirrorConn{
+		mirror: m,
+		linger: max(linger, time.Second),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go mc.serve()
+	if _, ok := c0.(websocketConn); ok {
+		// the bytes from a websocket are written to c1, Bridging must not use the websocket of c1 directly
+		c1 = &teeWriter{ReadWriteCloser: c1, mirror: mc}
+	} else {
+		c0 = &teeReader{ReadWriteCloser: c0, mirror: mc}
+	}
+	return c0, c1, mc.finish
+}
+
+type mirrorConn struct {
+	mirror *Mirror
+	linger time.Duration
+	signal chan struct{}
+	// closed by finish
+	done chan struct{}
+	once sync.Once
+
+	mutex  sync.Mutex
+	conn   io.ReadWriteCloser
+	queue  [][]byte
+	size   int
+	closed bool
+}
+
+// write queues a copy of b, if the buffer is full the mirror connection is abandoned
+func (c *mirrorConn) write(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	} else if c.size+len(b) > c.mirror.buffer {
+		c.mutex.Unlock()
+		c.abandon()
+		atomic.AddInt64(&c.mirror.overflowed, 1)
+		c.mirror.log.Debug(`mirror buffer full`)
+		c.notify()
+		return
+	}
+	c.queue = append(c.queue, append([]byte(nil), b...))
+	c.size += len(b)
+	c.mutex.Unlock()
+	c.notify()
+}
+func (c *mirrorConn) notify() {
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// finish tells serve that the client finished, it never blocks
+func (c *mirrorConn) finish() {
+	c.once.Do(func() {
+		close(c.done)
+		// a mirror that does not read must not keep serve writing forever
+		time.AfterFunc(c.linger, c.abandon)
+	})
+}
+
+// abandon drops the queued data and closes the mirror connection, the data written later is discarded
+func (c *mirrorConn) abandon() {
+	c.mutex.Lock()
+	conn := c.conn
+	c.closed = true
+	c.conn, c.queue, c.size = nil, nil, 0
+	c.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+func (c *mirrorConn) serve() {
+	m := c.mirror
+	// the connect timeout of the mirror dialer applies
+	conn, e := m.connect(context.Background())
+	if e != nil {
+		c.abandon()
+		atomic.AddInt64(&m.failed, 1)
+		m.log.Debug(`connect mirror fail`, `error`, e)
+		return
+	}
+	atomic.AddInt64(&m.connected, 1)
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	c.conn = conn
+	c.mutex.Unlock()
+	defer c.abandon()
+	// the responses are discarded
+	discarded := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(discarded)
+	}()
+	for {
+		c.mutex.Lock()
+		queue, closed := c.queue, c.closed
+		c.queue, c.size = nil, 0
+		c.mutex.Unlock()
+		if closed {
+			return
+		}
+		for _, b := range queue {
+			n, e := conn.Write(b)
+			atomic.AddInt64(&m.written, int64(n))
+			if e != nil {
+				m.log.Debug(`write mirror fail`, `error`, e)
+				return
+			}
+		}
+		if len(queue) != 0 {
+			continue
+		}
+		select {
+		case <-c.signal:
+		case <-discarded:
+			// the mirror closed the connection
+			return
+		case <-c.done:
+			// the signal of the last write may not have been received yet
+			c.mutex.Lock()
+			queue = c.queue
+			c.mutex.Unlock()
+			if len(queue) != 0 {
+				continue
+			}
+			if ioutil.CloseWrite(conn) == nil {
+				// wait for the mirror to finish its responses, finish closes conn after linger
+				<-discarded
+			}
+			return
+		}
+	}
+}
+
+// teeReader queues the data read from the client for the mirror
+type teeReader struct {
+	io.ReadWriteCloser
+	mirror *mirrorConn
+}
+
+func (t *teeReader) Read(b []byte) (n int, e error) {
+	n, e = t.ReadWriteCloser.Read(b)
+	t.mirror.write(b[:n])
+	return
+}
+func (t *teeReader) CloseWrite() error {
+	return ioutil.CloseWrite(t.ReadWriteCloser)
+}
+
+// teeWriter queues the data written to the remote for the mirror
+type teeWriter struct {
+	io.ReadWriteCloser
+	mirror *mirrorConn
+}
+
+func (t *teeWriter) Write(b []byte) (n int, e error) {
+	n, e = t.ReadWriteCloser.Write(b)
+	t.mirror.write(b[:n])
+	return
+}
+func (t *teeWriter) CloseWrite() error {
+	return ioutil.CloseWrite(t.ReadWriteCloser)
+}
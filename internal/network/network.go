@@ -1,73 +1,128 @@
 package network
 
 import (
-	"container/list"
+	"context"
 	"crypto/tls"
 	"errors"
+	"io"
 	"log/slog"
 	"net"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/pool"
 	"github.com/powerpuffpenguin/vnet"
 	"github.com/powerpuffpenguin/vnet/reverse"
 )
 
 type Network struct {
-	pipe     map[string]*vnet.PipeListener
-	pipeList *list.List
+	mutex  sync.Mutex
+	pipe   map[string]*vnet.PipeListener
+	portal map[string]*Portal
+	// shapers of the dialers by tag
+	shapers map[string]*Shaper
+	// closed and replaced whenever a pipe or portal is added, to wake up the dialers waiting for it
+	ready chan struct{}
 
-	portal     map[string]*reverse.Dialer
-	portalList *list.List
+	sessions sessions
+	log      *slog.Logger
+	// if not nil, records every finished bridged connection
+	access *slog.Logger
 }
 
-func New() *Network {
+// New creates a network, access may be nil to disable the access log
+func New(log, access *slog.Logger) *Network {
 	return &Network{
-		pipe:       make(map[string]*vnet.PipeListener),
-		pipeList:   list.New(),
-		portal:     make(map[string]*reverse.Dialer),
-		portalList: list.New(),
+		pipe:   make(map[string]*vnet.PipeListener),
+		portal: make(map[string]*Portal),
+		ready:  make(chan struct{}),
+		log:    log,
+		access: access,
 	}
 }
 func (n *Network) listenPipe(address string) (l net.Listener, e error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	if _, ok := n.pipe[address]; ok {
 		e = errors.New(`listen pipe ` + address + `: bind: address already in use`)
 		return
 	}
-	var (
-		pipe = vnet.ListenPipe()
-		ele  = n.pipeList.Front()
-		next *list.Element
-	)
-	for ele != nil {
-		next = ele.Next()
-		d := ele.Value.(*pipeDialer)
-		if d.addr == address {
-			d.pipe = pipe
-			close(d.done)
-			n.pipeList.Remove(ele)
-		}
-		ele = next
-	}
-
+	pipe := vnet.ListenPipe()
 	l = &addrListener{
 		Listener: pipe,
 		addr:     NewAddr(`pipe`, address),
+		close: func() {
+			n.mutex.Lock()
+			if n.pipe[address] == pipe {
+				delete(n.pipe, address)
+			}
+			n.mutex.Unlock()
+		},
 	}
 	n.pipe[address] = pipe
+	close(n.ready)
+	n.ready = make(chan struct{})
 	return
 }
 
+// getPipe returns the pipe listening on address, waiting for it to be created
+func (n *Network) getPipe(ctx context.Context, address string) (pipe *vnet.PipeListener, e error) {
+	for {
+		n.mutex.Lock()
+		pipe = n.pipe[address]
+		ready := n.ready
+		n.mutex.Unlock()
+		if pipe != nil {
+			return
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			e = ctx.Err()
+			return
+		}
+	}
+}
+
+// getPortal returns the portal with tag, waiting for it to be created
+func (n *Network) getPortal(ctx context.Context, tag string) (portal *Portal, e error) {
+	for {
+		n.mutex.Lock()
+		portal = n.portal[tag]
+		ready := n.ready
+		n.mutex.Unlock()
+		if portal != nil {
+			return
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			e = ctx.Err()
+			return
+		}
+	}
+}
+
 type addrListener struct {
 	net.Listener
-	addr net.Addr
+	addr  net.Addr
+	close func()
 }
 
 func (a *addrListener) Addr() net.Addr {
 	return a.addr
 }
+func (a *addrListener) Close() (e error) {
+	e = a.Listener.Close()
+	if a.close != nil {
+		a.close()
+	}
+	return
+}
 func (n *Network) ListenUdp(network, address string, opts *config.UDP, pool *pool.Pool) (l net.Listener, e error) {
 	return newUdpListener(network, address, opts, pool)
 }
@@ -111,19 +166,17 @@ func (n *Network) Dialer(network string, addr string, cfg *tls.Config) (dialer D
 	switch network {
 	case `portal`:
 		dialer = &portalDialer{
+			n:    n,
 			cfg:  cfg,
 			addr: addr,
-			done: make(chan struct{}),
 		}
-		n.portalList.PushBack(dialer)
 		return
 	case `pipe`:
 		dialer = &pipeDialer{
+			n:    n,
 			cfg:  cfg,
 			addr: addr,
-			done: make(chan struct{}),
 		}
-		n.pipeList.PushBack(dialer)
 		return
 	case `tcp`:
 	case `tcp4`:
@@ -146,8 +199,48 @@ func (n *Network) Dialer(network string, addr string, cfg *tls.Config) (dialer D
 	}
 	return
 }
-func (n *Network) NewPortal(log *slog.Logger, l net.Listener, portal *config.Portal) (dialer *reverse.Dialer, e error) {
+
+// ViaDialer returns a dialer whose connections are produced by dial, such as the Connect of another dialer.
+// If cfg is not nil a tls handshake is done over the connection.
+func (n *Network) ViaDialer(dial func(ctx context.Context) (io.ReadWriteCloser, error), cfg *tls.Config) Dialer {
+	return &viaDialer{
+		dial: dial,
+		cfg:  cfg,
+	}
+}
+
+// Portal is a reverse dialer registered by tag, Close unregisters it
+type Portal struct {
+	*reverse.Dialer
+	n   *Network
+	tag string
+}
+
+func (p *Portal) Close() error {
+	p.n.mutex.Lock()
+	if p.n.portal[p.tag] == p {
+		delete(p.n.portal, p.tag)
+	}
+	p.n.mutex.Unlock()
+	metrics.PortalIdle.Delete(p.tag)
+	return p.Dialer.Close()
+}
+
+// DialContext takes an idle connection opened by a bridge
+func (p *Portal) DialContext(ctx context.Context, network, addr string) (c net.Conn, e error) {
+	c, e = p.Dialer.DialContext(ctx, network, addr)
+	if e == nil {
+		if ic, ok := c.(*idleConn); ok {
+			ic.use()
+			c = ic.Conn
+		}
+	}
+	return
+}
+func (n *Network) NewPortal(log *slog.Logger, l net.Listener, portal *config.Portal) (dialer *Portal, e error) {
 	tag := portal.Tag
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	if _, ok := n.portal[tag]; ok {
 		e = errors.New(`portal already exists: ` + tag)
 		return
@@ -197,31 +290,60 @@ func (n *Network) NewPortal(log *slog.Logger, l net.Listener, portal *config.Por
 			)
 		}
 	}
-	dialer = reverse.NewDialer(l,
+	rd := reverse.NewDialer(&idleListener{
+		Listener: l,
+		idle:     metrics.PortalIdle.With(tag),
+	},
 		reverse.WithDialerSynAck(true),
 		reverse.WithDialerTimeout(timeout),
 		reverse.WithDialerHeart(heart),
 	)
+	dialer = &Portal{
+		Dialer: rd,
+		n:      n,
+		tag:    tag,
+	}
 	n.portal[tag] = dialer
+	close(n.ready)
+	n.ready = make(chan struct{})
 	log.Info(`new portal`,
 		`timeout`, timeout,
 		`heart`, heart,
 		`heartTimeout`, heartTimeout,
 	)
+	return
+}
 
-	var (
-		ele  = n.portalList.Front()
-		next *list.Element
-	)
-	for ele != nil {
-		next = ele.Next()
-		d := ele.Value.(*portalDialer)
-		if d.addr == tag {
-			d.portal = dialer
-			close(d.done)
-			n.portalList.Remove(ele)
+// idleListener counts the connections accepted by a portal until they are used or closed
+type idleListener struct {
+	net.Listener
+	idle *metrics.Gauge
+}
+
+func (l *idleListener) Accept() (c net.Conn, e error) {
+	c, e = l.Listener.Accept()
+	if e == nil {
+		l.idle.Inc()
+		c = &idleConn{
+			Conn: c,
+			idle: l.idle,
 		}
-		ele = next
 	}
 	return
 }
+
+type idleConn struct {
+	net.Conn
+	idle *metrics.Gauge
+	used uint32
+}
+
+func (c *idleConn) use() {
+	if c.used == 0 && atomic.CompareAndSwapUint32(&c.used, 0, 1) {
+		c.idle.Dec()
+	}
+}
+func (c *idleConn) Close() error {
+	c.use()
+	return c.Conn.Close()
+}
@@ -0,0 +1,260 @@
+package network
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
+	"github.com/powerpuffpenguin/streamf/internal/ratelimit"
+	"github.com/powerpuffpenguin/streamf/pool"
+)
+
+// Metadata describes a bridged connection
+type Metadata struct {
+	// Tag of the listener, sniproxy or bridge that accepted c0
+	Listener string
+	// Address of the client
+	Client string
+	// Tag of the dialer that connected c1
+	Dialer string
+	// Address the dialer connected to
+	Remote string
+	// Server name sniffed by sniproxy
+	SNI string
+	// Router or sni matcher that selected the dialer
+	Route string
+}
+
+type session struct {
+	id     uint64
+	md     Metadata
+	at     time.Time
+	c0, c1 io.ReadWriteCloser
+	// bytes written to c1 and c0
+	in, out int64
+	// offset from at of the last forwarded data
+	active int64
+	// throughput of c1 and c0
+	inRate, outRate ratelimit.Meter
+	shapers         []*Shaper
+	// closed when the connection is closed, it wakes up the shapers
+	done chan struct{}
+	// why the connection was closed by streamf, guarded by sessions
+	reason string
+}
+
+func (s *session) Info() any {
+	return map[string]any{
+		`id`:       s.id,
+		`listener`: s.md.Listener,
+		`client`:   s.md.Client,
+		`dialer`:   s.md.Dialer,
+		`remote`:   s.md.Remote,
+		`sni`:      s.md.SNI,
+		`route`:    s.md.Route,
+		`start`:    s.at.Format(time.RFC3339),
+		`duration`: time.Since(s.at).Round(time.Second).String(),
+		`in`:       atomic.LoadInt64(&s.in),
+		`out`:      atomic.LoadInt64(&s.out),
+		`inRate`:   s.inRate.Rate(),
+		`outRate`:  s.outRate.Rate(),
+	}
+}
+
+// sessions tracks the bridged connections so that they can be drained on shutdown
+type sessions struct {
+	sync.Mutex
+	wait     sync.WaitGroup
+	keys     map[uint64]*session
+	id       uint64
+	draining bool
+}
+
+func (s *sessions) add(md Metadata, c0, c1 io.ReadWriteCloser, shapers []*Shaper) (key *session, ok bool) {
+	s.Lock()
+	if !s.draining {
+		if s.keys == nil {
+			s.keys = make(map[uint64]*session)
+		}
+		s.id++
+		key = &session{
+			id:      s.id,
+			md:      md,
+			at:      time.Now(),
+			c0:      c0,
+			c1:      c1,
+			shapers: shapers,
+			done:    make(chan struct{}),
+		}
+		s.keys[key.id] = key
+		s.wait.Add(1)
+		ok = true
+	}
+	s.Unlock()
+	return
+}
+
+// remove returns the reason set by close
+func (s *sessions) remove(key *session) (reason string) {
+	s.Lock()
+	delete(s.keys, key.id)
+	reason = key.reason
+	if reason == `` {
+		close(key.done)
+	}
+	s.Unlock()
+	return
+}
+
+// close closes both connections of key, s must be locked
+func (s *sessions) close(key *session, reason string) {
+	if key.reason == `` {
+		key.reason = reason
+		close(key.done)
+	}
+	key.c0.Close()
+	key.c1.Close()
+}
+
+// Bridging is like the package level Bridging but the connections are tracked for Drain, Sessions and metrics,
+// and closed when they exceed limits. After Drain is called both connections are closed immediately.
+func (n *Network) Bridging(md Metadata, c0, c1 io.ReadWriteCloser, pool *pool.Pool, duration time.Duration, limits Limits) {
+	shapers := n.shapersOf(md, &limits)
+	if limits.Clients != nil {
+		ip := clientIP(md.Client)
+		shapers = append(shapers, limits.Clients.get(ip))
+		defer limits.Clients.put(ip)
+	}
+	c0, c1, finish := limits.Mirror.tee(c0, c1, duration)
+	defer finish()
+	key, ok := n.sessions.add(md, c0, c1, shapers)
+	if !ok {
+		c0.Close()
+		c1.Close()
+		return
+	}
+	defer n.sessions.wait.Done()
+	active := metrics.Bridges.With(md.Listener, md.Dialer)
+	active.Inc()
+	in := metrics.BytesIn.With(md.Listener, md.Dialer)
+	out := metrics.BytesOut.With(md.Listener, md.Dialer)
+	stop := n.watch(key, limits)
+	// shaping and idle timeouts need the bytes as they are written
+	exact := len(shapers) != 0 || limits.Idle > 0
+	client := Bridging(c0, c1, pool, duration, exact,
+		func(n int64) {
+			atomic.AddInt64(&key.in, n)
+			atomic.StoreInt64(&key.active, int64(time.Since(key.at)))
+			in.Add(n)
+			key.inRate.Add(n)
+			key.shape(n, true)
+		},
+		func(n int64) {
+			atomic.AddInt64(&key.out, n)
+			atomic.StoreInt64(&key.active, int64(time.Since(key.at)))
+			out.Add(n)
+			key.outRate.Add(n)
+			key.shape(n, false)
+		},
+	)
+	active.Dec()
+	reason := n.sessions.remove(key)
+	stop()
+	if n.access == nil {
+		return
+	} else if reason == `` {
+		if client {
+			reason = `client closed`
+		} else {
+			reason = `remote closed`
+		}
+	}
+	n.access.Info(`access`,
+		`listener`, md.Listener,
+		`client`, md.Client,
+		`dialer`, md.Dialer,
+		`remote`, md.Remote,
+		`sni`, md.SNI,
+		`route`, md.Route,
+		`start`, key.at,
+		`duration`, time.Since(key.at),
+		`in`, atomic.LoadInt64(&key.in),
+		`out`, atomic.LoadInt64(&key.out),
+		`reason`, reason,
+	)
+}
+
+// Drain stops accepting new bridged connections and waits for the existing ones to finish.
+// If ctx is done first the remaining connections are closed and ctx.Err() is returned.
+func (n *Network) Drain(ctx context.Context) (e error) {
+	s := &n.sessions
+	s.Lock()
+	s.draining = true
+	s.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+		e = ctx.Err()
+	}
+	s.Lock()
+	for _, key := range s.keys {
+		s.close(key, `drain timeout`)
+	}
+	s.Unlock()
+	<-done
+	return
+}
+
+// Active returns the number of bridged connections
+func (n *Network) Active() (count int) {
+	n.sessions.Lock()
+	count = len(n.sessions.keys)
+	n.sessions.Unlock()
+	return
+}
+
+// sorted returns the bridged connections ordered by id
+func (n *Network) sorted() []*session {
+	n.sessions.Lock()
+	keys := make([]*session, 0, len(n.sessions.keys))
+	for _, key := range n.sessions.keys {
+		keys = append(keys, key)
+	}
+	n.sessions.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].id < keys[j].id
+	})
+	return keys
+}
+
+// Sessions returns the info of the bridged connections ordered by id
+func (n *Network) Sessions() []any {
+	keys := n.sorted()
+	items := make([]any, len(keys))
+	for i, key := range keys {
+		items[i] = key.Info()
+	}
+	return items
+}
+
+// Kill closes both connections of the bridged connection with id, it returns false if not found
+func (n *Network) Kill(id uint64) bool {
+	n.sessions.Lock()
+	key, ok := n.sessions.keys[id]
+	if ok {
+		n.sessions.close(key, `killed`)
+	}
+	n.sessions.Unlock()
+	return ok
+}
@@ -0,0 +1,204 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/ratelimit"
+)
+
+// Shaper limits the bandwidth of the bridged connections sharing it, each direction has its own bucket
+type Shaper struct {
+	// 'listener', 'route', 'client' or 'dialer'
+	kind    string
+	rate    config.Rate
+	in, out *ratelimit.Bucket
+	// throughput of all connections sharing the shaper
+	inRate, outRate ratelimit.Meter
+}
+
+// NewShaper returns nil if rate is not limited
+func NewShaper(kind string, rate *config.Rate) *Shaper {
+	if rate.Limit < 1 {
+		return nil
+	}
+	return &Shaper{
+		kind: kind,
+		rate: *rate,
+		in:   ratelimit.New(rate.Limit, rate.Burst),
+		out:  ratelimit.New(rate.Limit, rate.Burst),
+	}
+}
+
+// Clients gives each client ip its own shaper, shapers are removed when the ip has no bridged connections
+type Clients struct {
+	rate  config.Rate
+	mutex sync.Mutex
+	keys  map[string]*clientShaper
+}
+type clientShaper struct {
+	*Shaper
+	refs int
+}
+
+// NewClients returns nil if rate is not limited
+func NewClients(rate *config.Rate) *Clients {
+	if rate.Limit < 1 {
+		return nil
+	}
+	return &Clients{
+		rate: *rate,
+		keys: make(map[string]*clientShaper),
+	}
+}
+func (c *Clients) get(ip string) *Shaper {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := c.keys[ip]
+	if !ok {
+		s = &clientShaper{
+			Shaper: NewShaper(`client`, &c.rate),
+		}
+		c.keys[ip] = s
+	}
+	s.refs++
+	return s.Shaper
+}
+func (c *Clients) put(ip string) {
+	c.mutex.Lock()
+	s := c.keys[ip]
+	s.refs--
+	if s.refs == 0 {
+		delete(c.keys, ip)
+	}
+	c.mutex.Unlock()
+}
+
+// clientIP returns the host of addr
+func clientIP(addr string) string {
+	host, _, e := net.SplitHostPort(addr)
+	if e != nil {
+		return addr
+	}
+	return host
+}
+
+// Shape sets the bandwidth of dialers, the shapers whose rate did not change are kept
+func (n *Network) Shape(dialers []*config.Dialer) {
+	shapers := make(map[string]*Shaper)
+	n.mutex.Lock()
+	for _, d := range dialers {
+		if old, ok := n.shapers[d.Tag]; ok && old.rate == d.Rate {
+			shapers[d.Tag] = old
+		} else if s := NewShaper(`dialer`, &d.Rate); s != nil {
+			shapers[d.Tag] = s
+		}
+	}
+	n.shapers = shapers
+	n.mutex.Unlock()
+}
+
+// shapersOf returns the shapers of the listener, the router entry and the dialer of md
+func (n *Network) shapersOf(md Metadata, limits *Limits) (shapers []*Shaper) {
+	if limits.Listener != nil {
+		shapers = append(shapers, limits.Listener)
+	}
+	if limits.Route != nil {
+		shapers = append(shapers, limits.Route)
+	}
+	n.mutex.Lock()
+	s := n.shapers[md.Dialer]
+	n.mutex.Unlock()
+	if s != nil {
+		shapers = append(shapers, s)
+	}
+	return
+}
+
+// shape counts n bytes forwarded in one direction by the shapers of key,
+// and waits until all of them allow it or key is closed
+func (key *session) shape(n int64, in bool) {
+	var wait time.Duration
+	for _, s := range key.shapers {
+		var w time.Duration
+		if in {
+			s.inRate.Add(n)
+			w = s.in.Take(n)
+		} else {
+			s.outRate.Add(n)
+			w = s.out.Take(n)
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	select {
+	case <-timer.C:
+	case <-key.done:
+		timer.Stop()
+	}
+}
+
+// Bandwidth returns the info of the shapers used by the bridged connections
+func (n *Network) Bandwidth() []any {
+	type item struct {
+		shaper *Shaper
+		md     Metadata
+		count  int
+	}
+	var (
+		items []*item
+		keys  = make(map[*Shaper]*item)
+	)
+	for _, key := range n.sorted() {
+		for _, s := range key.shapers {
+			if found, ok := keys[s]; ok {
+				found.count++
+			} else {
+				found = &item{
+					shaper: s,
+					md:     key.md,
+					count:  1,
+				}
+				keys[s] = found
+				items = append(items, found)
+			}
+		}
+	}
+	infos := make([]any, len(items))
+	for i, item := range items {
+		s := item.shaper
+		burst := s.rate.Burst
+		if burst < 1 {
+			burst = s.rate.Limit
+		}
+		info := map[string]any{
+			`kind`:        s.kind,
+			`limit`:       s.rate.Limit,
+			`burst`:       burst,
+			`in`:          s.inRate.Rate(),
+			`out`:         s.outRate.Rate(),
+			`connections`: item.count,
+		}
+		switch s.kind {
+		case `listener`:
+			info[`listener`] = item.md.Listener
+		case `route`:
+			info[`listener`] = item.md.Listener
+			info[`route`] = item.md.Route
+		case `client`:
+			info[`listener`] = item.md.Listener
+			info[`client`] = clientIP(item.md.Client)
+		case `dialer`:
+			info[`dialer`] = item.md.Dialer
+		}
+		infos[i] = info
+	}
+	return infos
+}
@@ -0,0 +1,129 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+)
+
+// DefaultTimeout is how long a listener waits for the header of a new connection
+const DefaultTimeout = time.Second * 10
+
+type listener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+// NewListener returns a listener whose connections must start with a PROXY protocol header.
+// The header is read on the first Read, RemoteAddr or LocalAddr, waiting for it at most timeout.
+func NewListener(l net.Listener, timeout time.Duration) net.Listener {
+	return &listener{
+		Listener: l,
+		timeout:  timeout,
+	}
+}
+func (l *listener) Accept() (c net.Conn, e error) {
+	c, e = l.Listener.Accept()
+	if e != nil {
+		return
+	}
+	c = &Conn{
+		Conn:    c,
+		timeout: l.timeout,
+	}
+	return
+}
+
+// Conn is a connection that starts with a PROXY protocol header
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+
+	once     sync.Once
+	r        *bufio.Reader
+	src, dst net.Addr
+	e        error
+}
+
+func (c *Conn) CloseWrite() error {
+	return ioutil.CloseWrite(c.Conn)
+}
+
+// Handshake reads the header if it has not been read yet
+func (c *Conn) Handshake() error {
+	c.once.Do(c.handshake)
+	return c.e
+}
+func (c *Conn) handshake() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	c.r = bufio.NewReaderSize(c.Conn, 256)
+	c.src, c.dst, c.e = ReadHeader(c.r)
+	if c.timeout > 0 && c.e == nil {
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+func (c *Conn) Read(b []byte) (n int, e error) {
+	e = c.Handshake()
+	if e != nil {
+		return
+	}
+	if c.r == nil {
+		return c.Conn.Read(b)
+	}
+	n, e = c.r.Read(b)
+	if c.r.Buffered() == 0 {
+		c.r = nil
+	}
+	return
+}
+
+// ReadFrom keeps the fast path of the underlying connection for data written to the client
+func (c *Conn) ReadFrom(r io.Reader) (n int64, e error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+// RemoteAddr returns the client address carried by the header
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Handshake() == nil && c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address carried by the header
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Handshake() == nil && c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Handshaker is a connection wrapping a Conn that has more to check once the header is read
+type Handshaker interface {
+	ProxyHandshake() error
+}
+
+// Handshake reads the header of c if it is a PROXY protocol connection, possibly wrapped by tls or a Handshaker
+func Handshake(c net.Conn) error {
+	for {
+		if pc, ok := c.(*Conn); ok {
+			return pc.Handshake()
+		} else if h, ok := c.(Handshaker); ok {
+			return h.ProxyHandshake()
+		}
+		tc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = tc.NetConn()
+	}
+}
@@ -0,0 +1,239 @@
+// Package proxyproto implements the haproxy PROXY protocol v1 and v2 headers
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	V1 = 1
+	V2 = 2
+)
+
+var (
+	ErrNoHeader      = errors.New(`proxyproto: no PROXY protocol header`)
+	ErrInvalidHeader = errors.New(`proxyproto: invalid PROXY protocol header`)
+)
+
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseVersion parses "v1" or "v2"
+func ParseVersion(s string) (version int, e error) {
+	switch s {
+	case `v1`:
+		version = V1
+	case `v2`:
+		version = V2
+	default:
+		e = errors.New(`proxyproto: version not supported: ` + s)
+	}
+	return
+}
+
+// Header returns the header of version that carries src and dst.
+// If the addresses are not ip:port of the same family, a v1 "UNKNOWN" or v2 "LOCAL" header is returned.
+func Header(version int, src, dst net.Addr) []byte {
+	source, destination, ok := addrPort(src, dst)
+	if version == V1 {
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := `TCP4`
+		if source.Addr().Is6() {
+			family = `TCP6`
+		}
+		return []byte(`PROXY ` + family +
+			` ` + source.Addr().String() + ` ` + destination.Addr().String() +
+			` ` + strconv.Itoa(int(source.Port())) + ` ` + strconv.Itoa(int(destination.Port())) +
+			"\r\n")
+	}
+
+	b := make([]byte, 16, 16+36)
+	copy(b, signature)
+	if !ok {
+		// LOCAL
+		b[12] = 0x20
+		return b
+	}
+	// PROXY
+	b[12] = 0x21
+	if source.Addr().Is4() {
+		// TCP over IPv4
+		b[13] = 0x11
+		b = append(b, source.Addr().AsSlice()...)
+		b = append(b, destination.Addr().AsSlice()...)
+	} else {
+		// TCP over IPv6
+		b[13] = 0x21
+		b = append(b, source.Addr().AsSlice()...)
+		b = append(b, destination.Addr().AsSlice()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, source.Port())
+	b = binary.BigEndian.AppendUint16(b, destination.Port())
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	return b
+}
+func addrPort(src, dst net.Addr) (source, destination netip.AddrPort, ok bool) {
+	if src == nil {
+		return
+	}
+	source, e := netip.ParseAddrPort(src.String())
+	if e != nil {
+		return
+	}
+	source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+	if dst != nil {
+		destination, e = netip.ParseAddrPort(dst.String())
+		if e == nil {
+			destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+		}
+	}
+	if dst == nil || e != nil || destination.Addr().Is4() != source.Addr().Is4() {
+		// the address streamf was reached at is unknown, use the unspecified address of the same family
+		if source.Addr().Is4() {
+			destination = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		} else {
+			destination = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		}
+	}
+	ok = true
+	return
+}
+
+// ReadHeader reads a v1 or v2 header from r.
+// src and dst are nil for v1 "UNKNOWN", v2 "LOCAL" and address families other than tcp.
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, e error) {
+	b, e := r.Peek(1)
+	if e != nil {
+		return
+	}
+	switch b[0] {
+	case 'P':
+		return readV1(r)
+	case '\r':
+		return readV2(r)
+	}
+	e = ErrNoHeader
+	return
+}
+func readV1(r *bufio.Reader) (src, dst net.Addr, e error) {
+	// the v1 header is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		var c byte
+		c, e = r.ReadByte()
+		if e != nil {
+			return
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte(`PROXY `)) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		e = ErrInvalidHeader
+		return
+	}
+	fields := strings.Split(string(line[6:len(line)-2]), ` `)
+	switch fields[0] {
+	case `UNKNOWN`:
+		return
+	case `TCP4`, `TCP6`:
+		if len(fields) != 5 {
+			e = ErrInvalidHeader
+			return
+		}
+	default:
+		e = ErrInvalidHeader
+		return
+	}
+	srcIP, e := netip.ParseAddr(fields[1])
+	if e != nil {
+		e = ErrInvalidHeader
+		return
+	}
+	dstIP, e := netip.ParseAddr(fields[2])
+	if e != nil {
+		e = ErrInvalidHeader
+		return
+	}
+	srcPort, e := strconv.ParseUint(fields[3], 10, 16)
+	if e != nil {
+		e = ErrInvalidHeader
+		return
+	}
+	dstPort, e := strconv.ParseUint(fields[4], 10, 16)
+	if e != nil {
+		e = ErrInvalidHeader
+		return
+	}
+	src = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, uint16(srcPort)))
+	dst = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, uint16(dstPort)))
+	return
+}
+func readV2(r *bufio.Reader) (src, dst net.Addr, e error) {
+	b := make([]byte, 16)
+	_, e = io.ReadFull(r, b)
+	if e != nil {
+		return
+	}
+	if !bytes.Equal(b[:12], signature) || b[12]>>4 != 2 {
+		e = ErrInvalidHeader
+		return
+	}
+	command, family := b[12]&0xf, b[13]
+	b = make([]byte, binary.BigEndian.Uint16(b[14:]))
+	_, e = io.ReadFull(r, b)
+	if e != nil {
+		return
+	}
+	switch command {
+	case 0x0:
+		// LOCAL
+		return
+	case 0x1:
+		// PROXY
+	default:
+		e = ErrInvalidHeader
+		return
+	}
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		if len(b) < 12 {
+			e = ErrInvalidHeader
+			return
+		}
+		src = &net.TCPAddr{
+			IP:   net.IP(b[:4]),
+			Port: int(binary.BigEndian.Uint16(b[8:])),
+		}
+		dst = &net.TCPAddr{
+			IP:   net.IP(b[4:8]),
+			Port: int(binary.BigEndian.Uint16(b[10:])),
+		}
+	case 0x21:
+		// TCP over IPv6
+		if len(b) < 36 {
+			e = ErrInvalidHeader
+			return
+		}
+		src = &net.TCPAddr{
+			IP:   net.IP(b[:16]),
+			Port: int(binary.BigEndian.Uint16(b[32:])),
+		}
+		dst = &net.TCPAddr{
+			IP:   net.IP(b[16:32]),
+			Port: int(binary.BigEndian.Uint16(b[34:])),
+		}
+	}
+	return
+}
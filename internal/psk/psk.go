@@ -0,0 +1,376 @@
+// Package psk encrypts streams with AES-256-GCM keyed from a pre-shared secret.
+//
+// The secret is stretched with scrypt and a random salt the listener chooses when it starts, so the key of
+// a listener is derived once and a client derives it once for each listener salt it sees.
+// The client sends a random 32 bytes salt, the server answers with the scrypt salt and its own random salt,
+// then the client sends a 32 bytes confirmation, an HMAC-SHA256 of both salts proving it knows the secret.
+// Only if it checks out the server proves it knows the secret the same way, otherwise it closes the connection,
+// so a peer that does not know the secret gets nothing derived from it. Each direction then uses its own key
+// derived from both salts, so a recorded connection can not be replayed to a server that chooses a new salt.
+//
+// Every record is a 2 bytes big endian payload length followed by the sealed payload, the length is
+// authenticated as additional data and the nonce counts the records of the direction, so records can not
+// be dropped, reordered or replayed. A record with an empty payload ends the direction like CloseWrite,
+// a connection closed without it reads io.ErrUnexpectedEOF.
+package psk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+	"golang.org/x/crypto/scrypt"
+)
+
+// DefaultTimeout is how long a listener waits for the handshake of a new connection
+const DefaultTimeout = time.Second * 10
+
+const (
+	saltSize    = 32
+	keySaltSize = 16
+	headerSize  = 2
+	maxPayload  = 16 * 1024
+
+	// scrypt costs about 100ms and 32MB
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	// at most this many keys derived by clients are cached
+	maxKeys = 64
+)
+
+var (
+	ErrAuthentication = errors.New(`psk authentication failed`)
+	errRecord         = errors.New(`psk record too large`)
+)
+
+type listener struct {
+	net.Listener
+	key, keySalt []byte
+	timeout      time.Duration
+}
+
+// NewListener returns a listener whose connections are encrypted with secret.
+// The handshake is done on the first Read or Write, waiting for the client at most timeout.
+func NewListener(l net.Listener, secret string, timeout time.Duration) net.Listener {
+	keySalt := make([]byte, keySaltSize)
+	rand.Read(keySalt)
+	return &listener{
+		Listener: l,
+		key:      stretch(secret, keySalt),
+		keySalt:  keySalt,
+		timeout:  timeout,
+	}
+}
+func (l *listener) Accept() (c net.Conn, e error) {
+	c, e = l.Listener.Accept()
+	if e != nil {
+		return
+	}
+	c = &Conn{
+		Conn:    c,
+		key:     l.key,
+		keySalt: l.keySalt,
+		timeout: l.timeout,
+	}
+	return
+}
+
+// Client returns the client end of a connection encrypted with secret, the handshake takes at most timeout
+func Client(conn net.Conn, secret string, timeout time.Duration) *Conn {
+	return &Conn{
+		Conn:    conn,
+		secret:  secret,
+		timeout: timeout,
+		client:  true,
+	}
+}
+
+// Conn is a connection encrypted with a pre-shared secret
+type Conn struct {
+	net.Conn
+	// the secret of a client, the key and its salt of a server
+	secret       string
+	key, keySalt []byte
+	timeout      time.Duration
+	client       bool
+
+	once sync.Once
+	e    error
+
+	readMutex sync.Mutex
+	reader    cipher.AEAD
+	readNonce uint64
+	readBuf   []byte
+	// decrypted bytes not read yet
+	plain   []byte
+	readErr error
+
+	writeMutex sync.Mutex
+	writer     cipher.AEAD
+	writeNonce uint64
+	writeBuf   []byte
+	finSent    bool
+}
+
+// NetConn returns the underlying connection
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Handshake exchanges the salts if they have not been exchanged yet
+func (c *Conn) Handshake() error {
+	c.once.Do(c.handshake)
+	return c.e
+}
+func (c *Conn) handshake() {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	var (
+		b          [saltSize*3 + keySaltSize]byte
+		clientSalt = b[:saltSize]
+		keySalt    = b[saltSize : saltSize+keySaltSize]
+		serverSalt = b[saltSize+keySaltSize : saltSize*2+keySaltSize]
+		confirm    = b[saltSize*2+keySaltSize:]
+	)
+	if c.client {
+		_, c.e = rand.Read(clientSalt)
+		if c.e == nil {
+			_, c.e = c.Conn.Write(clientSalt)
+		}
+		if c.e == nil {
+			_, c.e = io.ReadFull(c.Conn, b[saltSize:saltSize*2+keySaltSize])
+		}
+		if c.e == nil {
+			c.key = clientKey(c.secret, keySalt)
+			_, c.e = c.Conn.Write(derive(c.key, `client confirm`, clientSalt, serverSalt))
+		}
+		if c.e == nil {
+			_, c.e = io.ReadFull(c.Conn, confirm)
+			if c.e == io.EOF {
+				// the server closes the connection if the client confirmation is wrong
+				c.e = ErrAuthentication
+			}
+		}
+		if c.e == nil && !hmac.Equal(confirm, derive(c.key, `server confirm`, clientSalt, serverSalt)) {
+			c.e = ErrAuthentication
+		}
+	} else {
+		_, c.e = io.ReadFull(c.Conn, clientSalt)
+		if c.e == nil {
+			copy(keySalt, c.keySalt)
+			_, c.e = rand.Read(serverSalt)
+		}
+		if c.e == nil {
+			_, c.e = c.Conn.Write(b[saltSize : saltSize*2+keySaltSize])
+		}
+		if c.e == nil {
+			_, c.e = io.ReadFull(c.Conn, confirm)
+		}
+		if c.e == nil {
+			if hmac.Equal(confirm, derive(c.key, `client confirm`, clientSalt, serverSalt)) {
+				_, c.e = c.Conn.Write(derive(c.key, `server confirm`, clientSalt, serverSalt))
+			} else {
+				c.e = ErrAuthentication
+			}
+		}
+	}
+	if c.e == nil {
+		var toServer, toClient cipher.AEAD
+		toServer, c.e = newAEAD(c.key, `client`, clientSalt, serverSalt)
+		if c.e == nil {
+			toClient, c.e = newAEAD(c.key, `server`, clientSalt, serverSalt)
+		}
+		if c.e == nil {
+			if c.client {
+				c.writer, c.reader = toServer, toClient
+			} else {
+				c.writer, c.reader = toClient, toServer
+			}
+			c.readBuf = make([]byte, maxPayload+c.reader.Overhead())
+			c.writeBuf = make([]byte, 0, headerSize+maxPayload+c.writer.Overhead())
+		}
+	}
+	if c.timeout > 0 && c.e == nil {
+		c.Conn.SetDeadline(time.Time{})
+	}
+}
+
+// stretch derives the key of secret with scrypt
+func stretch(secret string, salt []byte) []byte {
+	// the parameters are valid, scrypt can not fail
+	key, _ := scrypt.Key([]byte(secret), salt, scryptN, scryptR, scryptP, 32)
+	return key
+}
+
+type keyID struct {
+	secret string
+	salt   string
+}
+
+var keys = struct {
+	sync.Mutex
+	m map[keyID][]byte
+}{m: make(map[keyID][]byte)}
+
+// clientKey returns the key of secret for the salt of a listener, it is derived once for each salt
+func clientKey(secret string, salt []byte) []byte {
+	id := keyID{secret: secret, salt: string(salt)}
+	keys.Lock()
+	key, ok := keys.m[id]
+	keys.Unlock()
+	if ok {
+		return key
+	}
+	key = stretch(secret, salt)
+	keys.Lock()
+	if len(keys.m) >= maxKeys {
+		clear(keys.m)
+	}
+	keys.m[id] = key
+	keys.Unlock()
+	return key
+}
+
+// derive returns HMAC-SHA256(key, label + clientSalt + serverSalt)
+func derive(key []byte, label string, clientSalt, serverSalt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(`streamf psk ` + label))
+	mac.Write(clientSalt)
+	mac.Write(serverSalt)
+	return mac.Sum(nil)
+}
+func newAEAD(key []byte, label string, clientSalt, serverSalt []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(derive(key, label, clientSalt, serverSalt))
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+func nonce(b []byte, counter uint64) []byte {
+	binary.BigEndian.PutUint64(b[len(b)-8:], counter)
+	return b
+}
+
+func (c *Conn) Read(b []byte) (n int, e error) {
+	e = c.Handshake()
+	if e != nil {
+		return
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	for len(c.plain) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		c.readErr = c.readRecord()
+	}
+	n = copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return
+}
+
+// readRecord decrypts the next record into c.plain, it returns io.EOF for the record that ends the direction
+func (c *Conn) readRecord() (e error) {
+	var header [headerSize]byte
+	_, e = io.ReadFull(c.Conn, header[:])
+	if e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > maxPayload {
+		return errRecord
+	}
+	b := c.readBuf[:size+c.reader.Overhead()]
+	_, e = io.ReadFull(c.Conn, b)
+	if e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	var iv [12]byte
+	c.plain, e = c.reader.Open(b[:0], nonce(iv[:], c.readNonce), b, header[:])
+	if e != nil {
+		return ErrAuthentication
+	}
+	c.readNonce++
+	if size == 0 {
+		e = io.EOF
+	}
+	return
+}
+func (c *Conn) Write(b []byte) (n int, e error) {
+	e = c.Handshake()
+	if e != nil {
+		return
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.finSent {
+		return 0, io.ErrClosedPipe
+	}
+	for len(b) != 0 {
+		size := min(len(b), maxPayload)
+		e = c.writeRecord(b[:size])
+		if e != nil {
+			return
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+func (c *Conn) writeRecord(payload []byte) (e error) {
+	var (
+		header [headerSize]byte
+		iv     [12]byte
+	)
+	binary.BigEndian.PutUint16(header[:], uint16(len(payload)))
+	b := append(c.writeBuf[:0], header[:]...)
+	b = c.writer.Seal(b, nonce(iv[:], c.writeNonce), payload, header[:])
+	c.writeNonce++
+	_, e = c.Conn.Write(b)
+	return
+}
+
+// CloseWrite sends the record that ends the direction and half-closes the underlying connection if it supports it
+func (c *Conn) CloseWrite() (e error) {
+	e = c.Handshake()
+	if e != nil {
+		return
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.finSent {
+		return
+	}
+	c.finSent = true
+	e = c.writeRecord(nil)
+	if e == nil {
+		// the peer reads io.EOF from the record even if the connection can not be half-closed
+		ioutil.CloseWrite(c.Conn)
+	}
+	return
+}
+
+// Handshake exchanges the salts of c if it is a connection encrypted with a pre-shared secret
+func Handshake(c net.Conn) error {
+	if pc, ok := c.(*Conn); ok {
+		return pc.Handshake()
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package psk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// listen returns a listener of secret on a random loopback port, the accepted connections are sent to conns
+func listen(t *testing.T, secret string) (addr string, conns chan *Conn) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { l.Close() })
+	pl := NewListener(l, secret, time.Second*5)
+	conns = make(chan *Conn, 1)
+	go func() {
+		for {
+			c, e := pl.Accept()
+			if e != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+			conns <- c.(*Conn)
+		}
+	}()
+	return l.Addr().String(), conns
+}
+
+// pair returns the client and server ends of a handshaken connection, the raw client connection is wrapped by w
+func pair(t *testing.T, w func(net.Conn) net.Conn) (client, server *Conn, raw net.Conn) {
+	addr, conns := listen(t, `secret`)
+	raw, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { raw.Close() })
+	server = <-conns
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+	client = Client(w(raw), `secret`, time.Second*5)
+	if e = client.Handshake(); e != nil {
+		t.Fatal(e)
+	}
+	if e = <-done; e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+func nop(c net.Conn) net.Conn {
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	client, server, _ := pair(t, nop)
+	data := make([]byte, maxPayload*3+100)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	b, e := io.ReadAll(server)
+	if e != nil {
+		t.Fatal(e)
+	} else if !bytes.Equal(b, data) {
+		t.Fatal(`server read wrong data`)
+	}
+
+	// the other direction works after the client half-closed
+	go func() {
+		server.Write(data[:1000])
+		server.CloseWrite()
+	}()
+	b, e = io.ReadAll(client)
+	if e != nil {
+		t.Fatal(e)
+	} else if !bytes.Equal(b, data[:1000]) {
+		t.Fatal(`client read wrong data`)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	addr, conns := listen(t, `secret`)
+	raw, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer raw.Close()
+	done := make(chan error, 1)
+	go func() {
+		server := <-conns
+		e := server.Handshake()
+		server.Close()
+		done <- e
+	}()
+	e = Client(raw, `wrong`, time.Second*5).Handshake()
+	if !errors.Is(e, ErrAuthentication) {
+		t.Fatal(`client:`, e)
+	}
+	if e = <-done; !errors.Is(e, ErrAuthentication) {
+		t.Fatal(`server:`, e)
+	}
+}
+
+// TestServerConfirm checks that the server proves nothing to a client that has not proved the secret
+func TestServerConfirm(t *testing.T) {
+	addr, conns := listen(t, `secret`)
+	raw, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer raw.Close()
+	go func() {
+		server := <-conns
+		server.Handshake()
+		server.Close()
+	}()
+	raw.SetDeadline(time.Now().Add(time.Second * 5))
+	b := make([]byte, saltSize*2+keySaltSize)
+	_, e = raw.Write(b[:saltSize])
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = io.ReadFull(raw, b[saltSize:])
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = raw.Write(make([]byte, saltSize))
+	if e != nil {
+		t.Fatal(e)
+	}
+	n, e := raw.Read(b)
+	if n != 0 || e == nil {
+		t.Fatal(`server answered a wrong confirmation`, n, e)
+	}
+}
+
+// recorder keeps the records written after capture is set instead of sending them
+type recorder struct {
+	net.Conn
+	capture bool
+	records [][]byte
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.capture {
+		r.records = append(r.records, append([]byte(nil), b...))
+		return len(b), nil
+	}
+	return r.Conn.Write(b)
+}
+
+// records returns the server end and the records of "one", "two" and CloseWrite written by the client
+func records(t *testing.T) (server *Conn, raw net.Conn, one, two, fin []byte) {
+	var r *recorder
+	client, server, raw := pair(t, func(c net.Conn) net.Conn {
+		r = &recorder{Conn: c}
+		return r
+	})
+	r.capture = true
+	client.Write([]byte(`one`))
+	client.Write([]byte(`two`))
+	client.CloseWrite()
+	if len(r.records) != 3 {
+		t.Fatal(`records:`, len(r.records))
+	}
+	server.SetDeadline(time.Now().Add(time.Second * 5))
+	return server, raw, r.records[0], r.records[1], r.records[2]
+}
+
+// read reads from c until an error
+func read(c net.Conn) (s string, e error) {
+	b := make([]byte, 64)
+	for {
+		var n int
+		n, e = c.Read(b)
+		s += string(b[:n])
+		if e != nil {
+			return
+		}
+	}
+}
+func send(t *testing.T, raw net.Conn, records ...[]byte) {
+	for _, b := range records {
+		if _, e := raw.Write(b); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	server, raw, one, two, fin := records(t)
+	send(t, raw, one, two, fin)
+	s, e := read(server)
+	if s != `onetwo` || e != io.EOF {
+		t.Fatal(s, e)
+	}
+	// the end of the direction is kept
+	if n, e := server.Read(make([]byte, 1)); n != 0 || e != io.EOF {
+		t.Fatal(n, e)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	for _, i := range []int{0, 1, headerSize, headerSize + 2, -1} {
+		server, raw, one, _, _ := records(t)
+		if i < 0 {
+			i = len(one) - 1
+		}
+		one[i] ^= 1
+		send(t, raw, one)
+		raw.Close()
+		s, e := read(server)
+		if s != `` || (e != ErrAuthentication && e != io.ErrUnexpectedEOF && e != errRecord) {
+			t.Fatal(i, s, e)
+		}
+	}
+}
+
+func TestReordered(t *testing.T) {
+	server, raw, one, two, fin := records(t)
+	send(t, raw, two, one, fin)
+	s, e := read(server)
+	if s != `` || e != ErrAuthentication {
+		t.Fatal(s, e)
+	}
+}
+
+func TestReplayed(t *testing.T) {
+	server, raw, one, _, fin := records(t)
+	send(t, raw, one, one, fin)
+	s, e := read(server)
+	if s != `one` || e != ErrAuthentication {
+		t.Fatal(s, e)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	server, raw, one, two, _ := records(t)
+	send(t, raw, one, two[:len(two)-3])
+	raw.Close()
+	s, e := read(server)
+	if s != `one` || e != io.ErrUnexpectedEOF {
+		t.Fatal(s, e)
+	}
+
+	// closed without the record that ends the direction
+	server, raw, one, two, _ = records(t)
+	send(t, raw, one, two)
+	raw.Close()
+	s, e = read(server)
+	if s != `onetwo` || e != io.ErrUnexpectedEOF {
+		t.Fatal(s, e)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server, _ := pair(t, nop)
+	if e := client.CloseWrite(); e != nil {
+		t.Fatal(e)
+	}
+	if e := client.CloseWrite(); e != nil {
+		t.Fatal(`second CloseWrite:`, e)
+	}
+	if _, e := client.Write([]byte(`late`)); e != io.ErrClosedPipe {
+		t.Fatal(`Write after CloseWrite:`, e)
+	}
+	server.SetDeadline(time.Now().Add(time.Second * 5))
+	if n, e := server.Read(make([]byte, 1)); n != 0 || e != io.EOF {
+		t.Fatal(n, e)
+	}
+}
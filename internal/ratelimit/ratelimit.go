@@ -0,0 +1,98 @@
+// Package ratelimit implements the token bucket and throughput meter used to shape bridged connections
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket, tokens are bytes
+type Bucket struct {
+	mutex  sync.Mutex
+	limit  float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a bucket refilled with limit bytes per second up to burst, if burst < 1 it is equal to limit
+func New(limit, burst int64) *Bucket {
+	if burst < 1 {
+		burst = limit
+	}
+	return &Bucket{
+		limit:  float64(limit),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens generated since last, b must be locked
+func (b *Bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.limit
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Take removes n tokens which may leave the bucket in debt, it returns how long to wait until the debt is repaid.
+func (b *Bucket) Take(n int64) (wait time.Duration) {
+	b.mutex.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.limit * float64(time.Second))
+	}
+	b.mutex.Unlock()
+	return
+}
+
+// Allow removes n tokens if the bucket has enough
+func (b *Bucket) Allow(n int64) (ok bool) {
+	b.mutex.Lock()
+	b.refill()
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		ok = true
+	}
+	b.mutex.Unlock()
+	return
+}
+
+// Meter measures the throughput in bytes per second
+type Meter struct {
+	mutex sync.Mutex
+	// unix second of cur
+	at        int64
+	cur, prev int64
+}
+
+func (m *Meter) roll(now int64) {
+	if now != m.at {
+		if now == m.at+1 {
+			m.prev = m.cur
+		} else {
+			m.prev = 0
+		}
+		m.cur = 0
+		m.at = now
+	}
+}
+func (m *Meter) Add(n int64) {
+	m.mutex.Lock()
+	m.roll(time.Now().Unix())
+	m.cur += n
+	m.mutex.Unlock()
+}
+
+// Rate returns the bytes added during the last whole second
+func (m *Meter) Rate() (n int64) {
+	m.mutex.Lock()
+	m.roll(time.Now().Unix())
+	n = m.prev
+	m.mutex.Unlock()
+	return
+}
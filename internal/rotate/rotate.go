@@ -0,0 +1,151 @@
+// Package rotate implements a log file that is rotated by size and age
+package rotate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New(`rotate writer already closed`)
+
+// layout of the time added to the rotated file names, it sorts in time order
+const layout = `20060102T150405.000`
+
+// Writer appends to a file, when the file grows larger than maxSize bytes or has been written
+// for longer than maxAge it is renamed to name-20060102T150405.000.ext and a new file is created.
+type Writer struct {
+	mutex      sync.Mutex
+	name       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	// nil if the file could not be opened after rotating, it is opened again by the next Write
+	f      *os.File
+	size   int64
+	at     time.Time
+	closed bool
+}
+
+// New opens name for appending, maxSize, maxAge and maxBackups less than 1 are disabled.
+func New(name string, maxSize int64, maxAge time.Duration, maxBackups int) (w *Writer, e error) {
+	e = os.MkdirAll(filepath.Dir(name), 0755)
+	if e != nil {
+		return
+	}
+	w = &Writer{
+		name:       name,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	e = w.open()
+	if e != nil {
+		w = nil
+	}
+	return
+}
+func (w *Writer) open() (e error) {
+	f, e := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		return
+	}
+	info, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return
+	}
+	w.f = f
+	w.size = info.Size()
+	w.at = time.Now()
+	return
+}
+func (w *Writer) Write(b []byte) (n int, e error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		e = ErrClosed
+		return
+	} else if w.f == nil {
+		e = w.open()
+		if e != nil {
+			return
+		}
+	}
+	if w.size > 0 &&
+		((w.maxSize > 0 && w.size+int64(len(b)) > w.maxSize) ||
+			(w.maxAge > 0 && time.Since(w.at) >= w.maxAge)) {
+		e = w.rotate()
+		if e != nil {
+			return
+		}
+	}
+	n, e = w.f.Write(b)
+	w.size += int64(n)
+	return
+}
+func (w *Writer) rotate() (e error) {
+	w.f.Close()
+	w.f = nil
+	ext := filepath.Ext(w.name)
+	e = os.Rename(w.name, strings.TrimSuffix(w.name, ext)+`-`+time.Now().Format(layout)+ext)
+	if e != nil {
+		// keep writing to the old file rather than losing logs
+		return w.open()
+	}
+	e = w.open()
+	if e == nil {
+		w.clean()
+	}
+	return
+}
+
+// clean removes the oldest rotated files beyond maxBackups
+func (w *Writer) clean() {
+	if w.maxBackups < 1 {
+		return
+	}
+	var (
+		dir    = filepath.Dir(w.name)
+		ext    = filepath.Ext(w.name)
+		prefix = strings.TrimSuffix(filepath.Base(w.name), ext) + `-`
+	)
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		return
+	}
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		if _, e := time.Parse(layout, name[len(prefix):len(name)-len(ext)]); e == nil {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > w.maxBackups {
+		os.Remove(filepath.Join(dir, backups[0]))
+		backups = backups[1:]
+	}
+}
+func (w *Writer) Close() (e error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		e = ErrClosed
+		return
+	}
+	w.closed = true
+	if w.f != nil {
+		e = w.f.Close()
+		w.f = nil
+	}
+	return
+}
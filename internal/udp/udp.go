@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 )
 
 type UDP struct {
@@ -22,6 +23,8 @@ type UDP struct {
 	size    int
 	mutex   sync.Mutex
 	keys    map[string]*remoteConn
+	// sessions in metrics
+	sessions *metrics.Gauge
 
 	done   chan struct{}
 	closed uint32
@@ -82,10 +85,11 @@ func New(log *slog.Logger, opts *config.UDPForward) (u *UDP, e error) {
 		c:         c,
 		listen:    opts.Listen,
 		to:        opts.To,
-		toNetwork: opts.ToNetwork,
+		toNetwork: toNetwork,
 		timeout:   timeout,
 		size:      size,
 		keys:      make(map[string]*remoteConn),
+		sessions:  metrics.UDPSessions.With(tag),
 		done:      make(chan struct{}),
 		log:       log,
 	}
@@ -145,6 +149,7 @@ func (u *UDP) Serve() (e error) {
 			u.mutex.Lock()
 			u.keys[key] = c
 			u.mutex.Unlock()
+			u.sessions.Inc()
 		}
 	}
 	return
@@ -264,6 +269,7 @@ func (c *remoteConn) Close() (e error) {
 		c.udp.mutex.Lock()
 		if c.udp.keys[c.key] == c {
 			delete(c.udp.keys, c.key)
+			c.udp.sessions.Dec()
 		}
 		c.udp.mutex.Unlock()
 	}
@@ -3,6 +3,8 @@ package listener
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"io"
 	"log/slog"
 	"net"
 	"sync/atomic"
@@ -10,46 +12,92 @@ import (
 
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/certwatch"
+	"github.com/powerpuffpenguin/streamf/internal/compress"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/internal/proxyproto"
+	"github.com/powerpuffpenguin/streamf/internal/psk"
 	"github.com/powerpuffpenguin/streamf/pool"
 )
 
 type BasicListener struct {
-	listener net.Listener
-	dialer   dialer.Dialer
-	pool     *pool.Pool
-	log      *slog.Logger
-	closed   uint32
-	duration time.Duration
+	nk        *network.Network
+	listener  net.Listener
+	admission *network.Admission
+	watcher   *certwatch.Watcher
+	acl       *network.ACL
+	dialer    dialer.Dialer
+	pool      *pool.Pool
+	log       *slog.Logger
+	closed    uint32
+	done      chan struct{}
+	duration  time.Duration
+	limits    network.Limits
+	// accept streams multiplexed on the connections if mux is true
+	mux       bool
+	keepalive time.Duration
+	// decompresses the connections or streams if not nil
+	compress *compress.Stats
 
 	tag, network, addr string
 	secure             bool
 }
 
-func NewBasicListener(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialer dialer.Dialer, connect *config.ConnectDialer, opts *config.BasicListener) (listener *BasicListener, e error) {
+func NewBasicListener(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialer dialer.Dialer, mirror *network.Mirror, connect *config.ConnectDialer, opts *config.BasicListener) (listener *BasicListener, e error) {
 	secure, certificate, alpn, e := opts.TLS.Certificate()
 	if e != nil {
 		log.Error(`new basic listener fail`, `error`, e)
 		return
 	}
+	e = compress.Check(opts.Compress)
+	if e != nil {
+		log.Error(`new basic listener fail`, `error`, e)
+		return
+	}
+	admission := network.NewAdmission(&opts.Admission)
 	var l net.Listener
+	var watcher *certwatch.Watcher
 	if secure {
-		l, e = nk.ListenTLS(opts.Network, opts.Addr, &tls.Config{
-			Certificates: []tls.Certificate{certificate},
-			NextProtos:   alpn,
+		watcher = certwatch.New(&opts.TLS, certificate)
+		l, e = listenTLS(nk, opts, admission, &tls.Config{
+			GetCertificate: watcher.GetCertificate,
+			NextProtos:     alpn,
 		})
 		if e != nil {
 			log.Error(`new basic listener fail`, `error`, e)
 			return
 		}
 	} else if opts.Network == `udp` || opts.Network == `udp4` || opts.Network == `udp6` {
+		if opts.ProxyProtocol {
+			e = errors.New(`proxyProtocol not supported by udp listener`)
+			log.Error(`new basic listener fail`, `error`, e)
+			return
+		} else if opts.Mux.Enable {
+			e = errors.New(`mux not supported by udp listener`)
+			log.Error(`new basic listener fail`, `error`, e)
+			return
+		} else if opts.PSK != `` {
+			e = errors.New(`psk not supported by udp listener`)
+			log.Error(`new basic listener fail`, `error`, e)
+			return
+		} else if opts.Compress != `` {
+			e = errors.New(`compress not supported by udp listener`)
+			log.Error(`new basic listener fail`, `error`, e)
+			return
+		} else if mirror != nil {
+			e = errors.New(`mirror not supported by udp listener`)
+			log.Error(`new basic listener fail`, `error`, e)
+			return
+		}
 		l, e = nk.ListenUdp(opts.Network, opts.Addr, &opts.UDP, pool)
 		if e != nil {
 			log.Error(`new basic listener fail`, `error`, e)
 			return
 		}
+		l = admission.Listener(l, false)
 	} else {
-		l, e = nk.Listen(opts.Network, opts.Addr)
+		l, e = listen(nk, opts, admission)
 		if e != nil {
 			log.Error(`new basic listener fail`, `error`, e)
 			return
@@ -61,11 +109,21 @@ func NewBasicListener(nk *network.Network, log *slog.Logger, pool *pool.Pool, di
 	if tag == `` {
 		if secure {
 			tag = `basic ` + addr.Network() + `+tls://` + addr.String()
+		} else if opts.PSK != `` {
+			tag = `basic ` + addr.Network() + `+psk://` + addr.String()
 		} else {
 			tag = `basic ` + addr.Network() + `://` + addr.String()
 		}
 	}
+	admission.SetTag(tag)
+	acl, e := network.NewACL(tag, &opts.ACL)
+	if e != nil {
+		l.Close()
+		log.Error(`new basic listener fail`, `error`, e)
+		return
+	}
 	log = log.With(`listener`, tag, `dialer`, dialer.Tag())
+	watcher.Watch(log)
 	var duration time.Duration
 	if connect.Close == `` {
 		duration = time.Second
@@ -81,13 +139,33 @@ func NewBasicListener(nk *network.Network, log *slog.Logger, pool *pool.Pool, di
 			)
 		}
 	}
-	log.Info(`new basic listener`, `close`, duration)
+	limits := network.NewLimits(log, connect)
+	limits.Listener, limits.Clients = shaper(opts)
+	limits.Mirror = mirror
+	keepalive := muxKeepalive(log, &opts.Mux)
+	log.Info(`new basic listener`,
+		`close`, duration,
+		`idleTimeout`, limits.Idle,
+		`maxLifetime`, limits.Lifetime,
+		`mux`, opts.Mux.Enable,
+		`compress`, opts.Compress,
+		`mirror`, connect.Mirror.Tag,
+	)
 	listener = &BasicListener{
-		listener: l,
-		dialer:   dialer,
-		pool:     pool,
-		log:      log,
-		duration: duration,
+		nk:        nk,
+		listener:  metrics.Listener(l, metrics.Accepted.With(tag)),
+		admission: admission,
+		watcher:   watcher,
+		acl:       acl,
+		dialer:    dialer,
+		pool:      pool,
+		log:       log,
+		done:      make(chan struct{}),
+		duration:  duration,
+		limits:    limits,
+		mux:       opts.Mux.Enable,
+		keepalive: keepalive,
+		compress:  compress.New(opts.Compress),
 
 		tag:     tag,
 		network: addr.Network(),
@@ -98,17 +176,24 @@ func NewBasicListener(nk *network.Network, log *slog.Logger, pool *pool.Pool, di
 }
 func (l *BasicListener) Info() any {
 	return map[string]any{
-		`tag`:     l.tag,
-		`network`: l.network,
-		`addr`:    l.addr,
-		`secure`:  l.secure,
-		`dialer`:  l.dialer.Tag(),
-		`portal`:  false,
+		`tag`:         l.tag,
+		`network`:     l.network,
+		`addr`:        l.addr,
+		`secure`:      l.secure,
+		`dialer`:      l.dialer.Tag(),
+		`portal`:      false,
+		`admission`:   l.admission.Info(),
+		`certificate`: l.watcher.Info(),
+		`mux`:         l.mux,
+		`compress`:    l.compress.Info(),
+		`mirror`:      l.limits.Mirror.Info(),
 	}
 }
 func (l *BasicListener) Close() (e error) {
 	if l.closed == 0 && atomic.CompareAndSwapUint32(&l.closed, 0, 1) {
+		close(l.done)
 		e = l.listener.Close()
+		l.watcher.Close()
 	} else {
 		e = ErrClosed
 	}
@@ -142,7 +227,37 @@ func (l *BasicListener) Serve() error {
 	}
 }
 func (l *BasicListener) serve(src net.Conn) {
-	dst, e := l.dialer.Connect(context.Background())
+	e := proxyproto.Handshake(src)
+	if e != nil {
+		src.Close()
+		l.log.Warn(`read proxy protocol header fail`, `error`, e)
+		return
+	}
+	// denied clients get no crypto work, the client is authenticated before the dialer is contacted
+	if !l.acl.Allowed(src.RemoteAddr().String()) {
+		src.Close()
+		l.log.Warn(`client not allowed`, `client`, src.RemoteAddr())
+		return
+	}
+	e = psk.Handshake(src)
+	if e != nil {
+		src.Close()
+		l.log.Warn(`psk handshake fail`, `error`, e, `client`, src.RemoteAddr())
+		return
+	}
+	ctx := dialer.WithLocalAddr(dialer.WithClientAddr(context.Background(), src.RemoteAddr()), src.LocalAddr())
+	if l.mux {
+		demux(l.log.With(`client`, src.RemoteAddr()), src, l.keepalive, l.done, func(stream io.ReadWriteCloser) {
+			l.bridge(ctx, src.RemoteAddr().String(), stream)
+		})
+	} else {
+		l.bridge(ctx, src.RemoteAddr().String(), src)
+	}
+}
+
+// bridge connects the dialer and bridges src with it
+func (l *BasicListener) bridge(ctx context.Context, client string, src io.ReadWriteCloser) {
+	dst, e := l.dialer.Connect(ctx)
 	if e != nil {
 		src.Close()
 		l.log.Warn(`connect fail`, `error`, e)
@@ -155,5 +270,10 @@ func (l *BasicListener) serve(src net.Conn) {
 		`secure`, addr.Secure,
 		`url`, addr.URL,
 	)
-	network.Bridging(src, dst.ReadWriteCloser, l.pool, l.duration)
+	l.nk.Bridging(network.Metadata{
+		Listener: l.tag,
+		Client:   client,
+		Dialer:   addr.Dialer,
+		Remote:   addr.Addr,
+	}, l.compress.Wrap(src), dst.ReadWriteCloser, l.pool, l.duration, l.limits)
 }
@@ -0,0 +1,315 @@
+package listener
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/certwatch"
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/pool"
+)
+
+// ConnectListener is a http forward proxy that only accepts CONNECT requests
+type ConnectListener struct {
+	nk        *network.Network
+	server    http.Server
+	listener  net.Listener
+	admission *network.Admission
+	watcher   *certwatch.Watcher
+	acl       *network.ACL
+	dialer    dialer.AddrDialer
+	pool      *pool.Pool
+	log       *slog.Logger
+	closed    uint32
+	duration  time.Duration
+	limits    network.Limits
+	timeout   time.Duration
+
+	allow []string
+	auth  map[string]string
+
+	tag, network, addr string
+	secure             bool
+}
+
+func NewConnectListener(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[string]dialer.Dialer,
+	connect *config.ConnectDialer, opts *config.BasicListener, proxy *config.ConnectProxy,
+) (listener *ConnectListener, e error) {
+	var timeout time.Duration
+	if proxy.Timeout == `` {
+		timeout = time.Second * 10
+	} else {
+		var err error
+		timeout, err = time.ParseDuration(proxy.Timeout)
+		if err != nil {
+			timeout = time.Second * 10
+			log.Warn(`parse duration fail, used default timeout duration.`,
+				`error`, err,
+				`timeout`, timeout,
+			)
+		}
+	}
+	allow := make([]string, 0, len(proxy.Allow))
+	for _, pattern := range proxy.Allow {
+		pattern = strings.ToLower(pattern)
+		if _, e = path.Match(pattern, ``); e != nil {
+			log.Error(`connect allow pattern invalid`, `error`, e, `pattern`, pattern)
+			return
+		}
+		allow = append(allow, pattern)
+	}
+	d, e := addrDialer(log, dialers, connect.Tag, timeout)
+	if e != nil {
+		return
+	}
+	mirror, e := dialer.NewMirror(log, dialers, connect)
+	if e != nil {
+		return
+	}
+	secure, certificate, _, e := opts.TLS.Certificate()
+	if e != nil {
+		log.Error(`new connect listener fail`, `error`, e)
+		return
+	}
+	admission := network.NewAdmission(&opts.Admission)
+	var l net.Listener
+	var watcher *certwatch.Watcher
+	if secure {
+		watcher = certwatch.New(&opts.TLS, certificate)
+		l, e = listenTLS(nk, opts, admission, &tls.Config{
+			GetCertificate: watcher.GetCertificate,
+			NextProtos:     []string{`http/1.1`},
+		})
+	} else {
+		l, e = listen(nk, opts, admission)
+	}
+	if e != nil {
+		log.Error(`new connect listener fail`, `error`, e)
+		return
+	}
+
+	addr := l.Addr()
+	tag := opts.Tag
+	if tag == `` {
+		if secure {
+			tag = `connect ` + addr.Network() + `+tls://` + addr.String()
+		} else {
+			tag = `connect ` + addr.Network() + `://` + addr.String()
+		}
+	}
+	admission.SetTag(tag)
+	acl, e := network.NewACL(tag, &opts.ACL)
+	if e != nil {
+		l.Close()
+		log.Error(`new connect listener fail`, `error`, e)
+		return
+	}
+	log = log.With(`listener`, tag, `dialer`, d.Tag())
+	watcher.Watch(log)
+	var duration time.Duration
+	if connect.Close == `` {
+		duration = time.Second
+	} else {
+		var err error
+		duration, err = time.ParseDuration(connect.Close)
+		if err != nil {
+			duration = time.Second
+			log.Warn(`parse duration fail, used default close duration.`,
+				`error`, err,
+				`close`, connect.Close,
+				`default`, duration,
+			)
+		}
+	}
+	var auth map[string]string
+	if len(proxy.Auth) != 0 {
+		auth = make(map[string]string, len(proxy.Auth))
+		for _, item := range proxy.Auth {
+			auth[item.Username] = item.Password
+		}
+	}
+	limits := network.NewLimits(log, connect)
+	limits.Listener, limits.Clients = shaper(opts)
+	limits.Mirror = mirror
+	log.Info(`new connect listener`,
+		`close`, duration,
+		`idleTimeout`, limits.Idle,
+		`maxLifetime`, limits.Lifetime,
+		`mirror`, connect.Mirror.Tag,
+		`timeout`, timeout,
+		`auth`, auth != nil,
+		`allow`, allow,
+	)
+	listener = &ConnectListener{
+		nk:        nk,
+		listener:  metrics.Listener(l, metrics.Accepted.With(tag)),
+		admission: admission,
+		watcher:   watcher,
+		acl:       acl,
+		dialer:    d,
+		pool:      pool,
+		log:       log,
+		duration:  duration,
+		limits:    limits,
+		timeout:   timeout,
+
+		allow: allow,
+		auth:  auth,
+
+		tag:     tag,
+		network: addr.Network(),
+		addr:    addr.String(),
+		secure:  secure,
+	}
+	listener.server.Handler = listener
+	listener.server.ReadHeaderTimeout = timeout
+	return
+}
+func (l *ConnectListener) Info() any {
+	users := make([]string, 0, len(l.auth))
+	for username := range l.auth {
+		users = append(users, username)
+	}
+	return map[string]any{
+		`tag`:         l.tag,
+		`network`:     l.network,
+		`addr`:        l.addr,
+		`secure`:      l.secure,
+		`dialer`:      l.dialer.Tag(),
+		`portal`:      false,
+		`admission`:   l.admission.Info(),
+		`certificate`: l.watcher.Info(),
+		`mirror`:      l.limits.Mirror.Info(),
+		`connect`: map[string]any{
+			`allow`:   l.allow,
+			`auth`:    users,
+			`timeout`: l.timeout.String(),
+		},
+	}
+}
+func (l *ConnectListener) Close() (e error) {
+	if l.closed == 0 && atomic.CompareAndSwapUint32(&l.closed, 0, 1) {
+		e = l.listener.Close()
+		l.watcher.Close()
+	} else {
+		e = ErrClosed
+	}
+	return
+}
+func (l *ConnectListener) Serve() (e error) {
+	e = l.server.Serve(l.listener)
+	if l.closed != 0 && atomic.LoadUint32(&l.closed) != 0 {
+		e = ErrClosed
+	}
+	return
+}
+func (l *ConnectListener) authorized(r *http.Request) bool {
+	if l.auth == nil {
+		return true
+	}
+	s := r.Header.Get(`Proxy-Authorization`)
+	if len(s) < 6 || !strings.EqualFold(s[:6], `Basic `) {
+		return false
+	}
+	b, e := base64.StdEncoding.DecodeString(s[6:])
+	if e != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(b), `:`)
+	if !ok {
+		return false
+	}
+	value, ok := l.auth[username]
+	return ok && value == password
+}
+func (l *ConnectListener) allowed(host, port string) bool {
+	if len(l.allow) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	hostport := net.JoinHostPort(host, port)
+	for _, pattern := range l.allow {
+		if ok, _ := path.Match(pattern, hostport); ok {
+			return true
+		} else if ok, _ = path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+func (l *ConnectListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := l.log.With(`client`, r.RemoteAddr, `connect`, r.Host)
+	if !l.acl.Allowed(r.RemoteAddr) {
+		log.Warn(`client not allowed`)
+		http.Error(w, `Forbidden`, http.StatusForbidden)
+		return
+	} else if r.Method != http.MethodConnect {
+		w.Header().Set(`Allow`, http.MethodConnect)
+		http.Error(w, `Method Not Allowed`, http.StatusMethodNotAllowed)
+		return
+	} else if !l.authorized(r) {
+		log.Warn(`proxy authorization not matched`)
+		w.Header().Set(`Proxy-Authenticate`, `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, `Proxy Authentication Required`, http.StatusProxyAuthRequired)
+		return
+	}
+	host, port, e := net.SplitHostPort(r.Host)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	} else if !l.allowed(host, port) {
+		log.Warn(`connect destination not allowed`)
+		http.Error(w, `Forbidden`, http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, `hijacking not supported`, http.StatusInternalServerError)
+		return
+	}
+	dst, e := l.dialer.ConnectAddr(clientContext(r), `tcp`, r.Host)
+	if e != nil {
+		log.Warn(`connect fail`, `error`, e)
+		http.Error(w, `Bad Gateway`, http.StatusBadGateway)
+		return
+	}
+	c, rw, e := hijacker.Hijack()
+	if e != nil {
+		dst.Close()
+		log.Warn(`hijack fail`, `error`, e)
+		return
+	}
+	_, e = c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if e != nil {
+		c.Close()
+		dst.Close()
+		log.Warn(`connect reply fail`, `error`, e)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	c = ioutil.NewBufferedConn(c, rw.Reader)
+	addr := dst.RemoteAddr()
+	log.Info(`bridge`,
+		`network`, addr.Network,
+		`addr`, addr.Addr,
+		`secure`, addr.Secure,
+		`url`, addr.URL,
+	)
+	l.nk.Bridging(network.Metadata{
+		Listener: l.tag,
+		Client:   c.RemoteAddr().String(),
+		Dialer:   addr.Dialer,
+		Remote:   addr.Addr,
+	}, c, dst.ReadWriteCloser, l.pool, l.duration, l.limits)
+}
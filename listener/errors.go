@@ -6,4 +6,5 @@ import (
 )
 
 var ErrClosed = errors.New("listener already closed")
+var errPskTLS = errors.New(`psk can not be used with tls`)
 var errHttpMethod = errors.New(`method must be "` + http.MethodPost + `" or "` + http.MethodPut + `" or "` + http.MethodPatch + `" or "WS"`)
@@ -1,13 +1,18 @@
 package listener
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,8 +20,11 @@ import (
 
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/certwatch"
+	"github.com/powerpuffpenguin/streamf/internal/compress"
 	"github.com/powerpuffpenguin/streamf/internal/httpmux"
 	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/internal/network"
 	"github.com/powerpuffpenguin/streamf/pool"
 	"github.com/powerpuffpenguin/streamf/third-party/websocket"
@@ -25,14 +33,20 @@ import (
 )
 
 type HttpListener struct {
-	done              chan struct{}
-	server            http.Server
-	listener          net.Listener
-	certFile, keyFile string
-	pool              *pool.Pool
-	log               *slog.Logger
-	closed            uint32
-	upgrader          *websocket.Upgrader
+	nk        *network.Network
+	done      chan struct{}
+	server    http.Server
+	listener  net.Listener
+	admission *network.Admission
+	acl       *network.ACL
+	trusted   []netip.Prefix
+	watcher   *certwatch.Watcher
+	pool      *pool.Pool
+	log       *slog.Logger
+	closed    uint32
+	upgrader  *websocket.Upgrader
+	shaper    *network.Shaper
+	clients   *network.Clients
 
 	closer []io.Closer
 
@@ -44,12 +58,117 @@ type HttpListener struct {
 
 func (l *HttpListener) Info() any {
 	return map[string]any{
-		`tag`:     l.tag,
-		`network`: l.network,
-		`addr`:    l.addr,
-		`secure`:  l.secure,
-		`portal`:  true,
-		`router`:  l.router,
+		`tag`:         l.tag,
+		`network`:     l.network,
+		`addr`:        l.addr,
+		`secure`:      l.secure,
+		`portal`:      true,
+		`admission`:   l.admission.Info(),
+		`certificate`: l.watcher.Info(),
+		`router`:      l.router,
+	}
+}
+
+// clientAddr returns the client address of r, for requests from trusted proxies it is
+// the rightmost address in X-Forwarded-For that is not a trusted proxy
+func (l *HttpListener) clientAddr(r *http.Request) (addr string) {
+	addr = r.RemoteAddr
+	if len(l.trusted) == 0 || !network.ContainsAddr(l.trusted, addr) {
+		return
+	}
+	values := r.Header.Values(`X-Forwarded-For`)
+	for i := len(values) - 1; i >= 0; i-- {
+		ips := strings.Split(values[i], `,`)
+		for j := len(ips) - 1; j >= 0; j-- {
+			ip := strings.TrimSpace(ips[j])
+			if ip == `` {
+				continue
+			}
+			addr = ip
+			if !network.ContainsAddr(l.trusted, ip) {
+				return
+			}
+		}
+	}
+	return
+}
+
+// allow rejects the requests from clients not allowed by acl with 403
+func (l *HttpListener) allow(next http.HandlerFunc, acl *network.ACL) http.HandlerFunc {
+	if acl == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if addr := l.clientAddr(r); !acl.Allowed(addr) {
+			l.log.Warn(`client not allowed`, `client`, addr, `path`, r.URL.Path)
+			http.Error(w, `Forbidden`, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// verify rejects the requests without a verified client certificate matching rule with 403
+func (l *HttpListener) verify(next http.HandlerFunc, rule *config.ClientCert) http.HandlerFunc {
+	if len(rule.CommonName) == 0 && len(rule.SAN) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			l.log.Warn(`client certificate required`, `client`, r.RemoteAddr, `path`, r.URL.Path)
+			http.Error(w, `client certificate required`, http.StatusForbidden)
+			return
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		if !matchCert(cert, rule) {
+			l.log.Warn(`client certificate not matched`,
+				`client`, r.RemoteAddr,
+				`path`, r.URL.Path,
+				`subject`, cert.Subject.String(),
+			)
+			http.Error(w, `client certificate not matched`, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// matchCert reports whether the subject common name or a subject alternative name of cert is in rule
+func matchCert(cert *x509.Certificate, rule *config.ClientCert) bool {
+	if slices.Contains(rule.CommonName, cert.Subject.CommonName) {
+		return true
+	}
+	for _, v := range rule.SAN {
+		if slices.Contains(cert.DNSNames, v) || slices.Contains(cert.EmailAddresses, v) {
+			return true
+		}
+		for _, ip := range cert.IPAddresses {
+			if ip.String() == v {
+				return true
+			}
+		}
+		for _, uri := range cert.URIs {
+			if uri.String() == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// admit rejects the requests over the limits of admission with 503, the client is the one clientAddr trusts
+func (l *HttpListener) admit(next http.HandlerFunc, admission *network.Admission) http.HandlerFunc {
+	if admission == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, reason, ok := admission.Admit(l.clientAddr(r))
+		if !ok {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		next(w, r)
 	}
 }
 func basicAuth(next http.HandlerFunc, auths []config.BasicAuth) http.HandlerFunc {
@@ -79,14 +198,32 @@ func NewHttpListener(nk *network.Network,
 	opts *config.BasicListener, routers []*config.Router,
 	idleTimeout string,
 ) (listener *HttpListener, e error) {
+	admission := network.NewAdmission(&opts.Admission)
 	var (
-		l      net.Listener
-		secure bool
+		l         net.Listener
+		secure    bool
+		tlsConfig *tls.Config
+		watcher   *certwatch.Watcher
 	)
 	if opts.TLS.CertFile != `` && opts.TLS.KeyFile != `` {
 		secure = true
+		var certificate tls.Certificate
+		_, certificate, _, e = opts.TLS.Certificate()
+		if e != nil {
+			log.Error(`new http listener fail`, `error`, e)
+			return
+		}
+		watcher = certwatch.New(&opts.TLS, certificate)
+		tlsConfig = &tls.Config{
+			GetCertificate: watcher.GetCertificate,
+		}
+		tlsConfig.ClientAuth, tlsConfig.ClientCAs, e = opts.TLS.ClientVerify()
+		if e != nil {
+			log.Error(`new http listener fail`, `error`, e)
+			return
+		}
 	}
-	l, e = nk.Listen(opts.Network, opts.Addr)
+	l, e = listen(nk, opts, admission)
 	if e != nil {
 		log.Error(`new http listener fail`, `error`, e)
 		return
@@ -100,19 +237,36 @@ func NewHttpListener(nk *network.Network,
 			tag = `http ` + addr.Network() + `://` + addr.String()
 		}
 	}
+	admission.SetTag(tag)
+	acl, e := network.NewACL(tag, &opts.ACL)
+	if e != nil {
+		l.Close()
+		log.Error(`new http listener fail`, `error`, e)
+		return
+	}
+	trusted, e := network.ParsePrefixes(opts.TrustedProxies)
+	if e != nil {
+		l.Close()
+		log.Error(`new http listener fail`, `error`, e)
+		return
+	}
 	log = log.With(`listener`, tag)
+	watcher.Watch(log)
 
 	log.Info(`new http listener`,
 		`network`, addr.Network(),
 		`addr`, addr.String(),
 	)
 	listener = &HttpListener{
-		done:     make(chan struct{}),
-		certFile: opts.TLS.CertFile,
-		keyFile:  opts.TLS.KeyFile,
-		listener: l,
-		pool:     pool,
-		log:      log,
+		nk:        nk,
+		done:      make(chan struct{}),
+		watcher:   watcher,
+		listener:  metrics.Listener(l, metrics.Accepted.With(tag)),
+		admission: admission,
+		acl:       acl,
+		trusted:   trusted,
+		pool:      pool,
+		log:       log,
 
 		tag:     tag,
 		network: addr.Network(),
@@ -121,11 +275,23 @@ func NewHttpListener(nk *network.Network,
 
 		router: make(map[string]any),
 	}
+	listener.server.TLSConfig = tlsConfig
+	listener.shaper, listener.clients = shaper(opts)
 	var (
 		mux     = httpmux.New(log)
 		handler http.HandlerFunc
 	)
 	for _, router := range routers {
+		var acl *network.ACL
+		acl, e = network.NewACL(tag+` `+strings.ToUpper(router.Method)+` `+router.Pattern, &router.ACL)
+		if e != nil {
+			listener.Close()
+			log.Error(`new router fail`, `error`, e, `pattern`, router.Pattern)
+			return
+		}
+		guard := func(next http.HandlerFunc) http.HandlerFunc {
+			return listener.allow(listener.verify(basicAuth(next, router.Auth), &router.ClientCert), acl)
+		}
 		switch strings.ToUpper(router.Method) {
 		case ``, http.MethodPost:
 			if router.Portal.Tag == `` {
@@ -137,7 +303,7 @@ func NewHttpListener(nk *network.Network,
 				listener.Close()
 				return
 			}
-			mux.Post(router.Pattern, basicAuth(handler, router.Auth))
+			mux.Post(router.Pattern, guard(handler))
 		case http.MethodPut:
 			if router.Portal.Tag == `` {
 				handler, e = listener.createHttp2(dialers, router)
@@ -148,7 +314,7 @@ func NewHttpListener(nk *network.Network,
 				listener.Close()
 				return
 			}
-			mux.Put(router.Pattern, basicAuth(handler, router.Auth))
+			mux.Put(router.Pattern, guard(handler))
 		case http.MethodPatch:
 			if router.Portal.Tag == `` {
 				handler, e = listener.createHttp2(dialers, router)
@@ -159,7 +325,7 @@ func NewHttpListener(nk *network.Network,
 				listener.Close()
 				return
 			}
-			mux.Patch(router.Pattern, basicAuth(handler, router.Auth))
+			mux.Patch(router.Pattern, guard(handler))
 		case `WS`:
 			if router.Portal.Tag == `` {
 				handler, e = listener.createWebsocket(dialers, router)
@@ -170,7 +336,7 @@ func NewHttpListener(nk *network.Network,
 				listener.Close()
 				return
 			}
-			mux.Get(router.Pattern, basicAuth(handler, router.Auth))
+			mux.Get(router.Pattern, guard(handler))
 		case `API`:
 			for _, item := range api {
 				pattern := path.Join(router.Pattern, item.Path)
@@ -180,32 +346,32 @@ func NewHttpListener(nk *network.Network,
 				for _, method := range item.Method {
 					switch method {
 					case http.MethodGet:
-						mux.Get(pattern, basicAuth(item.Handler, router.Auth))
-						mux.Head(pattern, basicAuth(item.Handler, router.Auth))
+						mux.Get(pattern, guard(item.Handler))
+						mux.Head(pattern, guard(item.Handler))
 						log.Info(`new api router`,
 							`method`, method,
 							`pattern`, pattern,
 						)
 					case http.MethodPost:
-						mux.Post(pattern, basicAuth(item.Handler, router.Auth))
+						mux.Post(pattern, guard(item.Handler))
 						log.Info(`new api router`,
 							`method`, method,
 							`pattern`, pattern,
 						)
 					case http.MethodPut:
-						mux.Put(pattern, basicAuth(item.Handler, router.Auth))
+						mux.Put(pattern, guard(item.Handler))
 						log.Info(`new api router`,
 							`method`, method,
 							`pattern`, pattern,
 						)
 					case http.MethodPatch:
-						mux.Patch(pattern, basicAuth(item.Handler, router.Auth))
+						mux.Patch(pattern, guard(item.Handler))
 						log.Info(`new api router`,
 							`method`, method,
 							`pattern`, pattern,
 						)
 					case http.MethodDelete:
-						mux.Delete(pattern, basicAuth(item.Handler, router.Auth))
+						mux.Delete(pattern, guard(item.Handler))
 						log.Info(`new api router`,
 							`method`, method,
 							`pattern`, pattern,
@@ -220,8 +386,8 @@ func NewHttpListener(nk *network.Network,
 			}
 			fs := http.FileServer(http.Dir(router.FS))
 			serveHTTP := http.StripPrefix(pattern, fs).ServeHTTP
-			mux.Head(pattern, basicAuth(serveHTTP, router.Auth))
-			mux.Get(pattern, basicAuth(serveHTTP, router.Auth))
+			mux.Head(pattern, guard(serveHTTP))
+			mux.Get(pattern, guard(serveHTTP))
 			log.Info(`new fs router`,
 				`pattern`, pattern,
 			)
@@ -236,7 +402,8 @@ func NewHttpListener(nk *network.Network,
 			return
 		}
 	}
-	listener.server.Handler = mux
+	root := listener.allow(mux.ServeHTTP, listener.acl)
+	listener.server.Handler = root
 
 	var timeout time.Duration
 	if idleTimeout == `` {
@@ -258,7 +425,7 @@ func NewHttpListener(nk *network.Network,
 		var http2Server http2.Server
 		http2Server.IdleTimeout = timeout
 
-		listener.server.Handler = h2c.NewHandler(mux, &http2Server)
+		listener.server.Handler = h2c.NewHandler(root, &http2Server)
 		e = http2.ConfigureServer(&listener.server, &http2Server)
 		if e != nil {
 			close(listener.done)
@@ -275,6 +442,15 @@ func NewHttpListener(nk *network.Network,
 	listener.server.IdleTimeout = timeout
 	return
 }
+
+// clientContext returns the request context carrying the client address and the address it connected to for dialers
+func clientContext(r *http.Request) context.Context {
+	ctx := dialer.WithClientAddr(r.Context(), network.NewAddr(`tcp`, r.RemoteAddr))
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		ctx = dialer.WithLocalAddr(ctx, addr)
+	}
+	return ctx
+}
 func (l *HttpListener) access(r *http.Request, accessToken string) bool {
 	if found, ok := r.Header[`Authorization`]; ok {
 		for _, access := range found {
@@ -294,6 +470,10 @@ func (l *HttpListener) access(r *http.Request, accessToken string) bool {
 }
 func (l *HttpListener) createHttp2(dialers map[string]dialer.Dialer, router *config.Router) (handler http.HandlerFunc, e error) {
 	log := l.log
+	mirror, e := dialer.NewMirror(log, dialers, &router.Dialer)
+	if e != nil {
+		return
+	}
 	dialer, ok := dialers[router.Dialer.Tag]
 	if !ok {
 		e = errors.New(`dialer not found: ` + router.Dialer.Tag)
@@ -315,6 +495,18 @@ func (l *HttpListener) createHttp2(dialers map[string]dialer.Dialer, router *con
 			)
 		}
 	}
+	limits := network.NewLimits(log, &router.Dialer)
+	limits.Listener, limits.Clients = l.shaper, l.clients
+	limits.Mirror = mirror
+	keepalive := muxKeepalive(log, &router.Mux)
+	e = compress.Check(router.Compress)
+	if e != nil {
+		log.Error(`new router fail`, `error`, e, `pattern`, router.Pattern)
+		return
+	}
+	stats := compress.New(router.Compress)
+	admission := network.NewAdmission(&router.Admission)
+	admission.SetTag(l.tag + ` ` + strings.ToUpper(router.Method) + ` ` + router.Pattern)
 
 	log = log.With(`method`, router.Method, `dialer`, router.Dialer.Tag)
 	var accessToken string
@@ -325,12 +517,18 @@ func (l *HttpListener) createHttp2(dialers map[string]dialer.Dialer, router *con
 		log.Info(`new router`,
 			`pattern`, router.Pattern,
 			`close`, closeDuration,
+			`mux`, router.Mux.Enable,
+			`compress`, router.Compress,
+			`mirror`, router.Dialer.Mirror.Tag,
 		)
 	} else {
 		log.Info(`new router`,
 			`pattern`, router.Pattern,
 			`access`, router.Access,
 			`close`, closeDuration,
+			`mux`, router.Mux.Enable,
+			`compress`, router.Compress,
+			`mirror`, router.Dialer.Mirror.Tag,
 		)
 	}
 	handler = func(w http.ResponseWriter, r *http.Request) {
@@ -341,7 +539,15 @@ func (l *HttpListener) createHttp2(dialers map[string]dialer.Dialer, router *con
 			w.Write([]byte(`access not matched`))
 			return
 		}
-		dst, e := dialer.Connect(r.Context())
+		if router.Mux.Enable {
+			w.WriteHeader(http.StatusOK)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			l.demux(log, r, ioutil.NewReadWriter(r.Body, w, r.Body), dialer, keepalive, stats, closeDuration, limits, router.Pattern)
+			return
+		}
+		dst, e := dialer.Connect(clientContext(r))
 		if e != nil {
 			log.Warn(`connect fail`,
 				`error`, e,
@@ -362,14 +568,28 @@ func (l *HttpListener) createHttp2(dialers map[string]dialer.Dialer, router *con
 		if f, ok := w.(http.Flusher); ok {
 			f.Flush()
 		}
-		network.Bridging(ioutil.NewReadWriter(r.Body, w, r.Body), dst.ReadWriteCloser, l.pool, closeDuration)
-	}
+		l.nk.Bridging(network.Metadata{
+			Listener: l.tag,
+			Client:   r.RemoteAddr,
+			Dialer:   addr.Dialer,
+			Remote:   addr.Addr,
+			Route:    router.Pattern,
+		}, stats.Wrap(ioutil.NewReadWriter(r.Body, w, r.Body)), dst.ReadWriteCloser, l.pool, closeDuration, limits)
+	}
+	handler = l.admit(handler, admission)
 
 	l.router[strings.ToUpper(router.Method)+` `+router.Pattern] = map[string]any{
-		`close`:  closeDuration.String(),
-		`access`: router.Access,
-		`dialer`: router.Dialer.Tag,
-		`auth`:   router.Auth,
+		`close`:       closeDuration.String(),
+		`idleTimeout`: limits.Idle.String(),
+		`maxLifetime`: limits.Lifetime.String(),
+		`admission`:   admission,
+		`access`:      router.Access,
+		`dialer`:      router.Dialer.Tag,
+		`mux`:         router.Mux.Enable,
+		`compress`:    stats,
+		`mirror`:      mirror,
+		`auth`:        router.Auth,
+		`clientCert`:  router.ClientCert,
 	}
 	return
 }
@@ -437,6 +657,7 @@ func (l *HttpListener) createHttp2Portal(nk *network.Network, router *config.Rou
 		`heartTimeout`: router.Portal.HeartTimeout,
 		`timeout`:      router.Portal.Timeout,
 		`auth`:         router.Auth,
+		`clientCert`:   router.ClientCert,
 	}
 	return
 }
@@ -572,12 +793,17 @@ func (l *HttpListener) createWebsocketPortal(nk *network.Network, router *config
 		`heartTimeout`: router.Portal.HeartTimeout,
 		`timeout`:      router.Portal.Timeout,
 		`auth`:         router.Auth,
+		`clientCert`:   router.ClientCert,
 	}
 	return
 }
 
 func (l *HttpListener) createWebsocket(dialers map[string]dialer.Dialer, router *config.Router) (handler http.HandlerFunc, e error) {
 	log := l.log
+	mirror, e := dialer.NewMirror(log, dialers, &router.Dialer)
+	if e != nil {
+		return
+	}
 	dialer, ok := dialers[router.Dialer.Tag]
 	if !ok {
 		e = errors.New(`dialer not found: ` + router.Dialer.Tag)
@@ -607,16 +833,34 @@ func (l *HttpListener) createWebsocket(dialers map[string]dialer.Dialer, router
 			)
 		}
 	}
+	limits := network.NewLimits(log, &router.Dialer)
+	limits.Listener, limits.Clients = l.shaper, l.clients
+	limits.Mirror = mirror
+	keepalive := muxKeepalive(log, &router.Mux)
+	e = compress.Check(router.Compress)
+	if e != nil {
+		log.Error(`new router fail`, `error`, e, `pattern`, router.Pattern)
+		return
+	}
+	stats := compress.New(router.Compress)
+	admission := network.NewAdmission(&router.Admission)
+	admission.SetTag(l.tag + ` ` + strings.ToUpper(router.Method) + ` ` + router.Pattern)
 	if router.Access == `` {
 		log.Info(`new router`,
 			`pattern`, router.Pattern,
 			`close`, closeDuration,
+			`mux`, router.Mux.Enable,
+			`compress`, router.Compress,
+			`mirror`, router.Dialer.Mirror.Tag,
 		)
 	} else {
 		log.Info(`new router`,
 			`pattern`, router.Pattern,
 			`access`, router.Access,
 			`close`, closeDuration,
+			`mux`, router.Mux.Enable,
+			`compress`, router.Compress,
+			`mirror`, router.Dialer.Mirror.Tag,
 		)
 	}
 	upgrader := l.getUpgrader()
@@ -635,7 +879,15 @@ func (l *HttpListener) createWebsocket(dialers map[string]dialer.Dialer, router
 			)
 			return
 		}
-		dst, e := dialer.Connect(r.Context())
+		if router.Mux.Enable {
+			if router.Fast {
+				l.demux(log, r, ws.NetConn(), dialer, keepalive, stats, closeDuration, limits, router.Pattern)
+			} else {
+				l.demux(log, r, httpmux.NewWebsocketConn(ws), dialer, keepalive, stats, closeDuration, limits, router.Pattern)
+			}
+			return
+		}
+		dst, e := dialer.Connect(clientContext(r))
 		if e != nil {
 			log.Warn(`connect fail`,
 				`error`, e,
@@ -651,16 +903,37 @@ func (l *HttpListener) createWebsocket(dialers map[string]dialer.Dialer, router
 			`url`, addr.URL,
 		)
 		if router.Fast {
-			network.Bridging(ws.NetConn(), dst.ReadWriteCloser, l.pool, closeDuration)
+			l.nk.Bridging(network.Metadata{
+				Listener: l.tag,
+				Client:   r.RemoteAddr,
+				Dialer:   addr.Dialer,
+				Remote:   addr.Addr,
+				Route:    router.Pattern,
+			}, stats.Wrap(ws.NetConn()), dst.ReadWriteCloser, l.pool, closeDuration, limits)
 		} else {
-			network.Bridging(httpmux.NewWebsocketConn(ws), dst.ReadWriteCloser, l.pool, closeDuration)
+			l.nk.Bridging(network.Metadata{
+				Listener: l.tag,
+				Client:   r.RemoteAddr,
+				Dialer:   addr.Dialer,
+				Remote:   addr.Addr,
+				Route:    router.Pattern,
+			}, stats.Wrap(httpmux.NewWebsocketConn(ws)), dst.ReadWriteCloser, l.pool, closeDuration, limits)
 		}
 	}
+	handler = l.admit(handler, admission)
+
 	l.router[`WebSocket `+router.Pattern] = map[string]any{
-		`close`:  closeDuration.String(),
-		`access`: router.Access,
-		`dialer`: router.Dialer.Tag,
-		`auth`:   router.Auth,
+		`close`:       closeDuration.String(),
+		`idleTimeout`: limits.Idle.String(),
+		`maxLifetime`: limits.Lifetime.String(),
+		`admission`:   admission,
+		`access`:      router.Access,
+		`dialer`:      router.Dialer.Tag,
+		`mux`:         router.Mux.Enable,
+		`compress`:    stats,
+		`mirror`:      mirror,
+		`auth`:        router.Auth,
+		`clientCert`:  router.ClientCert,
 	}
 	return
 }
@@ -685,14 +958,16 @@ func (l *HttpListener) Close() (e error) {
 			closer.Close()
 		}
 		e = l.listener.Close()
+		l.watcher.Close()
 	} else {
 		e = ErrClosed
 	}
 	return
 }
 func (l *HttpListener) Serve() (e error) {
-	if l.certFile != `` && l.keyFile != `` {
-		e = l.server.ServeTLS(l.listener, l.certFile, l.keyFile)
+	if l.secure {
+		// the certificate is served by l.server.TLSConfig.GetCertificate
+		e = l.server.ServeTLS(l.listener, ``, ``)
 	} else {
 		e = l.server.Serve(l.listener)
 	}
@@ -1,13 +1,17 @@
 package listener
 
 import (
+	"crypto/tls"
 	"errors"
 	"log/slog"
+	"net"
 
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/dialer"
 	"github.com/powerpuffpenguin/streamf/internal/httpmux"
 	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/internal/proxyproto"
+	"github.com/powerpuffpenguin/streamf/internal/psk"
 	"github.com/powerpuffpenguin/streamf/pool"
 )
 
@@ -18,9 +22,11 @@ type Listener interface {
 }
 
 const (
-	Basic  = `basic`
-	Http   = `http`
-	Portal = `portal`
+	Basic   = `basic`
+	Http    = `http`
+	Portal  = `portal`
+	Socks   = `socks`
+	Connect = `connect`
 )
 
 func New(nk *network.Network, log *slog.Logger,
@@ -31,7 +37,11 @@ func New(nk *network.Network, log *slog.Logger,
 	switch opts.Mode {
 	case Basic, "":
 		if found, ok := dialers[opts.Dialer.Tag]; ok {
-			l, e = NewBasicListener(nk, log, pool, found, &opts.Dialer, &opts.BasicListener)
+			var mirror *network.Mirror
+			mirror, e = dialer.NewMirror(log, dialers, &opts.Dialer)
+			if e == nil {
+				l, e = NewBasicListener(nk, log, pool, found, mirror, &opts.Dialer, &opts.BasicListener)
+			}
 		} else {
 			e = errors.New(`dialer not found: ` + opts.Dialer.Tag)
 			log.Error(`dialer not found`, `dialer`, opts.Dialer.Tag)
@@ -40,9 +50,55 @@ func New(nk *network.Network, log *slog.Logger,
 		l, e = NewHttpListener(nk, log, pool, dialers, api, &opts.BasicListener, opts.Router, opts.IdleTimeout)
 	case Portal:
 		l, e = NewPortalListener(nk, log, &opts.BasicListener, &opts.Portal)
+	case Socks:
+		l, e = NewSocksListener(nk, log, pool, dialers, &opts.Dialer, &opts.BasicListener, &opts.Socks)
+	case Connect:
+		l, e = NewConnectListener(nk, log, pool, dialers, &opts.Dialer, &opts.BasicListener, &opts.Connect)
 	default:
 		e = errors.New(`listener mode not supported: ` + opts.Mode)
 		log.Error(`listener mode not supported`, `mode`, opts.Mode)
 	}
 	return
 }
+
+// shaper returns the shapers shared by all connections of the listener opts
+func shaper(opts *config.BasicListener) (listener *network.Shaper, clients *network.Clients) {
+	return network.NewShaper(`listener`, &opts.Rate), network.NewClients(&opts.ClientRate)
+}
+
+// listen listens on opts, connections are admitted by admission before anything is read from them,
+// except that the connections per ip are checked against the PROXY protocol header if there is one.
+// If opts.ProxyProtocol is true connections must start with a PROXY protocol header,
+// if opts.PSK is not empty the rest of them is encrypted with it
+func listen(nk *network.Network, opts *config.BasicListener, admission *network.Admission) (l net.Listener, e error) {
+	if opts.PSK != `` && opts.TLS.Secure() {
+		e = errPskTLS
+		return
+	}
+	l, e = nk.Listen(opts.Network, opts.Addr)
+	if e != nil {
+		return
+	}
+	l = admission.Listener(l, opts.ProxyProtocol)
+	if opts.ProxyProtocol {
+		l = admission.ProxyListener(proxyproto.NewListener(l, proxyproto.DefaultTimeout))
+	}
+	if opts.PSK != `` {
+		l = psk.NewListener(l, opts.PSK, psk.DefaultTimeout)
+	}
+	return
+}
+
+// listenTLS is like listen but serves tls, the PROXY protocol header is read before the tls handshake.
+// Client certificates are verified as opts.TLS requires.
+func listenTLS(nk *network.Network, opts *config.BasicListener, admission *network.Admission, config *tls.Config) (l net.Listener, e error) {
+	config.ClientAuth, config.ClientCAs, e = opts.TLS.ClientVerify()
+	if e != nil {
+		return
+	}
+	l, e = listen(nk, opts, admission)
+	if e == nil {
+		l = tls.NewListener(l, config)
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package listener
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/compress"
+	"github.com/powerpuffpenguin/streamf/internal/mux"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+)
+
+// demux serves the streams multiplexed on carrier in new goroutines until it is closed.
+// After done is closed the peer is told to open no more streams, and carrier is closed when its streams finish.
+func demux(log *slog.Logger, carrier io.ReadWriteCloser, keepalive time.Duration, done <-chan struct{}, serve func(stream io.ReadWriteCloser)) {
+	session := mux.Server(carrier, keepalive)
+	go func() {
+		select {
+		case <-session.Done():
+			return
+		case <-done:
+		}
+		session.GoAway()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for session.NumStreams() != 0 {
+			select {
+			case <-session.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+		session.Close()
+	}()
+	log.Debug(`mux carrier accepted`)
+	for {
+		stream, e := session.Accept()
+		if e != nil {
+			log.Debug(`mux carrier closed`, `error`, e)
+			return
+		}
+		go serve(stream)
+	}
+}
+
+// muxKeepalive returns the keepalive interval of the carriers if conf is enabled
+func muxKeepalive(log *slog.Logger, conf *config.Mux) (keepalive time.Duration) {
+	if conf.Enable {
+		keepalive = mux.Keepalive(log, conf.Keepalive)
+	}
+	return
+}
+
+// demux bridges each stream multiplexed on carrier, the tunnel of the request r, with a connection of d.
+// The streams are decompressed if stats is not nil
+func (l *HttpListener) demux(log *slog.Logger, r *http.Request, carrier io.ReadWriteCloser, d dialer.Dialer,
+	keepalive time.Duration, stats *compress.Stats, closeDuration time.Duration, limits network.Limits, route string,
+) {
+	ctx := clientContext(r)
+	demux(log.With(`client`, r.RemoteAddr), carrier, keepalive, l.done, func(stream io.ReadWriteCloser) {
+		dst, e := d.Connect(ctx)
+		if e != nil {
+			stream.Close()
+			log.Warn(`connect fail`, `error`, e)
+			return
+		}
+		addr := dst.RemoteAddr()
+		log.Info(`bridge`,
+			`network`, addr.Network,
+			`addr`, addr.Addr,
+			`secure`, addr.Secure,
+			`url`, addr.URL,
+		)
+		l.nk.Bridging(network.Metadata{
+			Listener: l.tag,
+			Client:   r.RemoteAddr,
+			Dialer:   addr.Dialer,
+			Remote:   addr.Addr,
+			Route:    route,
+		}, stats.Wrap(stream), dst.ReadWriteCloser, l.pool, closeDuration, limits)
+	})
+}
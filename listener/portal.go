@@ -7,12 +7,14 @@ import (
 	"sync/atomic"
 
 	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/internal/certwatch"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/internal/network"
-	"github.com/powerpuffpenguin/vnet/reverse"
 )
 
 type PortalListener struct {
-	dialer             *reverse.Dialer
+	dialer             *network.Portal
+	watcher            *certwatch.Watcher
 	closed             uint32
 	log                *slog.Logger
 	tag, network, addr string
@@ -28,22 +30,22 @@ func NewPortalListener(nk *network.Network,
 		log.Error(`new portal listener fail`, `error`, e)
 		return
 	}
-	var l net.Listener
+	var (
+		l       net.Listener
+		watcher *certwatch.Watcher
+	)
 	if secure {
-		l, e = nk.ListenTLS(opts.Network, opts.Addr, &tls.Config{
-			Certificates: []tls.Certificate{certificate},
-			NextProtos:   alpn,
+		watcher = certwatch.New(&opts.TLS, certificate)
+		l, e = listenTLS(nk, opts, nil, &tls.Config{
+			GetCertificate: watcher.GetCertificate,
+			NextProtos:     alpn,
 		})
-		if e != nil {
-			log.Error(`new portal listener fail`, `error`, e)
-			return
-		}
 	} else {
-		l, e = nk.Listen(opts.Network, opts.Addr)
-		if e != nil {
-			log.Error(`new portal listener fail`, `error`, e)
-			return
-		}
+		l, e = listen(nk, opts, nil)
+	}
+	if e != nil {
+		log.Error(`new portal listener fail`, `error`, e)
+		return
 	}
 
 	addr := l.Addr()
@@ -51,6 +53,8 @@ func NewPortalListener(nk *network.Network,
 	if tag == `` {
 		if secure {
 			tag = `portal ` + addr.Network() + `+tls://` + addr.String()
+		} else if opts.PSK != `` {
+			tag = `portal ` + addr.Network() + `+psk://` + addr.String()
 		} else {
 			tag = `portal ` + addr.Network() + `://` + addr.String()
 		}
@@ -59,14 +63,16 @@ func NewPortalListener(nk *network.Network,
 	if portal.Tag == `` {
 		portal.Tag = tag
 	}
-	dialer, e := nk.NewPortal(log, l, portal)
+	dialer, e := nk.NewPortal(log, metrics.Listener(l, metrics.Accepted.With(tag)), portal)
 	if e != nil {
 		log.Error(`new portal listener fail`, `error`, e)
 		return
 	}
+	watcher.Watch(log)
 	listener = &PortalListener{
-		dialer: dialer,
-		log:    log,
+		dialer:  dialer,
+		watcher: watcher,
+		log:     log,
 
 		tag:     tag,
 		network: addr.Network(),
@@ -78,6 +84,7 @@ func NewPortalListener(nk *network.Network,
 func (l *PortalListener) Close() (e error) {
 	if l.closed == 0 && atomic.CompareAndSwapUint32(&l.closed, 0, 1) {
 		e = l.dialer.Close()
+		l.watcher.Close()
 	} else {
 		e = ErrClosed
 	}
@@ -89,10 +96,11 @@ func (l *PortalListener) Serve() error {
 }
 func (l *PortalListener) Info() any {
 	return map[string]any{
-		`tag`:     l.tag,
-		`network`: l.network,
-		`addr`:    l.addr,
-		`secure`:  l.secure,
-		`portal`:  true,
+		`tag`:         l.tag,
+		`network`:     l.network,
+		`addr`:        l.addr,
+		`secure`:      l.secure,
+		`portal`:      true,
+		`certificate`: l.watcher.Info(),
 	}
 }
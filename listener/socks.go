@@ -0,0 +1,704 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/powerpuffpenguin/streamf/config"
+	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/certwatch"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
+	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/pool"
+)
+
+const (
+	socksVersion     = 5
+	socksAuthVersion = 1
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded           = 0
+	socksRepGeneralFailure      = 1
+	socksRepHostUnreachable     = 4
+	socksRepConnectionRefused   = 5
+	socksRepCommandNotSupported = 7
+	socksRepAtypNotSupported    = 8
+)
+
+var errSocksVersion = errors.New(`socks version not supported`)
+var errSocksAtyp = errors.New(`socks address type not supported`)
+var errSocksAuth = errors.New(`socks authentication failed`)
+
+// SocksListener is a socks5 server, it supports CONNECT and UDP ASSOCIATE
+type SocksListener struct {
+	nk        *network.Network
+	listener  net.Listener
+	admission *network.Admission
+	watcher   *certwatch.Watcher
+	acl       *network.ACL
+	dialer    dialer.AddrDialer
+	pool      *pool.Pool
+	log       *slog.Logger
+	closed    uint32
+	duration  time.Duration
+	limits    network.Limits
+	timeout   time.Duration
+
+	auth map[string]string
+	udp  bool
+
+	tag, network, addr string
+	secure             bool
+}
+
+// addrDialer returns the dialer used to connect to requested destinations, if tag is empty the destination is dialed directly.
+func addrDialer(log *slog.Logger, dialers map[string]dialer.Dialer, tag string, timeout time.Duration) (d dialer.AddrDialer, e error) {
+	if tag == `` {
+		d = dialer.NewDirectDialer(log, timeout)
+		return
+	}
+	found, ok := dialers[tag]
+	if !ok {
+		e = errors.New(`dialer not found: ` + tag)
+		log.Error(`dialer not found`, `dialer`, tag)
+		return
+	}
+	d, ok = dialer.AsAddrDialer(found)
+	if !ok {
+		e = errors.New(`dialer cannot connect to any address: ` + tag)
+		log.Error(`dialer cannot connect to any address`, `dialer`, tag)
+		return
+	}
+	return
+}
+func NewSocksListener(nk *network.Network, log *slog.Logger, pool *pool.Pool, dialers map[string]dialer.Dialer,
+	connect *config.ConnectDialer, opts *config.BasicListener, socks *config.SocksServer,
+) (listener *SocksListener, e error) {
+	var timeout time.Duration
+	if socks.Timeout == `` {
+		timeout = time.Second * 10
+	} else {
+		var err error
+		timeout, err = time.ParseDuration(socks.Timeout)
+		if err != nil {
+			timeout = time.Second * 10
+			log.Warn(`parse duration fail, used default timeout duration.`,
+				`error`, err,
+				`timeout`, timeout,
+			)
+		}
+	}
+	if socks.UDP && connect.Tag != `` {
+		e = errors.New(`socks udp associate only supported by direct dialing`)
+		log.Error(`new socks listener fail`, `error`, e)
+		return
+	}
+	d, e := addrDialer(log, dialers, connect.Tag, timeout)
+	if e != nil {
+		return
+	}
+	mirror, e := dialer.NewMirror(log, dialers, connect)
+	if e != nil {
+		return
+	}
+	secure, certificate, alpn, e := opts.TLS.Certificate()
+	if e != nil {
+		log.Error(`new socks listener fail`, `error`, e)
+		return
+	}
+	admission := network.NewAdmission(&opts.Admission)
+	var l net.Listener
+	var watcher *certwatch.Watcher
+	if secure {
+		watcher = certwatch.New(&opts.TLS, certificate)
+		l, e = listenTLS(nk, opts, admission, &tls.Config{
+			GetCertificate: watcher.GetCertificate,
+			NextProtos:     alpn,
+		})
+	} else {
+		l, e = listen(nk, opts, admission)
+	}
+	if e != nil {
+		log.Error(`new socks listener fail`, `error`, e)
+		return
+	}
+
+	addr := l.Addr()
+	tag := opts.Tag
+	if tag == `` {
+		if secure {
+			tag = `socks ` + addr.Network() + `+tls://` + addr.String()
+		} else {
+			tag = `socks ` + addr.Network() + `://` + addr.String()
+		}
+	}
+	admission.SetTag(tag)
+	acl, e := network.NewACL(tag, &opts.ACL)
+	if e != nil {
+		l.Close()
+		log.Error(`new socks listener fail`, `error`, e)
+		return
+	}
+	log = log.With(`listener`, tag, `dialer`, d.Tag())
+	watcher.Watch(log)
+	var duration time.Duration
+	if connect.Close == `` {
+		duration = time.Second
+	} else {
+		var err error
+		duration, err = time.ParseDuration(connect.Close)
+		if err != nil {
+			duration = time.Second
+			log.Warn(`parse duration fail, used default close duration.`,
+				`error`, err,
+				`close`, connect.Close,
+				`default`, duration,
+			)
+		}
+	}
+	var auth map[string]string
+	if len(socks.Auth) != 0 {
+		auth = make(map[string]string, len(socks.Auth))
+		for _, item := range socks.Auth {
+			auth[item.Username] = item.Password
+		}
+	}
+	limits := network.NewLimits(log, connect)
+	limits.Listener, limits.Clients = shaper(opts)
+	limits.Mirror = mirror
+	log.Info(`new socks listener`,
+		`close`, duration,
+		`idleTimeout`, limits.Idle,
+		`maxLifetime`, limits.Lifetime,
+		`mirror`, connect.Mirror.Tag,
+		`timeout`, timeout,
+		`auth`, auth != nil,
+		`udp`, socks.UDP,
+	)
+	listener = &SocksListener{
+		nk:        nk,
+		listener:  metrics.Listener(l, metrics.Accepted.With(tag)),
+		admission: admission,
+		watcher:   watcher,
+		acl:       acl,
+		dialer:    d,
+		pool:      pool,
+		log:       log,
+		duration:  duration,
+		limits:    limits,
+		timeout:   timeout,
+
+		auth: auth,
+		udp:  socks.UDP,
+
+		tag:     tag,
+		network: addr.Network(),
+		addr:    addr.String(),
+		secure:  secure,
+	}
+	return
+}
+func (l *SocksListener) Info() any {
+	users := make([]string, 0, len(l.auth))
+	for username := range l.auth {
+		users = append(users, username)
+	}
+	return map[string]any{
+		`tag`:         l.tag,
+		`network`:     l.network,
+		`addr`:        l.addr,
+		`secure`:      l.secure,
+		`dialer`:      l.dialer.Tag(),
+		`portal`:      false,
+		`admission`:   l.admission.Info(),
+		`certificate`: l.watcher.Info(),
+		`mirror`:      l.limits.Mirror.Info(),
+		`socks`: map[string]any{
+			`auth`:    users,
+			`udp`:     l.udp,
+			`timeout`: l.timeout.String(),
+		},
+	}
+}
+func (l *SocksListener) Close() (e error) {
+	if l.closed == 0 && atomic.CompareAndSwapUint32(&l.closed, 0, 1) {
+		e = l.listener.Close()
+		l.watcher.Close()
+	} else {
+		e = ErrClosed
+	}
+	return
+}
+func (l *SocksListener) Serve() error {
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		rw, err := l.listener.Accept()
+		if err != nil {
+			if l.closed != 0 && atomic.LoadUint32(&l.closed) != 0 {
+				return ErrClosed
+			}
+
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if max := 1 * time.Second; tempDelay > max {
+				tempDelay = max
+			}
+			l.log.Warn(`socks accept fail`,
+				`error`, err,
+				`retrying`, tempDelay,
+			)
+			time.Sleep(tempDelay)
+			continue
+		}
+		go l.serve(rw)
+	}
+}
+func (l *SocksListener) serve(c net.Conn) {
+	log := l.log.With(`client`, c.RemoteAddr())
+	if !l.acl.Allowed(c.RemoteAddr().String()) {
+		c.Close()
+		log.Warn(`client not allowed`)
+		return
+	}
+	c.SetDeadline(time.Now().Add(l.timeout))
+	cmd, target, e := l.handshake(c)
+	if e != nil {
+		c.Close()
+		log.Warn(`socks handshake fail`, `error`, e)
+		return
+	}
+	switch cmd {
+	case socksCmdConnect:
+		l.serveConnect(log, c, target)
+	case socksCmdUDPAssociate:
+		if l.udp {
+			l.serveUDP(log, c)
+		} else {
+			writeSocksReply(c, socksRepCommandNotSupported, nil)
+			c.Close()
+			log.Warn(`socks udp associate not enabled`)
+		}
+	default:
+		writeSocksReply(c, socksRepCommandNotSupported, nil)
+		c.Close()
+		log.Warn(`socks command not supported`, `command`, cmd)
+	}
+}
+
+// handshake negotiates the authentication method and reads the request
+func (l *SocksListener) handshake(c net.Conn) (cmd byte, target string, e error) {
+	b := make([]byte, 256+2)
+	_, e = io.ReadFull(c, b[:2])
+	if e != nil {
+		return
+	} else if b[0] != socksVersion {
+		e = errSocksVersion
+		return
+	}
+	methods := b[2 : 2+int(b[1])]
+	_, e = io.ReadFull(c, methods)
+	if e != nil {
+		return
+	}
+	var method byte = socksAuthNoAcceptable
+	want := byte(socksAuthNone)
+	if l.auth != nil {
+		want = socksAuthPassword
+	}
+	for _, m := range methods {
+		if m == want {
+			method = want
+			break
+		}
+	}
+	_, e = c.Write([]byte{socksVersion, method})
+	if e != nil {
+		return
+	} else if method == socksAuthNoAcceptable {
+		e = errSocksAuth
+		return
+	} else if method == socksAuthPassword {
+		e = l.authenticate(c, b)
+		if e != nil {
+			return
+		}
+	}
+
+	// VER CMD RSV ATYP
+	_, e = io.ReadFull(c, b[:4])
+	if e != nil {
+		return
+	} else if b[0] != socksVersion {
+		e = errSocksVersion
+		return
+	}
+	cmd = b[1]
+	target, e = readSocksAddr(c, b[3], b)
+	if e == errSocksAtyp {
+		writeSocksReply(c, socksRepAtypNotSupported, nil)
+	}
+	return
+}
+func (l *SocksListener) authenticate(c net.Conn, b []byte) (e error) {
+	// VER ULEN UNAME PLEN PASSWD
+	_, e = io.ReadFull(c, b[:2])
+	if e != nil {
+		return
+	} else if b[0] != socksAuthVersion {
+		e = errSocksVersion
+		return
+	}
+	ulen := int(b[1])
+	_, e = io.ReadFull(c, b[:ulen+1])
+	if e != nil {
+		return
+	}
+	username := string(b[:ulen])
+	plen := int(b[ulen])
+	_, e = io.ReadFull(c, b[:plen])
+	if e != nil {
+		return
+	}
+	password := string(b[:plen])
+	if value, ok := l.auth[username]; ok && value == password {
+		_, e = c.Write([]byte{socksAuthVersion, 0})
+		return
+	}
+	c.Write([]byte{socksAuthVersion, 1})
+	e = errSocksAuth
+	return
+}
+func (l *SocksListener) serveConnect(log *slog.Logger, c net.Conn, target string) {
+	log = log.With(`connect`, target)
+	ctx := dialer.WithLocalAddr(dialer.WithClientAddr(context.Background(), c.RemoteAddr()), c.LocalAddr())
+	dst, e := l.dialer.ConnectAddr(ctx, `tcp`, target)
+	if e != nil {
+		writeSocksReply(c, socksReply(e), nil)
+		c.Close()
+		log.Warn(`connect fail`, `error`, e)
+		return
+	}
+	e = writeSocksReply(c, socksRepSucceeded, nil)
+	if e != nil {
+		c.Close()
+		dst.Close()
+		log.Warn(`socks reply fail`, `error`, e)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	addr := dst.RemoteAddr()
+	log.Info(`bridge`,
+		`network`, addr.Network,
+		`addr`, addr.Addr,
+		`secure`, addr.Secure,
+		`url`, addr.URL,
+	)
+	l.nk.Bridging(network.Metadata{
+		Listener: l.tag,
+		Client:   c.RemoteAddr().String(),
+		Dialer:   addr.Dialer,
+		Remote:   addr.Addr,
+	}, c, dst.ReadWriteCloser, l.pool, l.duration, l.limits)
+}
+
+// serveUDP relays udp datagrams for the client until the control connection is closed
+func (l *SocksListener) serveUDP(log *slog.Logger, c net.Conn) {
+	defer c.Close()
+	var ip net.IP
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	var client net.IP
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		client = addr.IP
+	}
+	uc, e := net.ListenUDP(`udp`, &net.UDPAddr{IP: ip})
+	if e != nil {
+		writeSocksReply(c, socksRepGeneralFailure, nil)
+		log.Warn(`socks listen udp fail`, `error`, e)
+		return
+	}
+	defer uc.Close()
+	e = writeSocksReply(c, socksRepSucceeded, uc.LocalAddr().(*net.UDPAddr))
+	if e != nil {
+		log.Warn(`socks reply fail`, `error`, e)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	log.Info(`udp associate`, `addr`, uc.LocalAddr())
+	go l.relayUDP(log, uc, client)
+	io.Copy(io.Discard, c)
+}
+func (l *SocksListener) relayUDP(log *slog.Logger, uc *net.UDPConn, client net.IP) {
+	var (
+		b       = l.pool.Get()
+		header  = make([]byte, 0, 3+1+16+2)
+		a       = newSocksAssociation(log, uc)
+		from    netip.AddrPort
+		peer    netip.AddrPort
+		n, size int
+		target  string
+		e       error
+	)
+	defer l.pool.Put(b)
+	clientIP, _ := netip.AddrFromSlice(client)
+	clientIP = clientIP.Unmap()
+	for {
+		n, from, e = uc.ReadFromUDPAddrPort(b)
+		if e != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if !peer.IsValid() && (!clientIP.IsValid() || clientIP == from.Addr()) ||
+			peer == from {
+			// RSV FRAG ATYP DST.ADDR DST.PORT DATA
+			if n < 4 || b[2] != 0 {
+				continue
+			}
+			target, size, e = parseSocksAddr(b[3:n], b[3])
+			if e != nil {
+				continue
+			}
+			peer = from
+			a.send(target, b[3+size:n])
+		} else if peer.IsValid() && a.isTarget(from) {
+			header = appendSocksAddr(append(header[:0], 0, 0, 0), net.UDPAddrFromAddrPort(from))
+			if len(header)+n > len(b) {
+				continue
+			}
+			copy(b[len(header):], b[:n])
+			copy(b, header)
+			uc.WriteToUDPAddrPort(b[:len(header)+n], peer)
+		}
+	}
+}
+
+const (
+	// how long a resolved domain of a udp associate is used
+	socksResolvedTTL = time.Minute
+	// at most this many domains are cached, resolved at the same time and targets are remembered for a udp associate
+	socksMaxResolved  = 256
+	socksMaxResolving = 16
+	socksMaxSent      = 4096
+)
+
+type socksResolved struct {
+	addr    netip.AddrPort
+	expires time.Time
+}
+
+// socksAssociation sends the datagrams of a udp associate and remembers their targets,
+// so that only the targets can reply. Domains are resolved off the relay loop and cached.
+type socksAssociation struct {
+	log *slog.Logger
+	uc  *net.UDPConn
+
+	mutex     sync.Mutex
+	resolved  map[string]socksResolved
+	resolving map[string]bool
+	sent      map[netip.AddrPort]bool
+}
+
+func newSocksAssociation(log *slog.Logger, uc *net.UDPConn) *socksAssociation {
+	return &socksAssociation{
+		log:       log,
+		uc:        uc,
+		resolved:  make(map[string]socksResolved),
+		resolving: make(map[string]bool),
+		sent:      make(map[netip.AddrPort]bool),
+	}
+}
+
+// send sends payload to target, the datagram is dropped if target is being resolved
+func (a *socksAssociation) send(target string, payload []byte) {
+	if to, e := netip.ParseAddrPort(target); e == nil {
+		a.sendTo(netip.AddrPortFrom(to.Addr().Unmap(), to.Port()), payload)
+		return
+	}
+	a.mutex.Lock()
+	resolved, ok := a.resolved[target]
+	if ok && time.Now().Before(resolved.expires) {
+		a.mutex.Unlock()
+		a.sendTo(resolved.addr, payload)
+		return
+	} else if a.resolving[target] || len(a.resolving) >= socksMaxResolving {
+		a.mutex.Unlock()
+		return
+	}
+	a.resolving[target] = true
+	a.mutex.Unlock()
+	go a.resolve(target, append([]byte(nil), payload...))
+}
+func (a *socksAssociation) resolve(target string, payload []byte) {
+	addr, e := net.ResolveUDPAddr(`udp`, target)
+	a.mutex.Lock()
+	delete(a.resolving, target)
+	if e == nil {
+		if len(a.resolved) >= socksMaxResolved {
+			clear(a.resolved)
+		}
+		to := addr.AddrPort()
+		to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
+		a.resolved[target] = socksResolved{
+			addr:    to,
+			expires: time.Now().Add(socksResolvedTTL),
+		}
+		a.mutex.Unlock()
+		a.sendTo(to, payload)
+	} else {
+		a.mutex.Unlock()
+		a.log.Debug(`socks resolve udp fail`, `error`, e, `connect`, target)
+	}
+}
+func (a *socksAssociation) sendTo(to netip.AddrPort, payload []byte) {
+	a.mutex.Lock()
+	if !a.sent[to] {
+		if len(a.sent) >= socksMaxSent {
+			clear(a.sent)
+		}
+		a.sent[to] = true
+	}
+	a.mutex.Unlock()
+	a.uc.WriteToUDPAddrPort(payload, to)
+}
+
+// isTarget reports whether from is a target the client has sent to
+func (a *socksAssociation) isTarget(from netip.AddrPort) bool {
+	a.mutex.Lock()
+	ok := a.sent[from]
+	a.mutex.Unlock()
+	return ok
+}
+
+func socksReply(e error) byte {
+	if errors.Is(e, syscall.ECONNREFUSED) {
+		return socksRepConnectionRefused
+	} else if errors.Is(e, os.ErrDeadlineExceeded) || errors.Is(e, context.DeadlineExceeded) {
+		return socksRepHostUnreachable
+	}
+	return socksRepGeneralFailure
+}
+
+// writeSocksReply writes VER REP RSV ATYP BND.ADDR BND.PORT
+func writeSocksReply(w io.Writer, rep byte, bind *net.UDPAddr) (e error) {
+	b := make([]byte, 0, 3+1+16+2)
+	b = append(b, socksVersion, rep, 0)
+	if bind == nil {
+		bind = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	b = appendSocksAddr(b, bind)
+	_, e = w.Write(b)
+	return
+}
+func appendSocksAddr(b []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// readSocksAddr reads DST.ADDR DST.PORT from a stream, b is a scratch buffer of at least 258 bytes
+func readSocksAddr(r io.Reader, atyp byte, b []byte) (addr string, e error) {
+	var host string
+	switch atyp {
+	case socksAtypIPv4:
+		_, e = io.ReadFull(r, b[:net.IPv4len])
+		if e != nil {
+			return
+		}
+		host = net.IP(b[:net.IPv4len]).String()
+	case socksAtypIPv6:
+		_, e = io.ReadFull(r, b[:net.IPv6len])
+		if e != nil {
+			return
+		}
+		host = net.IP(b[:net.IPv6len]).String()
+	case socksAtypDomain:
+		_, e = io.ReadFull(r, b[:1])
+		if e != nil {
+			return
+		}
+		size := int(b[0])
+		_, e = io.ReadFull(r, b[:size])
+		if e != nil {
+			return
+		}
+		host = string(b[:size])
+	default:
+		e = errSocksAtyp
+		return
+	}
+	_, e = io.ReadFull(r, b[:2])
+	if e != nil {
+		return
+	}
+	addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b))))
+	return
+}
+
+// parseSocksAddr parses ATYP DST.ADDR DST.PORT from a datagram, n is the length of the parsed bytes
+func parseSocksAddr(b []byte, atyp byte) (addr string, n int, e error) {
+	var host string
+	switch atyp {
+	case socksAtypIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			e = errSocksAtyp
+			return
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAtypIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			e = errSocksAtyp
+			return
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAtypDomain:
+		if len(b) < 2 {
+			e = errSocksAtyp
+			return
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			e = errSocksAtyp
+			return
+		}
+		host = string(b[2:n])
+	default:
+		e = errSocksAtyp
+		return
+	}
+	addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[n:]))))
+	n += 2
+	return
+}
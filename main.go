@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/forwarding"
@@ -58,9 +61,39 @@ func main() {
 	if logLevel != `` {
 		c.Logger.Level = logLevel
 	}
-	app, e := forwarding.NewApplication(&c)
+	app, e := forwarding.NewApplication(&c, func() (*config.Config, error) {
+		var c config.Config
+		e := c.Load(conf)
+		if e != nil {
+			return nil, e
+		}
+		if logLevel != `` {
+			c.Logger.Level = logLevel
+		}
+		return &c, nil
+	})
 	if e != nil {
 		return
 	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		for range ch {
+			app.Reload()
+		}
+	}()
+	go func() {
+		ch := make(chan os.Signal, 2)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+		ctx, cancel := context.WithTimeout(context.Background(), app.Drain())
+		go func() {
+			// a second signal closes the remaining connections immediately
+			<-ch
+			cancel()
+		}()
+		app.Shutdown(ctx)
+		cancel()
+	}()
 	app.Serve()
 }
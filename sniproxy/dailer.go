@@ -6,15 +6,20 @@ import (
 	"time"
 
 	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/network"
 )
 
 type accuracyMatcher struct {
 	dialer   dialer.Dialer
 	duration time.Duration
+	limits   network.Limits
+	acl      *network.ACL
 }
 type orderMatcher struct {
 	dialer   dialer.Dialer
 	duration time.Duration
+	limits   network.Limits
+	acl      *network.ACL
 
 	value  string
 	prefix bool
@@ -26,10 +31,18 @@ func (o *orderMatcher) Match(s string) bool {
 	}
 	return strings.HasSuffix(s, o.value)
 }
+func (o *orderMatcher) Route() string {
+	if o.prefix {
+		return `prefix ` + o.value
+	}
+	return `suffix ` + o.value
+}
 
 type regexpMatcher struct {
 	dialer   dialer.Dialer
 	duration time.Duration
+	limits   network.Limits
+	acl      *network.ACL
 
 	value *regexp.Regexp
 }
@@ -37,3 +50,6 @@ type regexpMatcher struct {
 func (o *regexpMatcher) Match(s string) bool {
 	return o.value.MatchString(s)
 }
+func (o *regexpMatcher) Route() string {
+	return `regexp ` + o.value.String()
+}
@@ -11,18 +11,24 @@ import (
 
 	"github.com/powerpuffpenguin/streamf/config"
 	"github.com/powerpuffpenguin/streamf/dialer"
+	"github.com/powerpuffpenguin/streamf/internal/ioutil"
+	"github.com/powerpuffpenguin/streamf/internal/metrics"
 	"github.com/powerpuffpenguin/streamf/internal/network"
+	"github.com/powerpuffpenguin/streamf/internal/proxyproto"
 	"github.com/powerpuffpenguin/streamf/pool"
 )
 
 var ErrClosed = errors.New("listener already closed")
 
 type Listener struct {
-	listener net.Listener
-	pool     *pool.Pool
-	log      *slog.Logger
-	closed   uint32
-	close    chan struct{}
+	nk        *network.Network
+	listener  net.Listener
+	admission *network.Admission
+	acl       *network.ACL
+	pool      *pool.Pool
+	log       *slog.Logger
+	closed    uint32
+	close     chan struct{}
 
 	timeout time.Duration
 
@@ -34,6 +40,7 @@ type Listener struct {
 
 	def, fallback                 dialer.Dialer
 	defDuration, fallbackDuration time.Duration
+	defLimits, fallbackLimits     network.Limits
 }
 
 func New(nk *network.Network, log *slog.Logger,
@@ -44,11 +51,23 @@ func New(nk *network.Network, log *slog.Logger,
 		log.Error(`new sniproxy listener fail`, `error`, e)
 		return
 	}
+	admission := network.NewAdmission(&opts.Admission)
+	l = admission.Listener(l, opts.ProxyProtocol)
+	if opts.ProxyProtocol {
+		l = admission.ProxyListener(proxyproto.NewListener(l, proxyproto.DefaultTimeout))
+	}
 	addr := l.Addr()
 	tag := opts.Tag
 	if tag == `` {
 		tag = `sniproxy ` + addr.Network() + `://` + addr.String()
 	}
+	admission.SetTag(tag)
+	acl, e := network.NewACL(tag, &opts.ACL)
+	if e != nil {
+		l.Close()
+		log.Error(`new sniproxy listener fail`, `error`, e)
+		return
+	}
 	log = log.With(`sniproxy`, tag)
 
 	var duration time.Duration
@@ -67,6 +86,10 @@ func New(nk *network.Network, log *slog.Logger,
 		}
 	}
 
+	var (
+		shaper  = network.NewShaper(`listener`, &opts.Rate)
+		clients = network.NewClients(&opts.ClientRate)
+	)
 	log.Info(`new sniproxy listener`,
 		`network`, addr.Network(),
 		`addr`, addr.String(),
@@ -75,6 +98,7 @@ func New(nk *network.Network, log *slog.Logger,
 	var (
 		def         dialer.Dialer
 		defDuration time.Duration
+		defLimits   network.Limits
 	)
 	if opts.Default.Tag != `` {
 		def = dialers[opts.Default.Tag]
@@ -95,6 +119,13 @@ func New(nk *network.Network, log *slog.Logger,
 				`default`, duration,
 			)
 		}
+		defLimits = network.NewLimits(log, &opts.Default)
+		defLimits.Listener, defLimits.Clients = shaper, clients
+		defLimits.Mirror, e = dialer.NewMirror(log, dialers, &opts.Default)
+		if e != nil {
+			l.Close()
+			return
+		}
 		log.Info(`sni default router`,
 			`dialer`, def.Tag(),
 			`close`, defDuration,
@@ -103,6 +134,7 @@ func New(nk *network.Network, log *slog.Logger,
 	var (
 		fallback         dialer.Dialer
 		fallbackDuration time.Duration
+		fallbackLimits   network.Limits
 	)
 	if opts.Fallback.Tag != `` {
 		fallback = dialers[opts.Fallback.Tag]
@@ -122,6 +154,13 @@ func New(nk *network.Network, log *slog.Logger,
 				`default`, duration,
 			)
 		}
+		fallbackLimits = network.NewLimits(log, &opts.Fallback)
+		fallbackLimits.Listener, fallbackLimits.Clients = shaper, clients
+		fallbackLimits.Mirror, e = dialer.NewMirror(log, dialers, &opts.Fallback)
+		if e != nil {
+			l.Close()
+			return
+		}
 		log.Info(`sni fallback router`,
 			`dialer`, fallback.Tag(),
 			`close`, fallbackDuration,
@@ -134,6 +173,12 @@ func New(nk *network.Network, log *slog.Logger,
 		reg      []regexpMatcher
 	)
 	for _, router := range opts.SNIRouter {
+		mirror, err := dialer.NewMirror(log, dialers, &router.Dialer)
+		if err != nil {
+			l.Close()
+			e = err
+			return
+		}
 		dialer := dialers[router.Dialer.Tag]
 		if dialer == nil {
 			l.Close()
@@ -151,6 +196,16 @@ func New(nk *network.Network, log *slog.Logger,
 				`default`, duration,
 			)
 		}
+		limits := network.NewLimits(log, &router.Dialer)
+		limits.Listener, limits.Clients = shaper, clients
+		limits.Mirror = mirror
+		routeACL, err := network.NewACL(tag, &router.ACL)
+		if err != nil {
+			l.Close()
+			e = err
+			log.Error(`new sni router fail`, `error`, err, `dialer`, router.Dialer.Tag)
+			return
+		}
 
 		for _, matcher := range router.Matcher {
 			switch matcher.Type {
@@ -164,6 +219,8 @@ func New(nk *network.Network, log *slog.Logger,
 				accuracy[matcher.Value] = accuracyMatcher{
 					dialer:   dialer,
 					duration: duration,
+					limits:   limits,
+					acl:      routeACL,
 				}
 				log.Info(`sni accuracy`,
 					`value`, matcher.Value,
@@ -173,6 +230,8 @@ func New(nk *network.Network, log *slog.Logger,
 				order = append(order, orderMatcher{
 					dialer:   dialer,
 					duration: duration,
+					limits:   limits,
+					acl:      routeACL,
 					prefix:   true,
 					value:    matcher.Value,
 				})
@@ -184,6 +243,8 @@ func New(nk *network.Network, log *slog.Logger,
 				order = append(order, orderMatcher{
 					dialer:   dialer,
 					duration: duration,
+					limits:   limits,
+					acl:      routeACL,
 					prefix:   false,
 					value:    matcher.Value,
 				})
@@ -205,6 +266,8 @@ func New(nk *network.Network, log *slog.Logger,
 				reg = append(reg, regexpMatcher{
 					dialer:   dialer,
 					duration: duration,
+					limits:   limits,
+					acl:      routeACL,
 					value:    r,
 				})
 				log.Info(`sni regexp`,
@@ -215,9 +278,12 @@ func New(nk *network.Network, log *slog.Logger,
 		}
 	}
 	listener = &Listener{
-		listener: l,
-		pool:     pool,
-		log:      log,
+		nk:        nk,
+		listener:  metrics.Listener(l, metrics.Accepted.With(tag)),
+		admission: admission,
+		acl:       acl,
+		pool:      pool,
+		log:       log,
 
 		timeout: duration,
 		close:   make(chan struct{}),
@@ -234,6 +300,8 @@ func New(nk *network.Network, log *slog.Logger,
 		fallback:         fallback,
 		defDuration:      defDuration,
 		fallbackDuration: fallbackDuration,
+		defLimits:        defLimits,
+		fallbackLimits:   fallbackLimits,
 	}
 	return
 }
@@ -252,6 +320,7 @@ func (l *Listener) Info() any {
 		`network`:       l.network,
 		`addr`:          l.addr,
 		`sniff-timeout`: l.timeout,
+		`admission`:     l.admission.Info(),
 	}
 }
 func (l *Listener) Serve() (e error) {
@@ -282,9 +351,20 @@ func (l *Listener) Serve() (e error) {
 	}
 }
 func (l *Listener) serve(c net.Conn) {
+	if e := proxyproto.Handshake(c); e != nil {
+		c.Close()
+		l.log.Warn(`read proxy protocol header fail`, `error`, e)
+		return
+	}
 	addr:=c.RemoteAddr()
-	timer := time.NewTimer(l.timeout)
 	log:=l.log.With(`addr`,addr)
+	if !l.acl.Allowed(addr.String()) {
+		c.Close()
+		log.Warn(`client not allowed`)
+		return
+	}
+	timer := time.NewTimer(l.timeout)
+	ctx := dialer.WithLocalAddr(dialer.WithClientAddr(context.Background(), addr), c.LocalAddr())
 	var (
 		serverName string
 		sniBuffer  []byte
@@ -313,18 +393,25 @@ func (l *Listener) serve(c net.Conn) {
 	if sniError != nil {
 		log.Warn(`get sni fail`, `error`, sniError)
 		if !sniClosed && l.fallback != nil {
-			dst, err := l.fallback.Connect(context.Background())
+			dst, err := l.fallback.Connect(ctx)
 			if err != nil {
 				log.Warn(`connect remote fail`, `error`, err)
 				c.Close()
 				return
 			}
+			metrics.SNIMatches.With(l.tag, `fallback`).Inc()
 			log.Info(`sni bridging fallback`, `dialer`, l.fallback.Tag(), `remote`, dst.RemoteAddr().Addr)
-			network.Bridging(&sniConn{
+			l.nk.Bridging(network.Metadata{
+				Listener: l.tag,
+				Client:   addr.String(),
+				Dialer:   dst.RemoteAddr().Dialer,
+				Remote:   dst.RemoteAddr().Addr,
+				Route:    `fallback`,
+			}, &sniConn{
 				Conn:   c,
 				buffer: sniBuffer,
 				pool:   l.pool,
-			}, dst.ReadWriteCloser, l.pool, l.fallbackDuration)
+			}, dst.ReadWriteCloser, l.pool, l.fallbackDuration, l.fallbackLimits)
 			return
 		}
 		c.Close()
@@ -334,74 +421,122 @@ func (l *Listener) serve(c net.Conn) {
 
 	// 優先匹配最精準的路由
 	if matcher, ok := l.accuracy[serverName]; ok {
-		dst, err := matcher.dialer.Connect(context.Background())
+		if !matcher.acl.Allowed(addr.String()) {
+			log.Warn(`client not allowed`, `route`, `equal `+serverName)
+			c.Close()
+			return
+		}
+		dst, err := matcher.dialer.Connect(ctx)
 		if err != nil {
 			log.Warn(`connect remote fail`, `error`, err)
 			c.Close()
 			return
 		}
+		metrics.SNIMatches.With(l.tag, `equal `+serverName).Inc()
 		log.Info(`sni bridging accuracy`, `dialer`, matcher.dialer.Tag(), `remote`, dst.RemoteAddr().Addr)
-		network.Bridging(&sniConn{
+		l.nk.Bridging(network.Metadata{
+			Listener: l.tag,
+			Client:   addr.String(),
+			Dialer:   dst.RemoteAddr().Dialer,
+			Remote:   dst.RemoteAddr().Addr,
+			SNI:      serverName,
+			Route:    `equal ` + serverName,
+		}, &sniConn{
 			Conn:   c,
 			buffer: sniBuffer,
 			pool:   l.pool,
-		}, dst.ReadWriteCloser, l.pool, matcher.duration)
+		}, dst.ReadWriteCloser, l.pool, matcher.duration, matcher.limits)
 		return
 	}
 	// 按順序匹配 前綴/後綴 路由
 	for _, matcher := range l.order {
 		if matcher.Match(serverName) {
-			dst, err := matcher.dialer.Connect(context.Background())
+			if !matcher.acl.Allowed(addr.String()) {
+				log.Warn(`client not allowed`, `route`, matcher.Route())
+				c.Close()
+				return
+			}
+			dst, err := matcher.dialer.Connect(ctx)
 			if err != nil {
 				log.Warn(`connect remote fail`, `error`, err)
 				c.Close()
 				return
 			}
+			metrics.SNIMatches.With(l.tag, matcher.Route()).Inc()
 			log.Info(`sni bridging order`, `dialer`, matcher.dialer.Tag(), `remote`, dst.RemoteAddr().Addr)
-			network.Bridging(&sniConn{
+			l.nk.Bridging(network.Metadata{
+				Listener: l.tag,
+				Client:   addr.String(),
+				Dialer:   dst.RemoteAddr().Dialer,
+				Remote:   dst.RemoteAddr().Addr,
+				SNI:      serverName,
+				Route:    matcher.Route(),
+			}, &sniConn{
 				Conn:   c,
 				buffer: sniBuffer,
 				pool:   l.pool,
-			}, dst.ReadWriteCloser, l.pool, matcher.duration)
+			}, dst.ReadWriteCloser, l.pool, matcher.duration, matcher.limits)
 			return
 		}
 	}
 	// 最後匹配 最慢的 正則路由
 	for _, matcher := range l.regexp {
 		if matcher.Match(serverName) {
-			dst, err := matcher.dialer.Connect(context.Background())
+			if !matcher.acl.Allowed(addr.String()) {
+				log.Warn(`client not allowed`, `route`, matcher.Route())
+				c.Close()
+				return
+			}
+			dst, err := matcher.dialer.Connect(ctx)
 			if err != nil {
 				log.Warn(`connect remote fail`, `error`, err)
 				c.Close()
 				return
 			}
+			metrics.SNIMatches.With(l.tag, matcher.Route()).Inc()
 			log.Info(`sni bridging regexp`, `dialer`, matcher.dialer.Tag(), `remote`, dst.RemoteAddr().Addr)
-			network.Bridging(&sniConn{
+			l.nk.Bridging(network.Metadata{
+				Listener: l.tag,
+				Client:   addr.String(),
+				Dialer:   dst.RemoteAddr().Dialer,
+				Remote:   dst.RemoteAddr().Addr,
+				SNI:      serverName,
+				Route:    matcher.Route(),
+			}, &sniConn{
 				Conn:   c,
 				buffer: sniBuffer,
 				pool:   l.pool,
-			}, dst.ReadWriteCloser, l.pool, matcher.duration)
+			}, dst.ReadWriteCloser, l.pool, matcher.duration, matcher.limits)
 			return
 		}
 	}
 	// 默認路由
 	if l.def != nil {
-		dst, err := l.def.Connect(context.Background())
+		dst, err := l.def.Connect(ctx)
 		if err != nil {
 			log.Warn(`connect remote fail`, `error`, err)
 			c.Close()
 			return
 		}
+		metrics.SNIMatches.With(l.tag, `default`).Inc()
 		log.Info(`sni bridging default`, `dialer`, l.def.Tag(), `remote`, dst.RemoteAddr().Addr)
-		network.Bridging(&sniConn{
+		l.nk.Bridging(network.Metadata{
+			Listener: l.tag,
+			Client:   addr.String(),
+			Dialer:   dst.RemoteAddr().Dialer,
+			Remote:   dst.RemoteAddr().Addr,
+			SNI:      serverName,
+			Route:    `default`,
+		}, &sniConn{
 			Conn:   c,
 			buffer: sniBuffer,
 			pool:   l.pool,
-		}, dst.ReadWriteCloser, l.pool, l.defDuration)
+		}, dst.ReadWriteCloser, l.pool, l.defDuration, l.defLimits)
 		return
 	}
 
 	// 沒有匹配路由
+	metrics.SNIMatches.With(l.tag, `none`).Inc()
 	c.Close()
 }
 
@@ -412,6 +547,9 @@ type sniConn struct {
 	pool   *pool.Pool
 }
 
+func (s *sniConn) CloseWrite() error {
+	return ioutil.CloseWrite(s.Conn)
+}
 func (s *sniConn) Read(b []byte) (int, error) {
 	if s.buffer != nil {
 		if len(b) == 0 {